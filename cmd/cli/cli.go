@@ -3,25 +3,61 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
-	"net"
+	"net/netip"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/Escape-Technologies/cloudfinder/internal/log"
 	"github.com/Escape-Technologies/cloudfinder/pkg/cloud"
+	"github.com/Escape-Technologies/cloudfinder/pkg/dns"
 	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
 )
 
 // Version is injected during build
 var version string
 
+const defaultConcurrency = 10
+
 type args struct {
 	inputs chan string
 	debug  bool
 	mode   outputMode
+	// Print every matching range instead of the most specific one
+	all bool
+	// Load range data from this path instead of the embedded snapshot
+	dataPath string
+	// Custom providers and ranges configuration file
+	configPath string
+	// Prefix to origin AS dataset, the ASN of each ip is printed when set
+	asnDataPath string
+	// Inputs processed at the same time
+	concurrency int
+	// Print each input as soon as it is processed, instead of in input order
+	unordered bool
+	// Maximum inputs started per second, 0 for no limit
+	rate float64
+	// Log the number of processed inputs to stderr
+	progress bool
+	// Comma separated DNS servers, the system ones when empty
+	dnsServers string
+	dnsTimeout time.Duration
+	dnsRetries int
+	// Only look up A (-4) or AAAA (-6) records
+	ipv4Only, ipv6Only bool
+	// Follow the CNAME chain of hosts, CNAME rules take priority over the ranges
+	cname bool
+	// Classify cidr and range inputs by blocks instead of expanding them to their addresses
+	blocks bool
 }
 
 func printUsage() {
@@ -75,10 +111,51 @@ func getInputs(in *chan string) {
 	}
 }
 
+// lookupFlags registers the flags shared by the cli and serve: range data, DNS resolution and what to look up
+func lookupFlags(fs *flag.FlagSet, a *args) {
+	fs.BoolVar(&a.debug, "debug", false, "enable debug mode")
+	fs.BoolVar(&a.all, "all", false, "print all matching providers, from the most to the least specific")
+	fs.StringVar(&a.dataPath, "data", "", "load range data from a directory (trees or <provider>.txt ranges files) or a ranges file instead of the embedded snapshot")
+	fs.StringVar(&a.configPath, "config", "", "load custom providers and ranges from a json file, they take priority over the provider data")
+	fs.IntVar(&a.concurrency, "concurrency", defaultConcurrency, "number of inputs processed at the same time")
+	fs.IntVar(&a.concurrency, "c", defaultConcurrency, "shorthand for -concurrency")
+	fs.StringVar(&a.dnsServers, "dns", "", "comma separated DNS servers instead of the system ones: 1.1.1.1, tcp://1.1.1.1, tls://1.1.1.1 (DNS-over-TLS) or https://1.1.1.1/dns-query (DNS-over-HTTPS)")
+	fs.DurationVar(&a.dnsTimeout, "dns-timeout", dns.DefaultTimeout, "timeout of each DNS lookup attempt")
+	fs.IntVar(&a.dnsRetries, "dns-retries", dns.DefaultRetries, "retries of a failed DNS lookup, on the next DNS server")
+	fs.BoolVar(&a.ipv4Only, "4", false, "only look up IPv4 addresses (A records)")
+	fs.BoolVar(&a.ipv6Only, "6", false, "only look up IPv6 addresses (AAAA records)")
+	fs.BoolVar(&a.cname, "cname", false, "follow the CNAME chain of hosts and print it, a provider matching a CNAME target (eg. *.cloudfront.net) takes priority over the ip ranges")
+	fs.BoolVar(&a.blocks, "blocks", false, "classify cidr and range inputs (10.0.0.0/16, 1.2.3.4-1.2.3.200) by blocks of a single provider, instead of looking up each address")
+	fs.StringVar(&a.asnDataPath, "asn", "", "print the origin AS of each ip, from a prefix to ASN dataset written by pre-build -write-asn")
+}
+
+// validate checks the flags of lookupFlags
+func (a *args) validate() error {
+	if a.concurrency < 1 {
+		return errors.New("-concurrency must be at least 1")
+	}
+	if a.ipv4Only && a.ipv6Only {
+		return errors.New("-4 and -6 are exclusive")
+	}
+	return nil
+}
+
+// setLogger sets the right logger, shared by the cli output and the resolver
+func setLogger(debug bool) {
+	if debug {
+		log.Logger = log.NewLogger(slog.LevelDebug)
+	} else {
+		log.Logger = log.NewPrettyLogger(slog.LevelInfo)
+	}
+}
+
 func parseArgs() args {
 	a := args{}
 	a.mode = outputDefault
-	flag.BoolVar(&a.debug, "debug", false, "enable debug mode")
+	lookupFlags(flag.CommandLine, &a)
+	flag.BoolVar(&a.unordered, "unordered", false, "print each input as soon as it is resolved, instead of in input order")
+	flag.Float64Var(&a.rate, "rate", 0, "maximum inputs processed per second, eg. to spare a DNS resolver (0 for no limit)")
+	flag.BoolVar(&a.progress, "progress", false, "log the number of processed inputs to stderr every second")
 
 	var showVersion, json, raw, help bool
 	flag.BoolVar(&showVersion, "version", false, "print version number")
@@ -101,6 +178,11 @@ func parseArgs() args {
 		os.Exit(0)
 	}
 
+	if err := a.validate(); err != nil {
+		println("ERROR: " + err.Error())
+		os.Exit(1)
+	}
+
 	switch {
 	case json:
 		a.mode = outputJson
@@ -114,27 +196,112 @@ func parseArgs() args {
 }
 
 func main() {
-	r := cloud.NewResolver()
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serve(os.Args[2:])
+		return
+	}
 	a := parseArgs()
+	setLogger(a.debug)
 
-	// Set the right logger
-	if a.debug {
-		r.WithLogger(log.NewLogger(slog.LevelDebug))
-	} else {
-		r.WithLogger(log.NewPrettyLogger(slog.LevelInfo))
+	r, err := newResolver(a)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
 	}
 
-	for i := range a.inputs {
-		ips, err := getIPsForURL(context.Background(), i)
-		if err != nil {
-			log.Error("Failed to get ips, verify input", err)
+	dnsResolver, err := newDNSResolver(a)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+
+	p := newPool(a, r, dnsResolver)
+	p.ordered = !a.unordered
+	if a.rate > 0 {
+		p.interval = time.Duration(float64(time.Second) / a.rate)
+	}
+
+	if a.progress {
+		p.progress = time.Second
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	out := bufio.NewWriter(os.Stdout)
+	p.run(ctx, a.inputs, func(l lookup) {
+		printLookup(out, l, a.mode)
+		// Flush each input, so that the output can be followed (eg. piped to jq)
+		_ = out.Flush()
+	})
+}
+
+// newPool creates a pool looking up inputs as set by the flags of lookupFlags
+func newPool(a args, r cloud.Resolver, dnsResolver *dns.Resolver) *pool {
+	p := &pool{
+		workers: a.concurrency,
+		ordered: true,
+		resolveIPs: func(ctx context.Context, input string) ([]netip.Addr, error) {
+			return getIPsForURL(ctx, dnsResolver, input)
+		},
+		resolver: r,
+		all:      a.all,
+		asn:      a.asnDataPath != "",
+		blocks:   a.blocks,
+	}
+	if a.cname {
+		p.resolveCNAMEs = func(ctx context.Context, input string) ([]string, error) {
+			return getCNAMEChainForURL(ctx, dnsResolver, input)
+		}
+	}
+	return p
+}
+
+// Print the matches of an input, or the error of its DNS lookup
+func printLookup(w io.Writer, l lookup, mode outputMode) {
+	if l.err != nil {
+		log.Error("Failed to get ips, verify input", l.err)
+		return
+	}
+	for _, m := range l.matches {
+		if m.layers != nil {
+			printAllOutput(w, l.input, m, l.chain, mode)
+		} else {
+			printOutput(w, l.input, m, l.chain, mode)
 		}
+	}
+}
 
-		for _, ip := range ips {
-			p := r.GetProviderForIP(ip)
-			printOutput(i, ip, p, a.mode)
+func newResolver(a args) (cloud.Resolver, error) {
+	opts := []cloud.Option{cloud.WithLogger(log.Logger)}
+	if a.configPath != "" {
+		ranges, err := cloud.LoadConfig(a.configPath)
+		if err != nil {
+			return nil, err
 		}
+		opts = append(opts, cloud.WithCustomRanges(ranges...))
 	}
+	if a.asnDataPath != "" {
+		opts = append(opts, cloud.WithASNData(a.asnDataPath))
+	}
+
+	if a.dataPath == "" {
+		return cloud.New(opts...)
+	}
+	return cloud.NewResolverFromPath(a.dataPath, opts...)
+}
+
+func newDNSResolver(a args) (*dns.Resolver, error) {
+	opts := []dns.Option{dns.WithTimeout(a.dnsTimeout), dns.WithRetries(a.dnsRetries)}
+	if a.dnsServers != "" {
+		opts = append(opts, dns.WithServers(strings.Split(a.dnsServers, ",")...))
+	}
+	switch {
+	case a.ipv4Only:
+		opts = append(opts, dns.WithFamily(dns.FamilyIPv4))
+	case a.ipv6Only:
+		opts = append(opts, dns.WithFamily(dns.FamilyIPv6))
+	}
+	return dns.NewResolver(opts...)
 }
 
 type outputMode int
@@ -145,15 +312,66 @@ const (
 	outputJson // nolint:revive
 )
 
-func marshallOutput(input string, ip net.IP, p provider.Provider) string {
+type jsonLayer struct {
+	P        string `json:"provider"`
+	Network  string `json:"network,omitempty"`
+	Region   string `json:"region,omitempty"`
+	Service  string `json:"service,omitempty"`
+	Category string `json:"category,omitempty"`
+	// What decided the provider and the matched CNAME target, only output with -cname
+	Signal string `json:"signal,omitempty"`
+	CNAME  string `json:"cname,omitempty"`
+}
+
+func toJSONLayer(res cloud.Result, signal bool) jsonLayer {
+	layer := jsonLayer{
+		P:        res.Provider.String(),
+		Region:   res.Region,
+		Service:  res.Service,
+		Category: res.Category.String(),
+		CNAME:    res.CNAME,
+	}
+	if res.Prefix.IsValid() {
+		layer.Network = res.Prefix.String()
+	}
+	if signal {
+		layer.Signal = string(res.Signal)
+	}
+	return layer
+}
+
+// layers is only output when not nil (-all flag), the asn fields when the AS of m is not nil and known (-asn flag),
+// the signal and the CNAME chain when chain is not nil (-cname flag). Blocks (-blocks flag) replace the ip.
+func marshallOutput(input string, m match, res cloud.Result, layers []cloud.Result, chain []string) string {
 	toMarshall := struct {
 		Input string `json:"input"`
-		IP    string `json:"ip"`
-		P     string `json:"provider"`
+		IP    string `json:"ip,omitempty"`
+		Block string `json:"block,omitempty"`
+		jsonLayer
+		Chain  []string     `json:"cname_chain,omitempty"`
+		ASN    uint32       `json:"asn,omitempty"`
+		ASName string       `json:"as_name,omitempty"`
+		Layers *[]jsonLayer `json:"layers,omitempty"`
 	}{
-		Input: input,
-		IP:    ip.String(),
-		P:     p.String(),
+		Input:     input,
+		jsonLayer: toJSONLayer(res, chain != nil),
+		Chain:     chain,
+	}
+	if m.block.IsValid() {
+		toMarshall.Block = m.block.String()
+	} else {
+		toMarshall.IP = m.ip.String()
+	}
+	if m.as != nil {
+		toMarshall.ASN = m.as.Number
+		toMarshall.ASName = m.as.Name
+	}
+	if layers != nil {
+		jsonLayers := make([]jsonLayer, 0, len(layers))
+		for _, l := range layers {
+			jsonLayers = append(jsonLayers, toJSONLayer(l, chain != nil))
+		}
+		toMarshall.Layers = &jsonLayers
 	}
 	bytes, err := json.Marshal(toMarshall)
 	if err != nil {
@@ -162,15 +380,104 @@ func marshallOutput(input string, ip net.IP, p provider.Provider) string {
 	return string(bytes)
 }
 
-func printOutput(input string, ip net.IP, p provider.Provider, mode outputMode) {
+// Human readable provider, with the category, service and region when known, eg. "Aws (compute, EC2 eu-west-3)"
+func describeResult(res cloud.Result) string {
+	details := make([]string, 0, 2) // nolint:mnd
+	if res.Category != provider.CategoryUnknown {
+		details = append(details, res.Category.String())
+	}
+	if location := strings.TrimSpace(res.Service + " " + res.Region); location != "" {
+		details = append(details, location)
+	}
+	if len(details) == 0 {
+		return res.Provider.String()
+	}
+	return fmt.Sprintf("%s (%s)", res.Provider.String(), strings.Join(details, ", "))
+}
+
+// Human readable origin AS, eg. " [AS16509 AMAZON-02]", empty when as is nil or unknown
+func describeASN(as *cloud.ASN) string {
+	if as == nil || as.Number == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" [%s]", strings.TrimSpace(as.String()+" "+as.Name))
+}
+
+// What decided the provider and the CNAME chain, eg. " from cname d111.cloudfront.net (www.example.com >
+// d111.cloudfront.net)". Empty when chain is nil.
+func describeSignal(res cloud.Result, chain []string) string {
+	if chain == nil {
+		return ""
+	}
+	description := ""
+	switch res.Signal {
+	case cloud.SignalCNAME:
+		description = " from cname " + res.CNAME
+	case cloud.SignalRange:
+		description = " from range " + res.Prefix.String()
+	}
+	if len(chain) > 1 {
+		description += fmt.Sprintf(" (%s)", strings.Join(chain, " > "))
+	}
+	return description
+}
+
+// Print the match of an ip or a block, json and raw lines go to w
+func printOutput(w io.Writer, input string, m match, chain []string, mode outputMode) {
+	switch mode {
+	case outputDefault:
+		log.Info("%s (%s): %s%s%s", input, m.target(), describeResult(m.res), describeSignal(m.res, chain),
+			describeASN(m.as))
+	case outputJson:
+		_, _ = fmt.Fprintln(w, marshallOutput(input, m, m.res, nil, chain))
+	case outputRaw:
+		_, _ = fmt.Fprintln(w, rawOutput(input, m, m.res, chain))
+	}
+}
+
+// Comma separated input,ip (the block with -blocks),provider,region,service,category, then signal,cname_chain when
+// chain is not nil and asn,as_name when the AS of m is not nil. Fields are quoted when needed, as AS names can hold
+// commas.
+func rawOutput(input string, m match, res cloud.Result, chain []string) string {
+	record := []string{input, m.target(), res.Provider.String(), res.Region, res.Service, res.Category.String()}
+	if chain != nil {
+		record = append(record, string(res.Signal), strings.Join(chain, ">"))
+	}
+	if m.as != nil {
+		record = append(record, m.as.String(), m.as.Name)
+	}
+	b := &strings.Builder{}
+	w := csv.NewWriter(b)
+	_ = w.Write(record)
+	w.Flush()
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// Print all the matching ranges, eg. "Vercel (serverless) on top of Aws (compute, EC2 us-east-1)"
+func printAllOutput(w io.Writer, input string, m match, chain []string, mode outputMode) {
+	layers := m.layers
+	res := m.main()
+
 	switch mode {
 	case outputDefault:
-		log.Info("%s (%s): %s", input, ip.String(), p.String())
+		descriptions := make([]string, 0, len(layers))
+		for _, l := range layers {
+			descriptions = append(descriptions, describeResult(l))
+		}
+		if len(descriptions) == 0 {
+			descriptions = append(descriptions, describeResult(res))
+		}
+		log.Info("%s (%s): %s%s%s", input, m.target(), strings.Join(descriptions, " on top of "),
+			describeSignal(res, chain), describeASN(m.as))
 	case outputJson:
-		// Print to stdout
-		fmt.Println(marshallOutput(input, ip, p))
+		_, _ = fmt.Fprintln(w, marshallOutput(input, m, res, layers, chain))
 	case outputRaw:
-		// Print to stdout
-		fmt.Printf("%s,%s,%s\n", input, ip.String(), p.String())
+		// One line per layer
+		if len(layers) == 0 {
+			_, _ = fmt.Fprintln(w, rawOutput(input, m, res, chain))
+		}
+		for _, l := range layers {
+			_, _ = fmt.Fprintln(w, rawOutput(input, m, l, chain))
+		}
 	}
 }
@@ -3,9 +3,11 @@ package main
 import (
 	"context"
 	"fmt"
-	"net"
+	"net/netip"
 	"net/url"
 	"strings"
+
+	"github.com/Escape-Technologies/cloudfinder/pkg/dns"
 )
 
 func parseHostname(urlStr string) (string, error) {
@@ -27,22 +29,42 @@ func parseHostname(urlStr string) (string, error) {
 	return u.Hostname(), nil
 }
 
-func getIPsForURL(ctx context.Context, urlStr string) ([]net.IP, error) {
+func getIPsForURL(ctx context.Context, r *dns.Resolver, urlStr string) ([]netip.Addr, error) {
+	// Cidrs and dash ranges are expanded to their addresses
+	if prefixes, ok, err := parseRange(urlStr); ok {
+		var ips []netip.Addr
+		if err == nil {
+			ips, err = expandPrefixes(prefixes)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not get ips for url \"%s\": %w", urlStr, err)
+		}
+		return ips, nil
+	}
 	hostname, err := parseHostname(urlStr)
 	if err != nil {
 		return nil, fmt.Errorf("could not get ips for url \"%s\": %w", urlStr, err)
 	}
-	// If we already have an ip return it (no need to check the DNS)
-	ip := net.ParseIP(hostname)
-	if ip != nil {
-		return []net.IP{ip}, nil
-	}
-	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", hostname)
+	// Ips are returned as is, without DNS lookup
+	ips, err := r.LookupNetIP(ctx, hostname)
 	if err != nil {
 		return nil, fmt.Errorf("could not get ips for url \"%s\": %w", urlStr, err)
 	}
-	if len(ips) == 0 {
-		return nil, fmt.Errorf("DNS lookup did not find any ips for host \"%s\"", hostname)
-	}
 	return ips, nil
 }
+
+func getCNAMEChainForURL(ctx context.Context, r *dns.Resolver, urlStr string) ([]string, error) {
+	// Like ips, ranges have no chain
+	if _, ok, _ := parseRange(urlStr); ok {
+		return nil, nil
+	}
+	hostname, err := parseHostname(urlStr)
+	if err != nil {
+		return nil, fmt.Errorf("could not get the cname chain of url \"%s\": %w", urlStr, err)
+	}
+	chain, err := r.LookupCNAMEChain(ctx, hostname)
+	if err != nil {
+		return nil, fmt.Errorf("could not get the cname chain of url \"%s\": %w", urlStr, err)
+	}
+	return chain, nil
+}
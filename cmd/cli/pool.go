@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Escape-Technologies/cloudfinder/internal/log"
+	"github.com/Escape-Technologies/cloudfinder/pkg/cloud"
+	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
+)
+
+// lookup is the outcome of an input: the matches of its ips, or the error of its DNS lookup
+type lookup struct {
+	// Position of the input, from 0
+	index   int
+	input   string
+	matches []match
+	err     error
+	// CNAME chain of the host, only set with -cname: empty for ips and when the chain lookup failed
+	chain []string
+}
+
+type match struct {
+	ip netip.Addr
+	// Block of a cidr or range input, only set with -blocks, instead of ip
+	block netip.Prefix
+	res   cloud.Result
+	// Every matching range, only set with -all
+	layers []cloud.Result
+	// Origin AS, only set with -asn
+	as *cloud.ASN
+}
+
+// pool resolves inputs with a fixed number of workers
+type pool struct {
+	workers int
+	// Emit the lookups in input order. Otherwise, they are emitted as soon as they are done.
+	ordered bool
+	// Minimum delay between the start of two inputs, 0 for no limit
+	interval time.Duration
+	// Returns the ips of an input, getIPsForURL outside of the tests
+	resolveIPs func(ctx context.Context, input string) ([]netip.Addr, error)
+	// Returns the CNAME chain of an input, nil unless -cname is set
+	resolveCNAMEs func(ctx context.Context, input string) ([]string, error)
+	resolver      cloud.Resolver
+	// Look up every matching range (-all) and the origin AS (-asn)
+	all, asn bool
+	// Classify cidr and range inputs by blocks (-blocks)
+	blocks bool
+	// Log the progress at this interval while running, and once done. 0 disables the progress logs.
+	progress time.Duration
+
+	started time.Time
+	// Inputs done, read by the progress counter
+	done atomic.Int64
+}
+
+// run processes inputs until the channel is closed or ctx is done, and calls emit for each of them from the calling
+// goroutine: emit does not need to be safe for concurrent use.
+func (p *pool) run(ctx context.Context, inputs <-chan string, emit func(lookup)) {
+	p.started = time.Now()
+	if p.progress > 0 {
+		progressCtx, stop := context.WithCancel(ctx)
+		defer p.logProgress()
+		defer stop()
+		go p.reportProgress(progressCtx, p.progress)
+	}
+
+	workers := max(p.workers, 1)
+	jobs := make(chan lookup)
+	results := make(chan lookup)
+	// Slots of the inputs dispatched but not emitted yet when ordered, so a slow input does not let the faster ones
+	// pile up in memory: the input N+2*workers is only dispatched once the input N was emitted
+	var window chan struct{}
+	if p.ordered {
+		window = make(chan struct{}, 2*workers) // nolint:mnd
+	}
+
+	go p.dispatch(ctx, inputs, jobs, window)
+
+	wg := sync.WaitGroup{}
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				results <- p.process(ctx, job)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Lookups done before the previous ones wait here when ordered, at most the size of the window
+	pending := make(map[int]lookup)
+	next := 0
+	for l := range results {
+		p.done.Add(1)
+		if !p.ordered {
+			emit(l)
+			continue
+		}
+		pending[l.index] = l
+		for {
+			l, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			emit(l)
+			<-window
+			next++
+		}
+	}
+}
+
+// dispatch numbers the inputs and hands them to the workers, at most one per interval. When window is not nil, each
+// input takes a slot of it first, released once the input is emitted.
+func (p *pool) dispatch(ctx context.Context, inputs <-chan string, jobs chan<- lookup, window chan<- struct{}) {
+	defer close(jobs)
+	var tick <-chan time.Time
+	if p.interval > 0 {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for index := 0; ; index++ {
+		var input string
+		select {
+		case <-ctx.Done():
+			return
+		case next, ok := <-inputs:
+			if !ok {
+				return
+			}
+			input = next
+		}
+		if window != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case window <- struct{}{}:
+			}
+		}
+		// The first input starts right away
+		if tick != nil && index > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick:
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case jobs <- lookup{index: index, input: input}:
+		}
+	}
+}
+
+func (p *pool) process(ctx context.Context, l lookup) lookup {
+	if p.blocks {
+		if prefixes, ok, err := parseRange(l.input); ok {
+			return p.processBlocks(l, prefixes, err)
+		}
+	}
+	ips, err := p.resolveIPs(ctx, l.input)
+	if err != nil {
+		l.err = err
+		return l
+	}
+	cname := cloud.Result{Provider: provider.Unknown}
+	if p.resolveCNAMEs != nil {
+		// The ips are enough to find the provider, the chain is only logged when missing
+		l.chain, err = p.resolveCNAMEs(ctx, l.input)
+		if err != nil {
+			log.Debug("Failed to get the CNAME chain of %s: %v", l.input, err)
+		}
+		if l.chain == nil {
+			l.chain = []string{}
+		}
+		cname = p.resolver.LookupCNAME(l.chain)
+	}
+
+	l.matches = make([]match, 0, len(ips))
+	for _, ip := range ips {
+		m := match{ip: ip}
+		// A CNAME rule decides over the ranges: the provider of the ranges is often the one hosting the CNAME target
+		if cname.Provider != provider.Unknown {
+			cname.Family = cloud.IPv6
+			if ip.Is4() {
+				cname.Family = cloud.IPv4
+			}
+		}
+		switch {
+		case p.all && cname.Provider != provider.Unknown:
+			m.layers = append([]cloud.Result{cname}, p.resolver.LookupAllAddr(ip)...)
+		case p.all:
+			m.layers = p.resolver.LookupAllAddr(ip)
+		case cname.Provider != provider.Unknown:
+			m.res = cname
+		default:
+			m.res = p.resolver.LookupAddr(ip)
+		}
+		if p.asn {
+			as := p.resolver.LookupASNAddr(ip)
+			m.as = &as
+		}
+		l.matches = append(l.matches, m)
+	}
+	return l
+}
+
+// processBlocks looks up the blocks of the prefixes of a cidr or range input, the AS of a block is the one of its first
+// address
+func (p *pool) processBlocks(l lookup, prefixes []netip.Prefix, err error) lookup {
+	if err != nil {
+		l.err = fmt.Errorf("could not get blocks for url \"%s\": %w", l.input, err)
+		return l
+	}
+	l.matches = make([]match, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		for _, b := range p.resolver.LookupPrefix(prefix) {
+			m := match{block: b.Prefix, res: b.Result}
+			if p.asn {
+				as := p.resolver.LookupASNAddr(b.Prefix.Addr())
+				m.as = &as
+			}
+			l.matches = append(l.matches, m)
+		}
+	}
+	return l
+}
+
+// target is the looked up ip or block
+func (m match) target() string {
+	if m.block.IsValid() {
+		return m.block.String()
+	}
+	return m.ip.String()
+}
+
+// main is the result of the match: with -all, the most specific layer, Unknown when nothing matches
+func (m match) main() cloud.Result {
+	if m.layers == nil {
+		return m.res
+	}
+	if len(m.layers) == 0 {
+		return cloud.Result{Provider: provider.Unknown}
+	}
+	return m.layers[0]
+}
+
+// reportProgress logs the progress every interval until ctx is done
+func (p *pool) reportProgress(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.logProgress()
+		}
+	}
+}
+
+func (p *pool) logProgress() {
+	done := p.done.Load()
+	elapsed := time.Since(p.started)
+	log.Info("Progress: %d inputs processed in %s (%.1f/s)", done, elapsed.Round(time.Second), float64(done)/elapsed.Seconds())
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Escape-Technologies/cloudfinder/internal/log"
+	"github.com/Escape-Technologies/cloudfinder/pkg/cloud"
+)
+
+const testInputs = 40
+
+// testPool resolves inputs without DNS: the input is the ip, and the first inputs are the slowest so that workers
+// finish out of order. The very first one is much slower than the others.
+func testPool(workers int, ordered bool) *pool {
+	return &pool{
+		workers: workers,
+		ordered: ordered,
+		resolveIPs: func(ctx context.Context, input string) ([]netip.Addr, error) {
+			ip, err := netip.ParseAddr(input)
+			if err != nil {
+				return nil, fmt.Errorf("could not get ips for url %q: %w", input, err)
+			}
+			delay := time.Duration(testInputs-int(ip.As4()[3])) * 100 * time.Microsecond
+			if ip.As4()[3] == 0 {
+				delay = 100 * time.Millisecond
+			}
+			time.Sleep(delay)
+			return []netip.Addr{ip}, nil
+		},
+		resolver: cloud.NewResolver(),
+	}
+}
+
+func sendInputs(inputs []string) <-chan string {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		for _, input := range inputs {
+			ch <- input
+		}
+	}()
+	return ch
+}
+
+// testInputList returns 76.76.21.0, 76.76.21.1, ... with an invalid input in the middle
+func testInputList() []string {
+	inputs := make([]string, 0, testInputs+1)
+	for i := range testInputs {
+		inputs = append(inputs, fmt.Sprintf("76.76.21.%d", i))
+		if i == testInputs/2 {
+			inputs = append(inputs, "not a host")
+		}
+	}
+	return inputs
+}
+
+// runPool prints the inputs like main and returns the printed inputs, in order, for each output mode. Errors are
+// logged, they are only part of the default output.
+func runPool(t *testing.T, p *pool, inputs []string, mode outputMode) []string {
+	global := log.Logger
+	defer func() { log.Logger = global }()
+	logs := &bytes.Buffer{}
+	log.Logger = slog.New(slog.NewTextHandler(logs, nil))
+
+	out := &bytes.Buffer{}
+	p.run(context.Background(), sendInputs(inputs), func(l lookup) {
+		printLookup(out, l, mode)
+	})
+
+	printed := make([]string, 0, len(inputs))
+	switch mode {
+	case outputDefault:
+		line := regexp.MustCompile(`msg="(?:(\S+) \(|Failed to get ips.*url \\"(.+?)\\")`)
+		for _, m := range line.FindAllStringSubmatch(logs.String(), -1) {
+			printed = append(printed, m[1]+m[2])
+		}
+	case outputRaw:
+		records, err := csv.NewReader(out).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range records {
+			printed = append(printed, r[0])
+		}
+	case outputJson:
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			var parsed struct {
+				Input string `json:"input"`
+			}
+			if err := json.Unmarshal([]byte(line), &parsed); err != nil {
+				t.Fatal(err)
+			}
+			printed = append(printed, parsed.Input)
+		}
+	}
+	return printed
+}
+
+// withoutErrors removes the invalid input, which is only printed by the default output
+func withoutErrors(inputs []string, mode outputMode) []string {
+	if mode == outputDefault {
+		return inputs
+	}
+	return slices.DeleteFunc(slices.Clone(inputs), func(s string) bool { return s == "not a host" })
+}
+
+var testModes = map[string]outputMode{"default": outputDefault, "raw": outputRaw, "json": outputJson}
+
+func TestPoolOrdered(t *testing.T) {
+	inputs := testInputList()
+	for name, mode := range testModes {
+		t.Run(name, func(t *testing.T) {
+			printed := runPool(t, testPool(8, true), inputs, mode)
+			if expected := withoutErrors(inputs, mode); !slices.Equal(printed, expected) {
+				t.Errorf("Expected the inputs in order:\n%v\ngot:\n%v", expected, printed)
+			}
+		})
+	}
+}
+
+func TestPoolOrderedWindow(t *testing.T) {
+	// The first input is slow: the other worker may only run ahead of it by the size of the window
+	p := testPool(2, true)
+	started := atomic.Int64{}
+	resolveIPs := p.resolveIPs
+	p.resolveIPs = func(ctx context.Context, input string) ([]netip.Addr, error) {
+		started.Add(1)
+		return resolveIPs(ctx, input)
+	}
+	startedBeforeFirst := int64(-1)
+	p.run(context.Background(), sendInputs(testInputList()), func(l lookup) {
+		if startedBeforeFirst < 0 {
+			startedBeforeFirst = started.Load()
+		}
+	})
+	if startedBeforeFirst > 2*2 {
+		t.Errorf("Expected at most 4 inputs started before the first one was emitted, got %d", startedBeforeFirst)
+	}
+}
+
+func TestPoolUnordered(t *testing.T) {
+	inputs := testInputList()
+	for name, mode := range testModes {
+		t.Run(name, func(t *testing.T) {
+			printed := runPool(t, testPool(testInputs+1, false), inputs, mode)
+			expected := withoutErrors(inputs, mode)
+			if slices.Equal(printed, expected) {
+				t.Errorf("Expected the fastest inputs first, got the input order")
+			}
+			// The first input is the slowest, it is printed last
+			if printed[len(printed)-1] != inputs[0] {
+				t.Errorf("Expected %s to be printed last, got %v", inputs[0], printed)
+			}
+			slices.Sort(printed)
+			slices.Sort(expected)
+			if !slices.Equal(printed, expected) {
+				t.Errorf("Expected every input once:\n%v\ngot:\n%v", expected, printed)
+			}
+		})
+	}
+}
+
+func TestPoolSingleWorker(t *testing.T) {
+	// One worker is the sequential behaviour, even unordered
+	inputs := testInputList()
+	printed := runPool(t, testPool(1, false), inputs, outputRaw)
+	if expected := withoutErrors(inputs, outputRaw); !slices.Equal(printed, expected) {
+		t.Errorf("Expected the inputs in order:\n%v\ngot:\n%v", expected, printed)
+	}
+}
+
+func TestPoolRate(t *testing.T) {
+	p := testPool(4, true)
+	p.resolveIPs = func(ctx context.Context, input string) ([]netip.Addr, error) {
+		return nil, errors.New("no ips")
+	}
+	p.interval = 10 * time.Millisecond
+	start := time.Now()
+	count := 0
+	p.run(context.Background(), sendInputs([]string{"a", "b", "c", "d", "e"}), func(l lookup) { count++ })
+	if count != 5 {
+		t.Errorf("Expected 5 lookups, got %d", count)
+	}
+	// The first input starts right away, then one per interval
+	if elapsed := time.Since(start); elapsed < 4*p.interval {
+		t.Errorf("Expected 5 inputs to take at least %s, took %s", 4*p.interval, elapsed)
+	}
+}
+
+func TestPoolCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	inputs := make(chan string)
+	p := testPool(2, true)
+	done := make(chan struct{})
+	go func() {
+		p.run(ctx, inputs, func(l lookup) {})
+		close(done)
+	}()
+	inputs <- "76.76.21.1"
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected run to return once cancelled, with inputs left")
+	}
+}
+
+func TestPoolCNAME(t *testing.T) {
+	p := testPool(4, true)
+	chains := map[string][]string{
+		// Vercel runs on Aws ranges, its CNAME target decides
+		"76.76.21.1": {"app.example.com", "cname.vercel-dns.com"},
+		"76.76.21.2": {"www.example.com", "www.example.net"},
+	}
+	p.resolveCNAMEs = func(ctx context.Context, input string) ([]string, error) {
+		if chain, ok := chains[input]; ok {
+			return chain, nil
+		}
+		return nil, errors.New("no chain")
+	}
+
+	for _, all := range []bool{false, true} {
+		p.all = all
+		out := &bytes.Buffer{}
+		p.run(context.Background(), sendInputs([]string{"76.76.21.1", "76.76.21.2", "192.0.2.1"}), func(l lookup) {
+			printLookup(out, l, outputRaw)
+		})
+		records, err := csv.NewReader(out).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// input,ip,provider,region,service,category,signal,cname_chain
+		expected := [][]string{
+			{"76.76.21.1", "Vercel", "cname", "app.example.com>cname.vercel-dns.com"},
+			{"76.76.21.2", "Vercel", "range", "www.example.com>www.example.net"},
+			{"192.0.2.1", "Unknown", "", ""},
+		}
+		if all {
+			// The CNAME match is on top of the ranges
+			expected = slices.Insert(expected, 1, []string{"76.76.21.1", "Vercel", "range", "app.example.com>cname.vercel-dns.com"})
+		}
+		got := make([][]string, 0, len(records))
+		for _, r := range records {
+			got = append(got, []string{r[0], r[2], r[6], r[7]})
+		}
+		if !slices.EqualFunc(got, expected, slices.Equal) {
+			t.Errorf("Expected (all: %t):\n%v\ngot:\n%v", all, expected, got)
+		}
+	}
+}
+
+func TestPoolBlocks(t *testing.T) {
+	p := testPool(2, true)
+	p.blocks = true
+	inputs := []string{"76.76.20.0/22", "76.76.21.250-76.76.22.1", "76.76.21.1", "10.0.0.0/33"}
+	printed := make([]string, 0)
+	p.run(context.Background(), sendInputs(inputs), func(l lookup) {
+		if l.err != nil {
+			printed = append(printed, l.input+" error")
+		}
+		for _, m := range l.matches {
+			printed = append(printed, fmt.Sprintf("%s %s %s", l.input, m.target(), m.res.Provider))
+		}
+	})
+	expected := []string{
+		"76.76.20.0/22 76.76.20.0/24 Unknown",
+		"76.76.20.0/22 76.76.21.0/24 Vercel",
+		"76.76.20.0/22 76.76.22.0/23 Unknown",
+		"76.76.21.250-76.76.22.1 76.76.21.250/31 Vercel",
+		"76.76.21.250-76.76.22.1 76.76.21.252/30 Vercel",
+		"76.76.21.250-76.76.22.1 76.76.22.0/31 Unknown",
+		// Ips are looked up as usual
+		"76.76.21.1 76.76.21.1 Vercel",
+		"10.0.0.0/33 error",
+	}
+	if !slices.Equal(printed, expected) {
+		t.Errorf("Expected:\n%v\ngot:\n%v", expected, printed)
+	}
+}
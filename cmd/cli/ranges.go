@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Larger inputs are not expanded to their addresses, -blocks classifies them instead
+const maxExpandedAddrs = 1 << 16
+
+// parseRange parses a cidr (10.0.0.0/24, 2001:db8::/48) or a dash range (1.2.3.4-1.2.3.200) input into the prefixes
+// covering it. ok is false for the other inputs: urls, hostnames and ips.
+func parseRange(input string) (prefixes []netip.Prefix, ok bool, err error) {
+	input = strings.TrimSpace(input)
+	if addr, bits, found := strings.Cut(input, "/"); found && isAddr(addr) && isDigits(bits) {
+		prefix, err := netip.ParsePrefix(input)
+		if err != nil {
+			return nil, true, fmt.Errorf("invalid cidr \"%s\": %w", input, err)
+		}
+		return []netip.Prefix{prefix.Masked()}, true, nil
+	}
+
+	first, last, found := strings.Cut(input, "-")
+	if !found || !isAddr(first) || !isAddr(last) {
+		return nil, false, nil
+	}
+	start, end := netip.MustParseAddr(first).Unmap(), netip.MustParseAddr(last).Unmap()
+	if start.Is4() != end.Is4() {
+		return nil, true, fmt.Errorf("invalid range \"%s\": addresses of different families", input)
+	}
+	if end.Less(start) {
+		return nil, true, fmt.Errorf("invalid range \"%s\": %s is after %s", input, start, end)
+	}
+	return rangePrefixes(start, end), true, nil
+}
+
+func isAddr(s string) bool {
+	_, err := netip.ParseAddr(s)
+	return err == nil
+}
+
+func isDigits(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789") == ""
+}
+
+// rangePrefixes returns the fewest prefixes covering start to end, in order
+func rangePrefixes(start, end netip.Addr) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0)
+	for {
+		// The largest block aligned on start which ends before end
+		prefix := netip.PrefixFrom(start, start.BitLen())
+		for bits := 0; bits < start.BitLen(); bits++ {
+			p := netip.PrefixFrom(start, bits)
+			if p.Masked().Addr() == start && !end.Less(lastAddr(p)) {
+				prefix = p
+				break
+			}
+		}
+		prefixes = append(prefixes, prefix)
+		last := lastAddr(prefix)
+		if last == end {
+			return prefixes
+		}
+		start = last.Next()
+	}
+}
+
+// lastAddr returns the last address of a masked prefix
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Addr().As16()
+	offset := 0
+	if p.Addr().Is4() {
+		offset = 96
+	}
+	for i := offset + p.Bits(); i < 128; i++ {
+		b[i/8] |= 0x80 >> (i % 8) // nolint:mnd
+	}
+	addr := netip.AddrFrom16(b)
+	if p.Addr().Is4() {
+		return addr.Unmap()
+	}
+	return addr
+}
+
+// expandPrefixes returns every address of the prefixes, fails when there are more than maxExpandedAddrs
+func expandPrefixes(prefixes []netip.Prefix) ([]netip.Addr, error) {
+	count := 0
+	for _, p := range prefixes {
+		hostBits := p.Addr().BitLen() - p.Bits()
+		if hostBits > 16 || count+1<<hostBits > maxExpandedAddrs { // nolint:mnd
+			return nil, fmt.Errorf("more than %d addresses, use -blocks to classify it", maxExpandedAddrs)
+		}
+		count += 1 << hostBits
+	}
+	addrs := make([]netip.Addr, 0, count)
+	for _, p := range prefixes {
+		last := lastAddr(p)
+		for addr := p.Addr(); ; addr = addr.Next() {
+			addrs = append(addrs, addr)
+			if addr == last {
+				break
+			}
+		}
+	}
+	return addrs, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		input    string
+		ok       bool
+		prefixes []string
+	}{
+		{"10.0.0.0/24", true, []string{"10.0.0.0/24"}},
+		{"10.0.0.7/24", true, []string{"10.0.0.0/24"}},
+		{" 2001:db8::/48 ", true, []string{"2001:db8::/48"}},
+		{"1.2.3.4-1.2.3.4", true, []string{"1.2.3.4/32"}},
+		{"1.2.3.4-1.2.3.200", true, []string{"1.2.3.4/30", "1.2.3.8/29", "1.2.3.16/28", "1.2.3.32/27", "1.2.3.64/26",
+			"1.2.3.128/26", "1.2.3.192/29", "1.2.3.200/32"}},
+		{"0.0.0.0-255.255.255.255", true, []string{"0.0.0.0/0"}},
+		{"2001:db8::-2001:db8::ffff", true, []string{"2001:db8::/112"}},
+		{"::ffff:1.2.3.0-1.2.3.255", true, []string{"1.2.3.0/24"}},
+		// Urls, hostnames and ips are not ranges
+		{"example.com/10", false, nil},
+		{"my-host.example.com", false, nil},
+		{"1.2.3.4", false, nil},
+		{"https://1.2.3.4/24", false, nil},
+	}
+	for _, test := range tests {
+		prefixes, ok, err := parseRange(test.input)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", test.input, err)
+			continue
+		}
+		got := make([]string, 0, len(prefixes))
+		for _, p := range prefixes {
+			got = append(got, p.String())
+		}
+		if ok != test.ok || (ok && !slices.Equal(got, test.prefixes)) {
+			t.Errorf("Expected %q to be %t %v, got %t %v", test.input, test.ok, test.prefixes, ok, got)
+		}
+	}
+
+	for _, invalid := range []string{"10.0.0.0/33", "1.2.3.9-1.2.3.4", "1.2.3.4-2001:db8::1"} {
+		if _, ok, err := parseRange(invalid); !ok || err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestExpandPrefixes(t *testing.T) {
+	prefixes, _, _ := parseRange("192.0.2.254-192.0.3.1")
+	addrs, err := expandPrefixes(prefixes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(addrs); got != "[192.0.2.254 192.0.2.255 192.0.3.0 192.0.3.1]" {
+		t.Errorf("Expected 4 addresses, got %s", got)
+	}
+
+	if addrs, err := expandPrefixes([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/16")}); err != nil || len(addrs) != 1<<16 {
+		t.Errorf("Expected a /16 to be expanded, got %d addresses (%v)", len(addrs), err)
+	}
+	for _, cidrs := range [][]string{{"10.0.0.0/15"}, {"2001:db8::/64"}, {"10.0.0.0/16", "10.1.0.0/32"}} {
+		prefixes := make([]netip.Prefix, 0, len(cidrs))
+		for _, c := range cidrs {
+			prefixes = append(prefixes, netip.MustParsePrefix(c))
+		}
+		if _, err := expandPrefixes(prefixes); err == nil {
+			t.Errorf("Expected %v to be too large to expand", cidrs)
+		}
+	}
+}
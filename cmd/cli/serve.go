@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Escape-Technologies/cloudfinder/internal/log"
+	"github.com/Escape-Technologies/cloudfinder/pkg/cloud"
+)
+
+const (
+	defaultAddr     = "localhost:8080"
+	defaultMaxBatch = 1000
+	// Largest body of a batch request
+	maxBatchBody      = 10 << 20
+	readHeaderTimeout = 10 * time.Second
+	shutdownTimeout   = 10 * time.Second
+)
+
+type serveArgs struct {
+	args
+	addr string
+	// Most inputs of a batch request, streams are not limited
+	maxBatch int
+	// Poll the -data path and reload it when it changes, 0 to only reload on POST /v1/reload
+	watch time.Duration
+}
+
+func parseServeArgs(argv []string) (serveArgs, error) {
+	a := serveArgs{}
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.Usage = func() {
+		println("Usage:")
+		println("cloudfinder serve [flags]")
+		println("Flags:")
+		fs.PrintDefaults()
+	}
+	lookupFlags(fs, &a.args)
+	fs.StringVar(&a.addr, "addr", defaultAddr, "address to listen on")
+	fs.IntVar(&a.maxBatch, "max-batch", defaultMaxBatch, "maximum inputs of a batch request")
+	fs.DurationVar(&a.watch, "watch", 0, "poll the -data path at this interval and reload the range data when it changes (0 to disable)")
+	if err := fs.Parse(argv); err != nil {
+		return a, err
+	}
+	if fs.NArg() > 0 {
+		return a, fmt.Errorf("unexpected argument \"%s\", inputs are sent over HTTP", fs.Arg(0))
+	}
+	if err := a.validate(); err != nil {
+		return a, err
+	}
+	if a.maxBatch < 1 {
+		return a, errors.New("-max-batch must be at least 1")
+	}
+	if a.watch > 0 && a.dataPath == "" {
+		return a, errors.New("-watch needs -data")
+	}
+	return a, nil
+}
+
+// serve exposes the lookups over HTTP until SIGINT or SIGTERM, see server for the endpoints
+func serve(argv []string) {
+	a, err := parseServeArgs(argv)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+	setLogger(a.debug)
+
+	dnsResolver, err := newDNSResolver(a.args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	s := newServer(func(r cloud.Resolver) *pool { return newPool(a.args, r, dnsResolver) }, a.maxBatch)
+	s.dataPath = a.dataPath
+	// Load the range data while listening, the server is ready once it is loaded. A load error stops the server.
+	var loadErr error
+	go func() {
+		r, err := s.load(func() (cloud.Resolver, error) {
+			return newResolver(a.args)
+		})
+		if err != nil {
+			loadErr = err
+			stop()
+			return
+		}
+		log.Info("Range data loaded")
+		if a.watch > 0 {
+			r.Watch(ctx, a.dataPath, a.watch)
+		}
+	}()
+	srv := &http.Server{
+		Addr:              a.addr,
+		Handler:           s.handler(),
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		// Fail the readiness checks first, so that no new requests are routed here while the running ones finish
+		s.ready.Store(false)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Error("Failed to shut down the server", err)
+		}
+	}()
+
+	log.Info("Serving lookups on %s", a.addr)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+	<-done
+	if loadErr != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", loadErr)
+		os.Exit(1)
+	}
+}
+
+// server exposes the lookups of the cli over HTTP:
+//
+//	GET  /healthz            the process is up
+//	GET  /readyz             the range data is loaded and the server is not shutting down
+//	GET  /version            the cli version and the hash of the loaded range data
+//	GET  /v1/lookup?q=input  looks up a single ip, host, domain or url
+//	POST /v1/lookup          looks up a batch of inputs, {"inputs": [...]}, the results are in input order
+//	POST /v1/stream          looks up NDJSON inputs, and streams the -json output of each one as soon as it is done
+//	POST /v1/reload          reloads the range data
+//
+// Until the range data is loaded (see load), only /healthz answers, with a 200, the other endpoints fail with a 503.
+type server struct {
+	// A single resolver is shared by all the requests, reloads swap its data in place. nil until loaded.
+	resolver atomic.Pointer[cloud.ReloadableResolver]
+	// Returns the pool of a request on r, with the settings of the flags
+	newPool  func(r cloud.Resolver) *pool
+	maxBatch int
+	// The -data path, empty for the embedded data
+	dataPath string
+	// Set once the range data is loaded, unset when shutting down
+	ready atomic.Bool
+}
+
+func newServer(newPool func(r cloud.Resolver) *pool, maxBatch int) *server {
+	return &server{newPool: newPool, maxBatch: maxBatch}
+}
+
+// load creates the resolver of the requests with load, see cloud.NewReloadableResolver, and marks the server ready.
+// It is called once, the data is then replaced by reloads.
+func (s *server) load(load cloud.Loader) (*cloud.ReloadableResolver, error) {
+	r, err := cloud.NewReloadableResolver(load, cloud.WithLogger(log.Logger))
+	if err != nil {
+		return nil, err
+	}
+	s.resolver.Store(r)
+	s.ready.Store(true)
+	return r, nil
+}
+
+// loaded returns the resolver of the requests, or writes a 503 and returns nil when the range data is not loaded yet
+func (s *server) loaded(w http.ResponseWriter) *cloud.ReloadableResolver {
+	r := s.resolver.Load()
+	if r == nil {
+		writeJSON(w, http.StatusServiceUnavailable, errorResponse{Error: "range data not loaded yet"})
+	}
+	return r
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", s.handleHealth)
+	mux.HandleFunc("GET /readyz", s.handleReady)
+	mux.HandleFunc("GET /version", s.handleVersion)
+	mux.HandleFunc("GET /v1/lookup", s.handleLookup)
+	mux.HandleFunc("POST /v1/lookup", s.handleBatch)
+	mux.HandleFunc("POST /v1/stream", s.handleStream)
+	mux.HandleFunc("POST /v1/reload", s.handleReload)
+	return mux
+}
+
+type statusResponse struct {
+	Status string `json:"status"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// lookupResponse is the outcome of an input, matches are in the -json output format
+type lookupResponse struct {
+	Input   string            `json:"input"`
+	Matches []json.RawMessage `json:"matches,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Debug("Failed to write response: %v", err)
+	}
+}
+
+func (s *server) handleHealth(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, statusResponse{Status: "ok"})
+}
+
+func (s *server) handleReady(w http.ResponseWriter, _ *http.Request) {
+	if !s.ready.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, statusResponse{Status: "not ready"})
+		return
+	}
+	writeJSON(w, http.StatusOK, statusResponse{Status: "ready"})
+}
+
+func (s *server) handleVersion(w http.ResponseWriter, _ *http.Request) {
+	r := s.loaded(w)
+	if r == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Version string `json:"version"`
+		// Hash of the loaded range data (see cloud.DataHash), empty when loaded from ranges files
+		DataHash string `json:"data_hash,omitempty"`
+		DataPath string `json:"data_path,omitempty"`
+	}{Version: version, DataHash: cloud.DataHash(r), DataPath: s.dataPath})
+}
+
+func (s *server) handleLookup(w http.ResponseWriter, r *http.Request) {
+	input := r.URL.Query().Get("q")
+	if strings.TrimSpace(input) == "" {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "missing q parameter"})
+		return
+	}
+	resolver := s.loaded(w)
+	if resolver == nil {
+		return
+	}
+	res := toLookupResponse(s.newPool(resolver).process(r.Context(), lookup{input: input}))
+	if res.Error != "" {
+		writeJSON(w, http.StatusUnprocessableEntity, res)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	resolver := s.loaded(w)
+	if resolver == nil {
+		return
+	}
+	var req struct {
+		Inputs []string `json:"inputs"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBody)).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSON(w, http.StatusRequestEntityTooLarge, errorResponse{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("invalid body: %v", err)})
+		return
+	}
+	if len(req.Inputs) > s.maxBatch {
+		writeJSON(w, http.StatusRequestEntityTooLarge, errorResponse{
+			Error: fmt.Sprintf("%d inputs, at most %d are allowed", len(req.Inputs), s.maxBatch),
+		})
+		return
+	}
+
+	p := s.newPool(resolver)
+	p.ordered = true
+	results := make([]lookupResponse, 0, len(req.Inputs))
+	p.run(r.Context(), sendBatch(r.Context(), req.Inputs), func(l lookup) {
+		results = append(results, toLookupResponse(l))
+	})
+	if r.Context().Err() != nil {
+		// The client is gone
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Results []lookupResponse `json:"results"`
+	}{Results: results})
+}
+
+// handleStream reads one input per line, either raw, a JSON string or {"input": ...}. Each match is written as a line
+// of the -json output, the failed inputs as {"input": ..., "error": ...}.
+func (s *server) handleStream(w http.ResponseWriter, r *http.Request) {
+	resolver := s.loaded(w)
+	if resolver == nil {
+		return
+	}
+	rc := http.NewResponseController(w)
+	// Read the inputs while writing the results, HTTP/2 always allows it
+	if err := rc.EnableFullDuplex(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Debug("Failed to enable full duplex: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	_ = rc.Flush()
+
+	inputs := make(chan string)
+	go readStreamInputs(r.Context(), r.Body, inputs)
+	p := s.newPool(resolver)
+	p.run(r.Context(), inputs, func(l lookup) {
+		if l.err != nil {
+			writeLine(w, lookupResponse{Input: l.input, Error: l.err.Error()})
+		} else {
+			for _, m := range jsonMatches(l) {
+				writeLine(w, m)
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			log.Debug("Failed to flush the stream: %v", err)
+		}
+	})
+}
+
+// readStreamInputs sends the inputs of the NDJSON body until it ends or ctx is done, and closes inputs
+func readStreamInputs(ctx context.Context, body io.Reader, inputs chan<- string) {
+	defer close(inputs)
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		input := parseStreamInput(scanner.Text())
+		if input == "" {
+			continue
+		}
+		select {
+		case inputs <- input:
+		case <-ctx.Done():
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Debug("Failed to read the stream: %v", err)
+	}
+}
+
+// parseStreamInput returns the input of a stream line, an invalid JSON line is looked up as is and fails
+func parseStreamInput(line string) string {
+	line = strings.TrimSpace(line)
+	switch {
+	case strings.HasPrefix(line, `"`):
+		var input string
+		if json.Unmarshal([]byte(line), &input) == nil {
+			return input
+		}
+	case strings.HasPrefix(line, "{"):
+		var parsed struct {
+			Input string `json:"input"`
+		}
+		if json.Unmarshal([]byte(line), &parsed) == nil {
+			return parsed.Input
+		}
+	}
+	return line
+}
+
+func writeLine(w io.Writer, v any) {
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Debug("Failed to write response: %v", err)
+	}
+}
+
+func (s *server) handleReload(w http.ResponseWriter, _ *http.Request) {
+	resolver := s.loaded(w)
+	if resolver == nil {
+		return
+	}
+	if err := resolver.Reload(); err != nil {
+		log.Error("Failed to reload range data", err)
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		return
+	}
+	log.Info("Reloaded range data")
+	writeJSON(w, http.StatusOK, statusResponse{Status: "reloaded"})
+}
+
+func toLookupResponse(l lookup) lookupResponse {
+	if l.err != nil {
+		return lookupResponse{Input: l.input, Error: l.err.Error()}
+	}
+	return lookupResponse{Input: l.input, Matches: jsonMatches(l)}
+}
+
+// jsonMatches returns each match of l in the -json output format
+func jsonMatches(l lookup) []json.RawMessage {
+	matches := make([]json.RawMessage, 0, len(l.matches))
+	for _, m := range l.matches {
+		matches = append(matches, json.RawMessage(marshallOutput(l.input, m, m.main(), m.layers, l.chain)))
+	}
+	return matches
+}
+
+// sendBatch sends inputs until they are all sent or ctx is done, and closes the returned channel
+func sendBatch(ctx context.Context, inputs []string) <-chan string {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		for _, input := range inputs {
+			select {
+			case ch <- input:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
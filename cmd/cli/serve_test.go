@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Escape-Technologies/cloudfinder/internal/static"
+	"github.com/Escape-Technologies/cloudfinder/pkg/cloud"
+)
+
+// testServer serves lookups of ips without DNS, and counts the loads of the range data. The loads fail once failing
+// is set.
+func testServer(t *testing.T) (*server, *httptest.Server, *atomic.Int64, *atomic.Bool) {
+	loads, failing := &atomic.Int64{}, &atomic.Bool{}
+	s, ts := newTestServer(t)
+	_, err := s.load(func() (cloud.Resolver, error) {
+		loads.Add(1)
+		if failing.Load() {
+			return nil, errors.New("broken data")
+		}
+		return cloud.NewResolver(), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, ts, loads, failing
+}
+
+// newTestServer returns a server without range data, see testServer
+func newTestServer(t *testing.T) (*server, *httptest.Server) {
+	s := newServer(func(r cloud.Resolver) *pool {
+		return &pool{
+			workers: 4,
+			resolveIPs: func(ctx context.Context, input string) ([]netip.Addr, error) {
+				ip, err := netip.ParseAddr(input)
+				if err != nil {
+					return nil, fmt.Errorf("could not get ips for url %q: %w", input, err)
+				}
+				return []netip.Addr{ip}, nil
+			},
+			resolver: r,
+		}
+	}, 3)
+	ts := httptest.NewServer(s.handler())
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// request sends a request and decodes the JSON response into out
+func request(t *testing.T, method, url, body string, out any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("Expected a JSON response to %s %s, got %v", method, url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+type testMatch struct {
+	Input    string `json:"input"`
+	IP       string `json:"ip"`
+	Provider string `json:"provider"`
+}
+
+type testLookup struct {
+	Input   string      `json:"input"`
+	Matches []testMatch `json:"matches"`
+	Error   string      `json:"error"`
+}
+
+func TestServeNotLoaded(t *testing.T) {
+	s, ts := newTestServer(t)
+	var status statusResponse
+	if code := request(t, http.MethodGet, ts.URL+"/healthz", "", &status); code != http.StatusOK {
+		t.Errorf("Expected healthz to be ok while loading, got %d %+v", code, status)
+	}
+	for _, endpoint := range []string{"GET /readyz", "GET /version", "GET /v1/lookup?q=76.76.21.21", "POST /v1/lookup",
+		"POST /v1/stream", "POST /v1/reload"} {
+		method, path, _ := strings.Cut(endpoint, " ")
+		if code := request(t, method, ts.URL+path, `{"inputs": ["76.76.21.21"]}`, nil); code != http.StatusServiceUnavailable {
+			t.Errorf("Expected %s to fail while loading, got %d", endpoint, code)
+		}
+	}
+
+	if _, err := s.load(func() (cloud.Resolver, error) { return nil, errors.New("broken data") }); err == nil {
+		t.Errorf("Expected the load error")
+	}
+	if code := request(t, http.MethodGet, ts.URL+"/readyz", "", &status); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected readyz to fail after a failed load, got %d %+v", code, status)
+	}
+}
+
+func TestServeStatus(t *testing.T) {
+	s, ts, _, _ := testServer(t)
+
+	var status statusResponse
+	if code := request(t, http.MethodGet, ts.URL+"/healthz", "", &status); code != http.StatusOK || status.Status != "ok" {
+		t.Errorf("Expected healthz to be ok, got %d %+v", code, status)
+	}
+	if code := request(t, http.MethodGet, ts.URL+"/readyz", "", &status); code != http.StatusOK {
+		t.Errorf("Expected readyz to be ready, got %d %+v", code, status)
+	}
+	s.ready.Store(false)
+	if code := request(t, http.MethodGet, ts.URL+"/readyz", "", &status); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected readyz to fail while shutting down, got %d %+v", code, status)
+	}
+
+	var v struct {
+		DataHash string `json:"data_hash"`
+	}
+	if code := request(t, http.MethodGet, ts.URL+"/version", "", &v); code != http.StatusOK || v.DataHash == "" ||
+		v.DataHash != static.Hash() {
+		t.Errorf("Expected the data hash %q, got %d %q", static.Hash(), code, v.DataHash)
+	}
+
+	if code := request(t, http.MethodGet, ts.URL+"/v1/reload", "", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected reload to only accept POST, got %d", code)
+	}
+}
+
+func TestServeLookup(t *testing.T) {
+	_, ts, _, _ := testServer(t)
+
+	var l testLookup
+	code := request(t, http.MethodGet, ts.URL+"/v1/lookup?q=76.76.21.21", "", &l)
+	if code != http.StatusOK || len(l.Matches) != 1 || l.Matches[0].Provider != "Vercel" ||
+		l.Matches[0].IP != "76.76.21.21" || l.Matches[0].Input != "76.76.21.21" {
+		t.Errorf("Expected 76.76.21.21 to be Vercel, got %d %+v", code, l)
+	}
+
+	l = testLookup{}
+	if code := request(t, http.MethodGet, ts.URL+"/v1/lookup?q=not+a+host", "", &l); code != http.StatusUnprocessableEntity ||
+		l.Error == "" || l.Input != "not a host" {
+		t.Errorf("Expected an error for an invalid input, got %d %+v", code, l)
+	}
+
+	var e errorResponse
+	if code := request(t, http.MethodGet, ts.URL+"/v1/lookup", "", &e); code != http.StatusBadRequest || e.Error == "" {
+		t.Errorf("Expected an error without q, got %d %+v", code, e)
+	}
+}
+
+func TestServeBatch(t *testing.T) {
+	_, ts, _, _ := testServer(t)
+
+	var batch struct {
+		Results []testLookup `json:"results"`
+	}
+	code := request(t, http.MethodPost, ts.URL+"/v1/lookup", `{"inputs": ["76.76.21.21", "not a host", "76.76.21.22"]}`,
+		&batch)
+	if code != http.StatusOK || len(batch.Results) != 3 {
+		t.Fatalf("Expected 3 results, got %d %+v", code, batch)
+	}
+	for i, input := range []string{"76.76.21.21", "not a host", "76.76.21.22"} {
+		if batch.Results[i].Input != input {
+			t.Errorf("Expected result %d to be %s, got %+v", i, input, batch.Results[i])
+		}
+	}
+	if batch.Results[1].Error == "" || len(batch.Results[1].Matches) != 0 {
+		t.Errorf("Expected an error for the invalid input, got %+v", batch.Results[1])
+	}
+	if len(batch.Results[2].Matches) != 1 || batch.Results[2].Matches[0].Provider != "Vercel" {
+		t.Errorf("Expected 76.76.21.22 to be Vercel, got %+v", batch.Results[2])
+	}
+
+	for body, expected := range map[string]int{
+		`{"inputs": ["1.1.1.1", "1.1.1.2", "1.1.1.3", "1.1.1.4"]}`: http.StatusRequestEntityTooLarge,
+		`{"inputs": "1.1.1.1"}`: http.StatusBadRequest,
+		`not json`:              http.StatusBadRequest,
+	} {
+		var e errorResponse
+		if code := request(t, http.MethodPost, ts.URL+"/v1/lookup", body, &e); code != expected || e.Error == "" {
+			t.Errorf("Expected %d for %s, got %d %+v", expected, body, code, e)
+		}
+	}
+}
+
+func TestServeStream(t *testing.T) {
+	_, ts, _, _ := testServer(t)
+
+	body, inputs := io.Pipe()
+	resp, err := http.Post(ts.URL+"/v1/stream", "application/x-ndjson", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the stream to be accepted, got %d", resp.StatusCode)
+	}
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	next := func() testMatch {
+		t.Helper()
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatal("Expected a line, the stream ended")
+			}
+			var m struct {
+				testMatch
+				Error string `json:"error"`
+			}
+			if err := json.Unmarshal([]byte(line), &m); err != nil {
+				t.Fatal(err)
+			}
+			if m.Error != "" {
+				m.IP = "error"
+			}
+			return m.testMatch
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected each input to be streamed as soon as it is done")
+		}
+		return testMatch{}
+	}
+
+	// Each input is answered before the next one is sent
+	for _, test := range []struct {
+		line     string
+		expected testMatch
+	}{
+		{"76.76.21.21", testMatch{Input: "76.76.21.21", IP: "76.76.21.21", Provider: "Vercel"}},
+		{`"76.76.21.22"`, testMatch{Input: "76.76.21.22", IP: "76.76.21.22", Provider: "Vercel"}},
+		{`{"input": "76.76.21.23"}`, testMatch{Input: "76.76.21.23", IP: "76.76.21.23", Provider: "Vercel"}},
+		{`{"input": "not a host"}`, testMatch{Input: "not a host", IP: "error"}},
+	} {
+		if _, err := fmt.Fprintln(inputs, test.line); err != nil {
+			t.Fatal(err)
+		}
+		if got := next(); got != test.expected {
+			t.Errorf("Expected %s to stream %+v, got %+v", test.line, test.expected, got)
+		}
+	}
+	_ = inputs.Close()
+	if line, ok := <-lines; ok {
+		t.Errorf("Expected the stream to end with the inputs, got %s", line)
+	}
+}
+
+func TestServeReload(t *testing.T) {
+	_, ts, loads, failing := testServer(t)
+
+	var status statusResponse
+	if code := request(t, http.MethodPost, ts.URL+"/v1/reload", "", &status); code != http.StatusOK ||
+		status.Status != "reloaded" || loads.Load() != 2 {
+		t.Errorf("Expected the data to be reloaded, got %d %+v after %d loads", code, status, loads.Load())
+	}
+
+	failing.Store(true)
+	var e errorResponse
+	if code := request(t, http.MethodPost, ts.URL+"/v1/reload", "", &e); code != http.StatusInternalServerError ||
+		!strings.Contains(e.Error, "broken data") {
+		t.Errorf("Expected the reload to fail, got %d %+v", code, e)
+	}
+	// The previous data is kept
+	var l testLookup
+	if code := request(t, http.MethodGet, ts.URL+"/v1/lookup?q=76.76.21.21", "", &l); code != http.StatusOK ||
+		len(l.Matches) != 1 || l.Matches[0].Provider != "Vercel" {
+		t.Errorf("Expected lookups to keep working after a failed reload, got %d %+v", code, l)
+	}
+}
+
+func TestParseServeArgs(t *testing.T) {
+	a, err := parseServeArgs([]string{"-addr", ":9000", "-max-batch", "10", "-all"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.addr != ":9000" || a.maxBatch != 10 || !a.all || a.concurrency != defaultConcurrency {
+		t.Errorf("Expected the flags to be parsed, got %+v", a)
+	}
+	for _, argv := range [][]string{
+		{"-max-batch", "0"},
+		{"-watch", "1s"},
+		{"-4", "-6"},
+		{"1.1.1.1"},
+	} {
+		if _, err := parseServeArgs(argv); err == nil {
+			t.Errorf("Expected an error for %v", argv)
+		}
+	}
+}
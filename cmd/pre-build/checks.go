@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/Escape-Technologies/cloudfinder/internal/source"
+	"github.com/Escape-Technologies/cloudfinder/internal/tree"
+	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
+)
+
+// Guardrails against a bad upstream day: a feed returning an empty or truncated file must not ship a resolver that
+// does not know a provider anymore. The new ranges of each provider are compared with the previous snapshot.
+
+// thresholds of the per provider checks, percentages are relative to the previous snapshot
+type thresholds struct {
+	minRanges int
+	maxShrink float64
+	maxGrowth float64
+}
+
+var defaultThresholds = thresholds{minRanges: 1, maxShrink: 25, maxGrowth: 100}
+
+const (
+	// Percentage checks are skipped when fewer ranges changed, small providers easily double
+	minChangedRanges = 10
+	// Shortest accepted prefixes, anything shorter is a catch-all (eg. 0.0.0.0/0) from a broken feed
+	minIPv4Bits = 8
+	minIPv6Bits = 16
+)
+
+// violation is a failed check
+type violation struct {
+	provider provider.Provider
+	message  string
+}
+
+func (v violation) String() string {
+	return fmt.Sprintf("%s: %s", v.provider, v.message)
+}
+
+func countPerProvider(ranges []*source.IPRange) map[provider.Provider]int {
+	counts := make(map[provider.Provider]int)
+	for _, r := range ranges {
+		counts[r.Provider]++
+	}
+	return counts
+}
+
+// checkRanges returns the checks failed by next, for the expected providers and every provider of either snapshot.
+// previous is nil when there is no snapshot to compare with, only the absolute checks are then done.
+func checkRanges(expected []provider.Provider, previous, next []*source.IPRange, th thresholds) []violation {
+	violations := make([]violation, 0)
+
+	for _, r := range next {
+		minBits := minIPv6Bits
+		if r.Cat == source.CatIPv4 {
+			minBits = minIPv4Bits
+		}
+		if r.Prefix.Bits() < minBits {
+			violations = append(violations, violation{r.Provider, fmt.Sprintf("catch-all prefix %s (shorter than /%d)", r.Prefix, minBits)})
+		}
+	}
+
+	prevCounts := countPerProvider(previous)
+	nextCounts := countPerProvider(next)
+	providers := slices.Clone(expected)
+	for p := range prevCounts {
+		providers = append(providers, p)
+	}
+	for p := range nextCounts {
+		providers = append(providers, p)
+	}
+	slices.Sort(providers)
+	providers = slices.Compact(providers)
+
+	for _, p := range providers {
+		prev, next := prevCounts[p], nextCounts[p]
+		if next < th.minRanges {
+			violations = append(violations, violation{p, fmt.Sprintf("%d ranges, expected at least %d", next, th.minRanges)})
+			continue
+		}
+		if previous == nil || prev == 0 || abs(next-prev) < minChangedRanges {
+			continue
+		}
+		change := float64(next-prev) / float64(prev) * 100 // nolint:mnd
+		if -change > th.maxShrink {
+			violations = append(violations, violation{p, fmt.Sprintf("shrank by %.1f%% (%d -> %d ranges), at most %.1f%% allowed", -change, prev, next, th.maxShrink)})
+		}
+		if change > th.maxGrowth {
+			violations = append(violations, violation{p, fmt.Sprintf("grew by %.1f%% (%d -> %d ranges), at most %.1f%% allowed", change, prev, next, th.maxGrowth)})
+		}
+	}
+	return violations
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func formatViolations(violations []violation) string {
+	lines := make([]string, 0, len(violations))
+	for _, v := range violations {
+		lines = append(lines, "  - "+v.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// loadPreviousRanges reads the ranges of the trees written by the previous run. Returns nil if there are none.
+func loadPreviousRanges(paths ...string) ([]*source.IPRange, error) {
+	ranges := make([]*source.IPRange, 0)
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read previous tree: %w", err)
+		}
+		t, err := tree.NewFlatFrom(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read previous tree %s: %w", path, err)
+		}
+		ranges = append(ranges, t.GetAllRanges()...)
+	}
+	return ranges, nil
+}
+
+// hasMetadata reports whether any range has a region or a service. Snapshots built before the metadata was stored
+// (and the pruned one embedded before the first scheduled build) have none: they are not a baseline for the
+// percentage checks, a provider would "grow" by every range the snapshot had pruned.
+func hasMetadata(ranges []*source.IPRange) bool {
+	return slices.ContainsFunc(ranges, func(r *source.IPRange) bool {
+		return r.Region != "" || r.Service != ""
+	})
+}
+
+func sourceProviders(sources []source.IPRangeSource) []provider.Provider {
+	providers := make([]provider.Provider, 0, len(sources))
+	for _, s := range sources {
+		providers = append(providers, s.GetProvider())
+	}
+	return providers
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Escape-Technologies/cloudfinder/internal/source"
+	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
+)
+
+// makeRanges returns n distinct /24 ranges of the given provider
+func makeRanges(p provider.Provider, n int) []*source.IPRange {
+	ranges := make([]*source.IPRange, 0, n)
+	for i := range n {
+		prefix := netip.MustParsePrefix(fmt.Sprintf("10.%d.%d.0/24", i/256, i%256)) // nolint:mnd
+		ranges = append(ranges, &source.IPRange{Prefix: prefix, Cat: source.CatIPv4, Provider: p})
+	}
+	return ranges
+}
+
+func concat(ranges ...[]*source.IPRange) []*source.IPRange {
+	all := make([]*source.IPRange, 0)
+	for _, r := range ranges {
+		all = append(all, r...)
+	}
+	return all
+}
+
+func TestCheckRanges(t *testing.T) {
+	expected := []provider.Provider{provider.Aws, provider.Gcp}
+	previous := concat(makeRanges(provider.Aws, 100), makeRanges(provider.Gcp, 3))
+	catchAll := &source.IPRange{Prefix: netip.MustParsePrefix("0.0.0.0/0"), Cat: source.CatIPv4, Provider: provider.Gcp}
+	catchAll6 := &source.IPRange{Prefix: netip.MustParsePrefix("::/0"), Cat: source.CatIPv6, Provider: provider.Gcp}
+
+	tests := []struct {
+		name     string
+		previous []*source.IPRange
+		next     []*source.IPRange
+		failures []string
+	}{
+		{"unchanged", previous, previous, nil},
+		{"small changes", previous, concat(makeRanges(provider.Aws, 90), makeRanges(provider.Gcp, 12)), nil},
+		{"empty feed", previous, makeRanges(provider.Aws, 100), []string{"Gcp: 0 ranges"}},
+		{"truncated feed", previous, concat(makeRanges(provider.Aws, 50), makeRanges(provider.Gcp, 3)), []string{"Aws: shrank by 50.0%"}},
+		{"duplicated feed", previous, concat(makeRanges(provider.Aws, 250), makeRanges(provider.Gcp, 3)), []string{"Aws: grew by 150.0%"}},
+		{"catch-all", previous, concat(previous, []*source.IPRange{catchAll, catchAll6}), []string{"Gcp: catch-all prefix 0.0.0.0/0", "Gcp: catch-all prefix ::/0"}},
+		{"first build", nil, makeRanges(provider.Aws, 10), []string{"Gcp: 0 ranges"}},
+		{"removed provider", concat(previous, makeRanges(provider.Vercel, 1)), previous, []string{"Vercel: 0 ranges"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			violations := checkRanges(expected, test.previous, test.next, defaultThresholds)
+			if len(violations) != len(test.failures) {
+				t.Fatalf("Expected %d violations, got:\n%s", len(test.failures), formatViolations(violations))
+			}
+			for i, v := range violations {
+				if !strings.HasPrefix(v.String(), test.failures[i]) {
+					t.Errorf("Expected violation %q, got %q", test.failures[i], v)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckRangesThresholds(t *testing.T) {
+	previous := makeRanges(provider.Aws, 100)
+	next := makeRanges(provider.Aws, 80)
+	if violations := checkRanges(nil, previous, next, defaultThresholds); len(violations) != 0 {
+		t.Errorf("Expected 20%% shrink to pass by default, got %s", formatViolations(violations))
+	}
+	strict := thresholds{minRanges: 100, maxShrink: 10, maxGrowth: 10}
+	if violations := checkRanges(nil, previous, next, strict); len(violations) != 1 {
+		t.Errorf("Expected the min ranges check to fail, got %s", formatViolations(violations))
+	}
+	strict.minRanges = 1
+	if violations := checkRanges(nil, previous, next, strict); len(violations) != 1 {
+		t.Errorf("Expected the shrink check to fail, got %s", formatViolations(violations))
+	}
+}
+
+// The committed data must pass the default checks, or every pre-build would fail
+func TestHasMetadata(t *testing.T) {
+	ranges := concat(makeRanges(provider.Aws, 2), makeRanges(provider.Gcp, 2))
+	if hasMetadata(ranges) {
+		t.Errorf("Expected no metadata on ranges without region nor service")
+	}
+	ranges[3].Service = "CDN"
+	if !hasMetadata(ranges) {
+		t.Errorf("Expected metadata on a range with a service")
+	}
+}
+
+func TestCheckCommittedRanges(t *testing.T) {
+	root := filepath.Join("..", "..")
+	previous, err := loadPreviousRanges(filepath.Join(root, ipv4TreePath), filepath.Join(root, ipv6TreePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(previous) == 0 {
+		t.Fatal("Expected ranges in the committed trees")
+	}
+	sources, err := source.AllSources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if violations := checkRanges(sourceProviders(sources), previous, previous, defaultThresholds); len(violations) != 0 {
+		t.Errorf("Expected the committed trees to pass the checks, got:\n%s", formatViolations(violations))
+	}
+
+	missing, err := loadPreviousRanges(filepath.Join(t.TempDir(), "ipv4.bin"))
+	if err != nil || missing != nil {
+		t.Errorf("Expected no previous ranges without trees, got %d ranges, %v", len(missing), err)
+	}
+}
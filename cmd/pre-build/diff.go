@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/Escape-Technologies/cloudfinder/internal/source"
+	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
+)
+
+// Changelog formats of -diff
+const (
+	diffMarkdown = "markdown"
+	diffJSON     = "json"
+)
+
+// providerChanges lists the prefixes added and removed for a provider. The address space changes are the sum of the
+// added prefixes minus the sum of the removed ones: overlapping prefixes are counted several times.
+type providerChanges struct {
+	Provider      string   `json:"provider"`
+	Added         []string `json:"added"`
+	Removed       []string `json:"removed"`
+	IPv4Addresses *big.Int `json:"ipv4_addresses"`
+	IPv6Addresses *big.Int `json:"ipv6_addresses"`
+}
+
+// changelog of the ranges between two snapshots, only changed providers are listed
+type changelog struct {
+	Providers []*providerChanges `json:"providers"`
+}
+
+type rangeKey struct {
+	provider provider.Provider
+	prefix   netip.Prefix
+}
+
+// prefixSize returns the number of addresses in prefix
+func prefixSize(prefix netip.Prefix) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(prefix.Addr().BitLen()-prefix.Bits())) // nolint:gosec
+}
+
+func rangeKeys(ranges []*source.IPRange) map[rangeKey]*source.IPRange {
+	keys := make(map[rangeKey]*source.IPRange, len(ranges))
+	for _, r := range ranges {
+		keys[rangeKey{r.Provider, r.Prefix.Masked()}] = r
+	}
+	return keys
+}
+
+// diffRanges compares the prefixes of each provider, regions and services are ignored
+func diffRanges(previous, next []*source.IPRange) changelog {
+	prevKeys, nextKeys := rangeKeys(previous), rangeKeys(next)
+	added := make([]*source.IPRange, 0)
+	for k, r := range nextKeys {
+		if _, ok := prevKeys[k]; !ok {
+			added = append(added, r)
+		}
+	}
+	removed := make([]*source.IPRange, 0)
+	for k, r := range prevKeys {
+		if _, ok := nextKeys[k]; !ok {
+			removed = append(removed, r)
+		}
+	}
+	sortRanges(added)
+	sortRanges(removed)
+
+	changes := make(map[provider.Provider]*providerChanges)
+	changesFor := func(p provider.Provider) *providerChanges {
+		if c, ok := changes[p]; ok {
+			return c
+		}
+		c := &providerChanges{
+			Provider:      p.String(),
+			Added:         []string{},
+			Removed:       []string{},
+			IPv4Addresses: new(big.Int),
+			IPv6Addresses: new(big.Int),
+		}
+		changes[p] = c
+		return c
+	}
+	addressesFor := func(c *providerChanges, r *source.IPRange) *big.Int {
+		if r.Cat == source.CatIPv4 {
+			return c.IPv4Addresses
+		}
+		return c.IPv6Addresses
+	}
+	for _, r := range added {
+		c := changesFor(r.Provider)
+		c.Added = append(c.Added, r.Prefix.String())
+		addresses := addressesFor(c, r)
+		addresses.Add(addresses, prefixSize(r.Prefix))
+	}
+	for _, r := range removed {
+		c := changesFor(r.Provider)
+		c.Removed = append(c.Removed, r.Prefix.String())
+		addresses := addressesFor(c, r)
+		addresses.Sub(addresses, prefixSize(r.Prefix))
+	}
+
+	providers := make([]provider.Provider, 0, len(changes))
+	for p := range changes {
+		providers = append(providers, p)
+	}
+	slices.Sort(providers)
+	cl := changelog{Providers: make([]*providerChanges, 0, len(providers))}
+	for _, p := range providers {
+		cl.Providers = append(cl.Providers, changes[p])
+	}
+	return cl
+}
+
+// signed formats n with an explicit sign, eg. +256
+func signed(n *big.Int) string {
+	if n.Sign() > 0 {
+		return "+" + n.String()
+	}
+	return n.String()
+}
+
+func (c changelog) writeMarkdown(w io.Writer) error {
+	b := &strings.Builder{}
+	b.WriteString("# IP ranges changes\n\n")
+	if len(c.Providers) == 0 {
+		b.WriteString("No changes.\n")
+		_, err := io.WriteString(w, b.String())
+		return err
+	}
+
+	b.WriteString("| Provider | Added | Removed | IPv4 addresses | IPv6 addresses |\n")
+	b.WriteString("|---|---|---|---|---|\n")
+	for _, p := range c.Providers {
+		fmt.Fprintf(b, "| %s | %d | %d | %s | %s |\n", p.Provider, len(p.Added), len(p.Removed), signed(p.IPv4Addresses), signed(p.IPv6Addresses))
+	}
+	for _, p := range c.Providers {
+		fmt.Fprintf(b, "\n## %s\n\n```diff\n", p.Provider)
+		for _, prefix := range p.Added {
+			fmt.Fprintf(b, "+ %s\n", prefix)
+		}
+		for _, prefix := range p.Removed {
+			fmt.Fprintf(b, "- %s\n", prefix)
+		}
+		b.WriteString("```\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (c changelog) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(c)
+}
+
+func (c changelog) write(w io.Writer, format string) error {
+	switch format {
+	case diffMarkdown:
+		return c.writeMarkdown(w)
+	case diffJSON:
+		return c.writeJSON(w)
+	default:
+		return fmt.Errorf("unknown diff format %q, expected %s or %s", format, diffMarkdown, diffJSON)
+	}
+}
+
+// loadSnapshot reads the ranges of a directory of trees (ipv4.bin and ipv6.bin, eg. internal/static) or of ranges
+// files (<provider>.txt, eg. ranges)
+func loadSnapshot(dir string) ([]*source.IPRange, error) {
+	ipv4Path, ipv6Path := filepath.Join(dir, filepath.Base(ipv4TreePath)), filepath.Join(dir, filepath.Base(ipv6TreePath))
+	if _, err := os.Stat(ipv4Path); err == nil {
+		return loadPreviousRanges(ipv4Path, ipv6Path)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	ranges := make([]*source.IPRange, 0)
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), source.RangesFileExt) {
+			continue
+		}
+		fileRanges, err := source.ReadRangesFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, fileRanges...)
+	}
+	if len(ranges) == 0 {
+		return nil, errors.New("failed to read snapshot: no trees or ranges files in " + dir)
+	}
+	return ranges, nil
+}
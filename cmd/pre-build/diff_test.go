@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Escape-Technologies/cloudfinder/internal/source"
+	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
+)
+
+func newRange(p provider.Provider, cidr string) *source.IPRange {
+	prefix := netip.MustParsePrefix(cidr)
+	return &source.IPRange{Prefix: prefix, Cat: source.GetIPCat(prefix.Addr()), Provider: p}
+}
+
+func TestDiffRanges(t *testing.T) {
+	previous := []*source.IPRange{
+		newRange(provider.Aws, "10.0.0.0/24"),
+		newRange(provider.Aws, "10.0.1.0/24"),
+		newRange(provider.Gcp, "2001:db8::/32"),
+		newRange(provider.Vercel, "76.76.21.0/24"),
+	}
+	next := []*source.IPRange{
+		newRange(provider.Aws, "10.0.0.0/24"),
+		newRange(provider.Aws, "10.1.0.0/16"),
+		newRange(provider.Aws, "2001:db8:1::/48"),
+		newRange(provider.Vercel, "76.76.21.0/24"),
+	}
+
+	changes := diffRanges(previous, next)
+	if len(changes.Providers) != 2 {
+		t.Fatalf("Expected Aws and Gcp changes, got %+v", changes.Providers)
+	}
+	aws, gcp := changes.Providers[0], changes.Providers[1]
+	if aws.Provider != "Aws" || strings.Join(aws.Added, ",") != "10.1.0.0/16,2001:db8:1::/48" || strings.Join(aws.Removed, ",") != "10.0.1.0/24" {
+		t.Errorf("Unexpected Aws changes %+v", aws)
+	}
+	if aws.IPv4Addresses.String() != "65280" || aws.IPv6Addresses.String() != "1208925819614629174706176" {
+		t.Errorf("Expected +65280 IPv4 and +2^80 IPv6 addresses for Aws, got %s and %s", aws.IPv4Addresses, aws.IPv6Addresses)
+	}
+	if gcp.Provider != "Gcp" || len(gcp.Added) != 0 || len(gcp.Removed) != 1 || gcp.IPv6Addresses.Sign() >= 0 {
+		t.Errorf("Unexpected Gcp changes %+v", gcp)
+	}
+
+	markdown := &bytes.Buffer{}
+	if err := changes.write(markdown, diffMarkdown); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"| Aws | 2 | 1 | +65280 | +1208925819614629174706176 |", "## Gcp", "+ 10.1.0.0/16", "- 2001:db8::/32"} {
+		if !strings.Contains(markdown.String(), expected) {
+			t.Errorf("Expected %q in markdown, got:\n%s", expected, markdown)
+		}
+	}
+
+	raw := &bytes.Buffer{}
+	if err := changes.write(raw, diffJSON); err != nil {
+		t.Fatal(err)
+	}
+	var decoded changelog
+	if err := json.Unmarshal(raw.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Providers) != 2 || decoded.Providers[1].IPv6Addresses.Cmp(gcp.IPv6Addresses) != 0 {
+		t.Errorf("Expected the json to round trip, got %s", raw)
+	}
+
+	if err := changes.write(raw, "html"); err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+}
+
+func TestDiffNoChanges(t *testing.T) {
+	markdown := &bytes.Buffer{}
+	if err := diffRanges(nil, nil).write(markdown, diffMarkdown); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(markdown.String(), "No changes.") {
+		t.Errorf("Expected no changes, got %s", markdown)
+	}
+}
+
+// Both committed snapshots are written by the same pre-build run
+func TestLoadSnapshot(t *testing.T) {
+	root := filepath.Join("..", "..")
+	trees, err := loadSnapshot(filepath.Join(root, filepath.Dir(ipv4TreePath)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges, err := loadSnapshot(filepath.Join(root, "ranges"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes := diffRanges(trees, ranges); len(changes.Providers) != 0 {
+		t.Errorf("Expected the trees and ranges files to match, got %d changed providers", len(changes.Providers))
+	}
+
+	if _, err := loadSnapshot(t.TempDir()); err == nil {
+		t.Errorf("Expected an error for an empty snapshot")
+	}
+}
@@ -1,43 +1,124 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
-	"net"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"sort"
 	"strings"
+	"syscall"
+	"time"
 
 	"crypto/sha256"
 
+	"github.com/Escape-Technologies/cloudfinder/internal/asn"
 	"github.com/Escape-Technologies/cloudfinder/internal/log"
 	"github.com/Escape-Technologies/cloudfinder/internal/source"
 	"github.com/Escape-Technologies/cloudfinder/internal/tree"
 )
 
 const (
-	ipv4TreePath     = "internal/static/ipv4.gob"
-	ipv6TreePath     = "internal/static/ipv6.gob"
+	ipv4TreePath     = "internal/static/ipv4.bin"
+	ipv6TreePath     = "internal/static/ipv6.bin"
 	ipRangesHashPath = "internal/static/hash.txt"
 )
 
 // Fetches ip range sources & generates the ip range data file & tree data file
 func main() {
-	var writeRangesDir string
-	var force bool
-	flag.StringVar(&writeRangesDir, "write-ranges", "", "optionnaly store the ranges in a directory")
+	var writeRangesDir, proxy, cacheDir, diffFormat, diffAgainst, mrtDumps, writeASN, catalogPath string
+	var force, skipChecks bool
+	th := defaultThresholds
+	fetcher := source.NewFetcher(log.NewScoped(log.Logger))
+	flag.StringVar(&writeRangesDir, "write-ranges", "", "optionnaly store the ranges in a directory, one <provider>.txt file of cidr[,region[,service]] lines per provider")
 	flag.BoolVar(&force, "force", false, "force to re compute tree")
+	flag.StringVar(&proxy, "proxy", "", "http proxy for all requests, eg. http://proxy.corp:3128 (defaults to HTTPS_PROXY)")
+	flag.StringVar(&fetcher.UserAgent, "user-agent", fetcher.UserAgent, "user agent of all requests")
+	flag.StringVar(&fetcher.BgpToolsContact, "bgp-tools-contact", fetcher.BgpToolsContact, "contact appended to the user agent of the bgp.tools requests only, as bgp.tools requires (eg. an email)")
+	flag.DurationVar(&fetcher.Client.Timeout, "timeout", fetcher.Client.Timeout, "timeout of each request")
+	flag.IntVar(&fetcher.Retry.Attempts, "retries", fetcher.Retry.Attempts, "attempts per request, 1 disables retries")
+	flag.DurationVar(&fetcher.Retry.Backoff, "backoff", fetcher.Retry.Backoff, "wait before retrying a request, doubled for each retry")
+	flag.StringVar(&cacheDir, "cache-dir", defaultCacheDir(), "cache the feeds in this directory, feeds are then fetched with conditional requests. Empty disables the cache")
+	flag.BoolVar(&fetcher.Offline, "offline", false, "build from the cache only, without any request")
+	flag.IntVar(&th.minRanges, "min-ranges", th.minRanges, "fail if a provider has fewer ranges")
+	flag.Float64Var(&th.maxShrink, "max-shrink", th.maxShrink, "fail if a provider lost more than this percentage of its ranges since the previous build")
+	flag.Float64Var(&th.maxGrowth, "max-growth", th.maxGrowth, "fail if a provider gained more than this percentage of ranges since the previous build")
+	flag.BoolVar(&skipChecks, "skip-checks", false, "write the ranges even if the data checks fail, eg. after a provider really dropped ranges")
+	flag.StringVar(&diffFormat, "diff", "", "only print the changes since a previous snapshot, as markdown or json, nothing is written")
+	flag.StringVar(&diffAgainst, "diff-against", filepath.Dir(ipv4TreePath), "previous snapshot for -diff: a directory of trees (internal/static) or of ranges files (ranges)")
+	flag.StringVar(&mrtDumps, "mrt", "", "comma separated MRT RIB dumps (eg. from RouteViews or RIPE RIS, .gz and .bz2 are supported), used instead of bgp.tools for the ASN ranges")
+	flag.StringVar(&catalogPath, "catalog", "", "provider catalog replacing the embedded one (internal/source/catalog.json), it must describe every provider without a dedicated parser")
+	flag.StringVar(&writeASN, "write-asn", "", "optionnaly store the prefix to origin AS dataset (see cloud.WithASNData) in this file, compressed when it ends with .gz")
 	flag.Parse()
 
+	if diffFormat != "" && diffFormat != diffMarkdown && diffFormat != diffJSON {
+		log.Fatal("Invalid flags", fmt.Errorf("-diff must be %s or %s", diffMarkdown, diffJSON))
+	}
+
+	if cacheDir != "" {
+		cache, err := source.NewCache(cacheDir)
+		if err != nil {
+			log.Fatal("Invalid cache dir", err)
+		}
+		fetcher.Cache = cache
+	} else if fetcher.Offline {
+		log.Fatal("Invalid flags", errors.New("-offline requires -cache-dir"))
+	}
+
+	if mrtDumps != "" {
+		fetcher.ASNBackends[source.BackendMRT] = source.NewMRTBackend(strings.Split(mrtDumps, ",")...)
+		fetcher.DefaultASNBackend = source.BackendMRT
+	}
+
+	if proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			log.Fatal("Invalid proxy", err)
+		}
+		if err := fetcher.SetProxy(proxyURL); err != nil {
+			log.Fatal("Invalid proxy", err)
+		}
+	}
+
+	// Stop cleanly on interrupt: pending requests are aborted and nothing is written
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	sources, err := loadSources(catalogPath)
+	if err != nil {
+		log.Fatal("Invalid sources", err)
+	}
+
 	// Fetch sourceRanges then sort
-	sourceRanges := source.GetAllIPRanges(source.AllSources)
+	sourceRanges, err := source.GetAllIPRanges(ctx, fetcher, sources)
+	if ctx.Err() != nil {
+		log.Error("Interrupted, nothing was written", ctx.Err())
+		os.Exit(1) // nolint:gocritic
+	}
+	if err != nil {
+		log.Fatal("Failed to fetch ip ranges", err)
+	}
 	sortRanges(sourceRanges)
 
 	// Compute the hash of the rangesStr
 	hash := computeRangesHash(sourceRanges)
 	log.Info("Hash of ip ranges: %s", hash)
 
+	if diffFormat != "" {
+		printDiff(sourceRanges, diffAgainst, diffFormat)
+		return
+	}
+
+	if writeASN != "" {
+		writeASNData(ctx, fetcher, writeASN)
+	}
+
 	// Compare to previous hash
 	prevHash, err := os.ReadFile(ipRangesHashPath)
 	if err != nil {
@@ -49,38 +130,125 @@ func main() {
 		return
 	}
 
+	ipv4Tree, ipv6Tree := buildTrees(sourceRanges)
+
+	// Check the new ranges before writing anything
+	previous, err := loadPreviousRanges(ipv4TreePath, ipv6TreePath)
+	if err != nil {
+		log.Warning("Cannot compare with the previous ranges", err)
+	}
+	if previous != nil && !hasMetadata(previous) {
+		log.Info("Previous ranges have no region nor service, only the absolute checks are done against this legacy snapshot")
+		previous = nil
+	}
+	next := append(ipv4Tree.GetAllRanges(), ipv6Tree.GetAllRanges()...)
+	violations := checkRanges(sourceProviders(sources), previous, next, th)
+	if len(violations) > 0 {
+		report := fmt.Errorf("%d checks failed:\n%s", len(violations), formatViolations(violations))
+		if !skipChecks {
+			log.Fatal("Ranges look wrong, nothing was written (rerun with -skip-checks if the changes are expected)", report)
+		}
+		log.Warning("Ranges look wrong, written anyway (-skip-checks)", report)
+	}
+
 	// Write new hash to disk
 	err = os.WriteFile(ipRangesHashPath, []byte(hash), 0644) // nolint: mnd
 	if err != nil {
 		log.Fatal("Failed to write hash", err)
 	}
 
-	// Build tree
+	buildDate := time.Now()
+	writeTree(ipv4Tree, ipv4TreePath, hash, buildDate)
+	writeTree(ipv6Tree, ipv6TreePath, hash, buildDate)
+
+	if writeRangesDir != "" {
+		writeRangesToDir(ipv4Tree, ipv6Tree, writeRangesDir)
+		log.Info("Wrote ranges to %s", writeRangesDir)
+	}
+}
+
+// loadSources returns the sources of the catalog at path, of the embedded catalog when path is empty
+func loadSources(path string) ([]source.IPRangeSource, error) {
+	if path == "" {
+		return source.AllSources()
+	}
+	catalog, err := source.LoadCatalog(path)
+	if err != nil {
+		return nil, err
+	}
+	return source.NewSources(catalog)
+}
+
+func buildTrees(ranges []*source.IPRange) (tree.Tree, tree.Tree) {
 	count4 := 0
 	ipv4Tree := tree.NewIPv4Tree()
 	count6 := 0
 	ipv6Tree := tree.NewIPv6Tree()
-	for _, r := range sourceRanges {
+	for _, r := range ranges {
+		t := ipv6Tree
 		if r.Cat == source.CatIPv4 {
+			t = ipv4Tree
 			count4++
-			ipv4Tree.Add(r)
-		}
-		if r.Cat == source.CatIPv6 {
+		} else {
 			count6++
-			ipv6Tree.Add(r)
+		}
+		if err := t.Add(r); err != nil {
+			log.Fatal("Failed to build tree", err)
 		}
 	}
 
 	log.Info("Added %d IPv4 ranges to tree", count4)
 	log.Info("Added %d IPv6 ranges to tree", count6)
+	return ipv4Tree, ipv6Tree
+}
 
-	writeTree(ipv4Tree, ipv4TreePath)
-	writeTree(ipv6Tree, ipv6TreePath)
+// Print the changelog of the ranges since the snapshot in dir to stdout
+func printDiff(ranges []*source.IPRange, dir string, format string) {
+	previous, err := loadSnapshot(dir)
+	if err != nil {
+		log.Fatal("Failed to load previous snapshot", err)
+	}
+	ipv4Tree, ipv6Tree := buildTrees(ranges)
+	next := append(ipv4Tree.GetAllRanges(), ipv6Tree.GetAllRanges()...)
+	if err := diffRanges(previous, next).write(os.Stdout, format); err != nil {
+		log.Fatal("Failed to write diff", err)
+	}
+}
 
-	if writeRangesDir != "" {
-		writeRangesToDir(ipv4Tree, ipv6Tree, writeRangesDir)
-		log.Info("Wrote ranges to %s", writeRangesDir)
+// Write the prefix to origin AS dataset, from the ASN table of the default backend and the AS names of bgp.tools
+func writeASNData(ctx context.Context, fetcher *source.Fetcher, path string) {
+	table, err := source.GetASNTable(ctx, fetcher, "")
+	if err != nil {
+		log.Fatal("Failed to get asn table", err)
+	}
+	entries := make([]asn.Entry, 0, len(table))
+	for number, ranges := range table {
+		n, err := asn.ParseASN(number)
+		if err != nil {
+			log.Fatal("Invalid asn table", err)
+		}
+		for _, r := range ranges {
+			entries = append(entries, asn.Entry{Prefix: r.Prefix, ASN: n})
+		}
+	}
+
+	names, err := source.GetASNNames(ctx, fetcher)
+	if err != nil {
+		log.Warning("Writing the asn data without names", err)
+	}
+	if err := asn.WriteFile(path, entries, names); err != nil {
+		log.Fatal("Failed to write asn data", err)
 	}
+	log.Info("Wrote %d prefixes and %d AS names to %s", len(entries), len(names), path)
+}
+
+// Feeds cache in the user cache directory, eg. ~/.cache/cloudfinder/feeds. Empty (cache disabled) when unknown.
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "cloudfinder", "feeds")
 }
 
 func byteCountSI(b int64) string {
@@ -96,22 +264,39 @@ func byteCountSI(b int64) string {
 	return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "kMGTPE"[exp])
 }
 
-func writeTree(tree tree.Tree, path string) {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644) // nolint: mnd
+// writeTree writes the tree to a temporary file next to path, renamed once complete: readers (eg. a resolver watching
+// the directory) never see a partially written tree.
+func writeTree(t tree.Tree, path string, hash string, buildDate time.Time) {
+	var rawHash [tree.HashSize]byte
+	_, err := hex.Decode(rawHash[:], []byte(hash))
 	if err != nil {
-		panic(err)
+		log.Fatal("Failed to decode hash", err)
 	}
-	// empty file
-	err = f.Truncate(0)
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
 	if err != nil {
-		panic(err)
+		log.Fatal("Failed to write tree", err)
 	}
+	defer os.Remove(f.Name())
 
-	tree.SerializeTo(f)
-
+	err = tree.WriteFlat(f, t, rawHash, buildDate)
+	if err != nil {
+		f.Close()
+		log.Fatal("Failed to write tree", err) // nolint:gocritic
+	}
 	s, _ := f.Stat()
+	if err := f.Close(); err != nil {
+		log.Fatal("Failed to write tree", err)
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil { // nolint: mnd
+		log.Fatal("Failed to write tree", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		log.Fatal("Failed to write tree", err)
+	}
+
 	size := byteCountSI(s.Size())
-	log.Info("Wrote tree to %s (size: %s)", f.Name(), size)
+	log.Info("Wrote tree to %s (size: %s)", path, size)
 }
 
 func computeRangesHash(sortedRanges []*source.IPRange) string {
@@ -123,31 +308,25 @@ func computeRangesHash(sortedRanges []*source.IPRange) string {
 	return hex.EncodeToString(hash)
 }
 
-func compareIPs(a, b net.IP) int {
-	a = a.To16()
-	b = b.To16()
-	for i := 0; i < len(a); i++ {
-		if a[i] != b[i] {
-			if a[i] < b[i] {
-				return -1
-			}
-			return 1
-		}
-	}
-	return 0
-}
-
 func sortRanges(ranges []*source.IPRange) {
 	sort.Slice(ranges, func(i, j int) bool {
 		// Compare IP addresses
-		ipCompare := compareIPs(ranges[i].Network.IP, ranges[j].Network.IP)
+		ipCompare := ranges[i].Prefix.Addr().Compare(ranges[j].Prefix.Addr())
 		if ipCompare != 0 {
 			return ipCompare < 0
 		}
 		// If IP addresses are equal, compare prefix lengths (shorter prefixes first)
-		iMaskSize, _ := ranges[i].Network.Mask.Size()
-		jMaskSize, _ := ranges[j].Network.Mask.Size()
-		return iMaskSize < jMaskSize
+		if ranges[i].Prefix.Bits() != ranges[j].Prefix.Bits() {
+			return ranges[i].Prefix.Bits() < ranges[j].Prefix.Bits()
+		}
+		// Same network, keep a stable order so the hash only changes with the data
+		if ranges[i].Provider != ranges[j].Provider {
+			return ranges[i].Provider < ranges[j].Provider
+		}
+		if ranges[i].Service != ranges[j].Service {
+			return ranges[i].Service < ranges[j].Service
+		}
+		return ranges[i].Region < ranges[j].Region
 	})
 }
 
@@ -175,16 +354,15 @@ func writeRangesToDir(ipv4tree tree.Tree, ipv6tree tree.Tree, rangesDir string)
 		rangesPerProvider[providerKey] = append(rangesPerProvider[providerKey], r)
 	}
 
-	// Write ranges to files
+	// Write ranges to files, with their region and service
 	for provider, ranges := range rangesPerProvider {
-		fileContents := strings.Builder{}
-		for _, r := range ranges {
-			fileContents.WriteString(r.Network.String())
-			fileContents.WriteString("\n")
+		fileContents := bytes.Buffer{}
+		if err := source.WriteRanges(&fileContents, ranges); err != nil {
+			log.Fatal("Failed to write ranges file", err)
 		}
 
 		filePath := fmt.Sprintf("%s/%s.txt", rangesDir, provider)
-		err := os.WriteFile(filePath, []byte(fileContents.String()), os.ModePerm)
+		err := os.WriteFile(filePath, fileContents.Bytes(), os.ModePerm)
 		if err != nil {
 			log.Fatal("Failed to write ranges file", err)
 		}
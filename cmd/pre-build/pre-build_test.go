@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Escape-Technologies/cloudfinder/internal/log"
+	"github.com/Escape-Technologies/cloudfinder/internal/source"
+	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
+)
+
+func TestLoadSourcesCatalog(t *testing.T) {
+	catalog, err := source.DefaultCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog.Providers = append(catalog.Providers, source.CatalogProvider{
+		Name:     "Catalogtest",
+		Category: string(provider.CategoryHosting),
+		Sources:  []source.CatalogSource{{Kind: source.KindStatic, Ranges: []string{"192.0.2.0/24"}}},
+	})
+	b, err := json.Marshal(catalog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "catalog.json")
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sources, err := loadSources(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := sources[len(sources)-1]
+	if added.GetProvider().String() != "Catalogtest" || added.GetProvider().Category() != provider.CategoryHosting {
+		t.Errorf("Expected the provider of the catalog, got %s (%s)", added.GetProvider(), added.GetProvider().Category())
+	}
+	ranges, err := added.GetIPRanges(context.Background(), source.NewFetcher(log.Discard))
+	if err != nil || len(ranges) != 1 {
+		t.Errorf("Expected the range of the catalog, got %d ranges, %v", len(ranges), err)
+	}
+
+	// Every provider without a dedicated parser must be described
+	catalog.Providers = catalog.Providers[1:]
+	b, err = json.Marshal(catalog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadSources(path); err == nil {
+		t.Errorf("Expected an error for a catalog missing a provider")
+	}
+	if _, err := loadSources(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("Expected an error for a missing catalog")
+	}
+}
@@ -0,0 +1,285 @@
+package asn
+
+import (
+	"bufio"
+	"cmp"
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The dataset maps prefixes to the AS announcing them, it is written by pre-build -write-asn. Text format, one record
+// per line, gzip compressed when the file name ends with .gz:
+//
+//	# comment
+//	1.1.1.0/24 13335                 prefix and origin AS
+//	AS13335 Cloudflare, Inc.         name of an AS, optional
+//
+// Names are listed after the prefixes. When a prefix has several origins, the first one is kept.
+
+// Entry is a prefix and the AS announcing it
+type Entry struct {
+	Prefix netip.Prefix
+	ASN    uint32
+}
+
+// level holds the prefixes of a given length, sorted by address
+type level struct {
+	bits  int
+	addrs []netip.Addr
+	asns  []uint32
+}
+
+// Table finds the origin AS of addresses by longest prefix match. It is read only once built, safe for concurrent use.
+type Table struct {
+	// Levels of each family, from the longest to the shortest prefixes
+	v4, v6 []*level
+	names  map[uint32]string
+	count  int
+}
+
+// NewTable builds a table from entries, the first entry of a prefix wins
+func NewTable(entries []Entry, names map[uint32]string) *Table {
+	byBits := map[bool]map[int]*level{true: {}, false: {}}
+	seen := make(map[netip.Prefix]bool, len(entries))
+	t := &Table{names: names}
+	if t.names == nil {
+		t.names = map[uint32]string{}
+	}
+	for _, e := range entries {
+		prefix := e.Prefix.Masked()
+		if !prefix.IsValid() || seen[prefix] {
+			continue
+		}
+		seen[prefix] = true
+		is4 := prefix.Addr().Is4()
+		l, ok := byBits[is4][prefix.Bits()]
+		if !ok {
+			l = &level{bits: prefix.Bits()}
+			byBits[is4][prefix.Bits()] = l
+		}
+		l.addrs = append(l.addrs, prefix.Addr())
+		l.asns = append(l.asns, e.ASN)
+		t.count++
+	}
+
+	levels := func(m map[int]*level) []*level {
+		ls := make([]*level, 0, len(m))
+		for _, l := range m {
+			order := make([]int, len(l.addrs))
+			for i := range order {
+				order[i] = i
+			}
+			slices.SortFunc(order, func(a, b int) int { return l.addrs[a].Compare(l.addrs[b]) })
+			addrs, asns := make([]netip.Addr, len(order)), make([]uint32, len(order))
+			for i, j := range order {
+				addrs[i], asns[i] = l.addrs[j], l.asns[j]
+			}
+			l.addrs, l.asns = addrs, asns
+			ls = append(ls, l)
+		}
+		slices.SortFunc(ls, func(a, b *level) int { return b.bits - a.bits })
+		return ls
+	}
+	t.v4 = levels(byBits[true])
+	t.v6 = levels(byBits[false])
+	return t
+}
+
+// Len returns the number of prefixes
+func (t *Table) Len() int {
+	return t.count
+}
+
+// Lookup returns the origin AS of the most specific prefix containing addr, and that prefix. found is false when
+// no prefix matches. IPv4-mapped IPv6 addresses are looked up as IPv4.
+func (t *Table) Lookup(addr netip.Addr) (asn uint32, prefix netip.Prefix, found bool) {
+	addr = addr.Unmap()
+	levels := t.v6
+	if addr.Is4() {
+		levels = t.v4
+	}
+	for _, l := range levels {
+		masked, err := addr.Prefix(l.bits)
+		if err != nil {
+			continue
+		}
+		i, ok := slices.BinarySearchFunc(l.addrs, masked.Addr(), netip.Addr.Compare)
+		if ok {
+			return l.asns[i], masked, true
+		}
+	}
+	return 0, netip.Prefix{}, false
+}
+
+// Name returns the name of an AS, empty when unknown
+func (t *Table) Name(asn uint32) string {
+	return t.names[asn]
+}
+
+// ParseASN parses an AS number, with or without the AS prefix (eg. AS13335 or 13335)
+func ParseASN(s string) (uint32, error) {
+	s = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(s)), "AS")
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid AS number %q", s)
+	}
+	return uint32(n), nil
+}
+
+// Read parses a dataset
+func Read(r io.Reader) (*Table, error) {
+	entries := make([]Entry, 0)
+	names := make(map[uint32]string)
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		first, rest, _ := strings.Cut(text, " ")
+		rest = strings.TrimSpace(rest)
+		if strings.HasPrefix(first, "AS") {
+			asn, err := ParseASN(first)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			names[asn] = rest
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(first)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		asn, err := ParseASN(rest)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		entries = append(entries, Entry{Prefix: prefix, ASN: asn})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewTable(entries, names), nil
+}
+
+// Load reads a dataset file, decompressed when its name ends with .gz
+func Load(path string) (*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load asn data: %w", err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load asn data %s: %w", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	t, err := Read(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load asn data %s: %w", path, err)
+	}
+	return t, nil
+}
+
+// Write serializes entries and names in the dataset format, sorted so that the output only changes with the data. The
+// origins of a prefix announced by several ASes (MOAS) are sorted by ASN, the lowest one is kept when it is read.
+func Write(w io.Writer, entries []Entry, names map[uint32]string) error {
+	entries = slices.Clone(entries)
+	slices.SortFunc(entries, func(a, b Entry) int {
+		if c := a.Prefix.Addr().Compare(b.Prefix.Addr()); c != 0 {
+			return c
+		}
+		if c := a.Prefix.Bits() - b.Prefix.Bits(); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ASN, b.ASN)
+	})
+
+	out := bufio.NewWriter(w)
+	_, _ = out.WriteString("# cloudfinder asn data: \"<prefix> <asn>\" then \"AS<asn> <name>\" lines\n")
+	for _, e := range entries {
+		_, _ = fmt.Fprintf(out, "%s %d\n", e.Prefix, e.ASN)
+	}
+
+	asns := make([]uint32, 0, len(names))
+	for asn := range names {
+		asns = append(asns, asn)
+	}
+	slices.Sort(asns)
+	for _, asn := range asns {
+		name := strings.Join(strings.Fields(names[asn]), " ")
+		if name == "" {
+			continue
+		}
+		_, _ = fmt.Fprintf(out, "AS%d %s\n", asn, name)
+	}
+	return out.Flush()
+}
+
+// WriteFile writes a dataset file, compressed when its name ends with .gz
+func WriteFile(path string, entries []Entry, names map[uint32]string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if !strings.HasSuffix(path, ".gz") {
+		if err := Write(f, entries, names); err != nil {
+			return err
+		}
+		return f.Close()
+	}
+
+	gz := gzip.NewWriter(f)
+	if err := Write(gz, entries, names); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// ParseNamesCSV parses https://bgp.tools/asns.csv: asn,name,class,cc with a header line, eg. AS13335,"Cloudflare, Inc.",Eyeball,US
+func ParseNamesCSV(r io.Reader) (map[uint32]string, error) {
+	names := make(map[uint32]string)
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == 1 && len(record) > 0 && record[0] == "asn" {
+			continue
+		}
+		if len(record) < 2 { // nolint:mnd
+			return nil, fmt.Errorf("line %d: expected an AS number and a name", line)
+		}
+		asn, err := ParseASN(record[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		names[asn] = record[1]
+	}
+}
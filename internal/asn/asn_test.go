@@ -0,0 +1,145 @@
+package asn
+
+import (
+	"bytes"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func testEntries() []Entry {
+	return []Entry{
+		{netip.MustParsePrefix("1.1.1.0/24"), 13335},
+		{netip.MustParsePrefix("3.0.0.0/9"), 16509},
+		{netip.MustParsePrefix("3.5.140.0/22"), 16509},
+		{netip.MustParsePrefix("3.5.0.0/16"), 14618},
+		{netip.MustParsePrefix("2606:4700::/32"), 13335},
+		// Second origin of a prefix, ignored
+		{netip.MustParsePrefix("1.1.1.0/24"), 64500},
+	}
+}
+
+func TestLookup(t *testing.T) {
+	table := NewTable(testEntries(), map[uint32]string{13335: "CLOUDFLARENET"})
+	if table.Len() != 5 {
+		t.Errorf("Expected 5 prefixes, got %d", table.Len())
+	}
+
+	tests := []struct {
+		ip     string
+		asn    uint32
+		prefix string
+	}{
+		{"1.1.1.1", 13335, "1.1.1.0/24"},
+		{"::ffff:1.1.1.1", 13335, "1.1.1.0/24"},
+		{"3.1.2.3", 16509, "3.0.0.0/9"},
+		{"3.5.1.1", 14618, "3.5.0.0/16"},
+		{"3.5.141.1", 16509, "3.5.140.0/22"},
+		{"2606:4700::1111", 13335, "2606:4700::/32"},
+		{"8.8.8.8", 0, ""},
+		{"2001:db8::1", 0, ""},
+	}
+	for _, test := range tests {
+		asn, prefix, found := table.Lookup(netip.MustParseAddr(test.ip))
+		if found != (test.asn != 0) || asn != test.asn {
+			t.Errorf("Expected %s to be announced by AS%d, got AS%d (found: %t)", test.ip, test.asn, asn, found)
+		}
+		if found && prefix.String() != test.prefix {
+			t.Errorf("Expected %s to match %s, got %s", test.ip, test.prefix, prefix)
+		}
+	}
+
+	if table.Name(13335) != "CLOUDFLARENET" || table.Name(16509) != "" {
+		t.Errorf("Unexpected names %q and %q", table.Name(13335), table.Name(16509))
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	names := map[uint32]string{13335: "Cloudflare, Inc.", 16509: "  AMAZON-02\t", 14618: ""}
+	for _, name := range []string{"asn.txt", "asn.txt.gz"} {
+		path := filepath.Join(t.TempDir(), name)
+		if err := WriteFile(path, testEntries(), names); err != nil {
+			t.Fatal(err)
+		}
+		table, err := Load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if table.Len() != 5 {
+			t.Errorf("Expected 5 prefixes in %s, got %d", name, table.Len())
+		}
+		if asn, _, _ := table.Lookup(netip.MustParseAddr("3.5.141.1")); asn != 16509 {
+			t.Errorf("Expected AS16509 in %s, got AS%d", name, asn)
+		}
+		if table.Name(13335) != "Cloudflare, Inc." || table.Name(16509) != "AMAZON-02" {
+			t.Errorf("Unexpected names in %s: %q and %q", name, table.Name(13335), table.Name(16509))
+		}
+	}
+
+	// Sorted by prefix, names last
+	buf := &bytes.Buffer{}
+	if err := Write(buf, testEntries(), names); err != nil {
+		t.Fatal(err)
+	}
+	expected := `1.1.1.0/24 13335
+1.1.1.0/24 64500
+3.0.0.0/9 16509
+3.5.0.0/16 14618
+3.5.140.0/22 16509
+2606:4700::/32 13335
+AS13335 Cloudflare, Inc.
+AS16509 AMAZON-02
+`
+	_, body, _ := strings.Cut(buf.String(), "\n")
+	if body != expected {
+		t.Errorf("Expected dataset:\n%s\ngot:\n%s", expected, body)
+	}
+
+	// Whatever the order of the entries, eg. the origins of 1.1.1.0/24
+	reversed := testEntries()
+	slices.Reverse(reversed)
+	buf.Reset()
+	if err := Write(buf, reversed, names); err != nil {
+		t.Fatal(err)
+	}
+	if _, body, _ := strings.Cut(buf.String(), "\n"); body != expected {
+		t.Errorf("Expected dataset:\n%s\ngot:\n%s", expected, body)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	tests := []string{
+		"1.1.1.0/24",
+		"1.1.1.0/33 13335",
+		"1.1.1.0/24 AS",
+		"1.1.1.0/24 99999999999",
+		"ASX Cloudflare",
+	}
+	for _, test := range tests {
+		if _, err := Read(strings.NewReader(test)); err == nil {
+			t.Errorf("Expected an error for %q", test)
+		}
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.gz")); err == nil {
+		t.Errorf("Expected an error for a missing file")
+	}
+}
+
+func TestParseNamesCSV(t *testing.T) {
+	names, err := ParseNamesCSV(strings.NewReader("asn,name,class,cc\nAS13335,\"Cloudflare, Inc.\",Eyeball,US\nAS16509,AMAZON-02,Content,US\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[13335] != "Cloudflare, Inc." || names[16509] != "AMAZON-02" {
+		t.Errorf("Unexpected names %v", names)
+	}
+
+	if _, err := ParseNamesCSV(strings.NewReader("AS13335\n")); err == nil {
+		t.Errorf("Expected an error for a line without name")
+	}
+	if _, err := ParseNamesCSV(strings.NewReader("Cloudflare,13335\n")); err == nil {
+		t.Errorf("Expected an error for an invalid AS number")
+	}
+}
@@ -54,11 +54,19 @@ func fmtMsgErr(msg string, err error) string {
 var Logger = NewLogger(LevelDebug)
 
 func logCtx(ctx context.Context, level slog.Level, msg string, args ...interface{}) {
-	Logger.Log(ctx, level, fmt.Sprintf(msg, args...))
+	logTo(ctx, Logger, level, msg, args...)
 }
 
 func logErrCtx(ctx context.Context, level slog.Level, msg string, err error) {
-	Logger.Log(ctx, level, fmtMsgErr(msg, err))
+	logErrTo(ctx, Logger, level, msg, err)
+}
+
+func logTo(ctx context.Context, logger *slog.Logger, level slog.Level, msg string, args ...interface{}) {
+	logger.Log(ctx, level, fmt.Sprintf(msg, args...))
+}
+
+func logErrTo(ctx context.Context, logger *slog.Logger, level slog.Level, msg string, err error) {
+	logger.Log(ctx, level, fmtMsgErr(msg, err))
 }
 
 func Debug(msg string, args ...interface{}) { logCtx(context.Background(), LevelDebug, msg, args...) }
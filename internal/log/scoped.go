@@ -0,0 +1,48 @@
+package log
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Scoped logs to its own *slog.Logger instead of the package Logger, with the same helpers as the package functions.
+// Library code takes a *Scoped by injection, so that each resolver (and each user of the library) controls its logs.
+// A nil *Scoped discards everything. There is no Fatal: library code returns errors instead.
+type Scoped struct {
+	logger *slog.Logger
+}
+
+// NewScoped returns a Scoped logging to logger, nil discards everything.
+func NewScoped(logger *slog.Logger) *Scoped {
+	if logger == nil {
+		logger = slog.New(slog.DiscardHandler)
+	}
+	return &Scoped{logger: logger}
+}
+
+// Discard is a Scoped that drops every record.
+var Discard = NewScoped(nil)
+
+// Logger returns the underlying *slog.Logger.
+func (s *Scoped) Logger() *slog.Logger {
+	if s == nil {
+		return Discard.logger
+	}
+	return s.logger
+}
+
+func (s *Scoped) Debug(msg string, args ...interface{}) {
+	logTo(context.Background(), s.Logger(), LevelDebug, msg, args...)
+}
+
+func (s *Scoped) Info(msg string, args ...interface{}) {
+	logTo(context.Background(), s.Logger(), LevelInfo, msg, args...)
+}
+
+func (s *Scoped) Warning(msg string, err error) {
+	logErrTo(context.Background(), s.Logger(), LevelWarning, msg, err)
+}
+
+func (s *Scoped) Error(msg string, err error) {
+	logErrTo(context.Background(), s.Logger(), LevelError, msg, err)
+}
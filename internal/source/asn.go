@@ -0,0 +1,148 @@
+package source
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/Escape-Technologies/cloudfinder/internal/asn"
+)
+
+// ASN backends, picked by the asn sources of the catalog (see CatalogSource.Backend)
+const (
+	// BackendBgpTools downloads the bgp.tools table
+	BackendBgpTools = "bgptools"
+	// BackendMRT reads local MRT RIB dumps, see MRTBackend
+	BackendMRT = "mrt"
+)
+
+// ASNBackend maps AS numbers to the ranges they announce. Backends load their data once and are safe for concurrent use.
+type ASNBackend interface {
+	// Table returns the ranges announced by each AS, keyed by AS number without the AS prefix (eg. 16276).
+	// The table is shared, callers must copy the ranges before modifying them.
+	Table(ctx context.Context, f *Fetcher) (map[string][]*IPRange, error)
+}
+
+// GetASNTable returns the table of the given backend, the default one of f when empty
+func GetASNTable(ctx context.Context, f *Fetcher, backend string) (map[string][]*IPRange, error) {
+	if backend == "" {
+		backend = f.DefaultASNBackend
+	}
+	b, ok := f.ASNBackends[backend]
+	if !ok {
+		return nil, fmt.Errorf("asn backend %s is not configured", backend)
+	}
+	return b.Table(ctx, f)
+}
+
+// getRangesForAsn returns the ranges of asn from the given backend, an empty slice when it announces none
+func getRangesForAsn(ctx context.Context, f *Fetcher, backend string, asn string) ([]*IPRange, error) {
+	table, err := GetASNTable(ctx, f, backend)
+	if err != nil {
+		return nil, err
+	}
+	if val, ok := table[asn]; ok {
+		return val, nil
+	}
+	return []*IPRange{}, nil
+}
+
+// asnTable is the table of a backend, loaded on first use. A failed load is retried on the next call.
+type asnTable struct {
+	lock   sync.Mutex
+	ranges map[string][]*IPRange
+}
+
+func (t *asnTable) get(load func() (map[string][]*IPRange, error)) (map[string][]*IPRange, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.ranges == nil {
+		ranges, err := load()
+		if err != nil {
+			return nil, err
+		}
+		t.ranges = ranges
+	}
+	return t.ranges, nil
+}
+
+/// BGP TOOLS
+
+var (
+	bgpToolsTableURL = "https://bgp.tools/table.txt"
+	bgpToolsNamesURL = "https://bgp.tools/asns.csv"
+)
+
+// BgpToolsBackend fetches https://bgp.tools/table.txt once, with the fetcher of the first call
+type BgpToolsBackend struct {
+	table asnTable
+}
+
+func (b *BgpToolsBackend) Table(ctx context.Context, f *Fetcher) (map[string][]*IPRange, error) {
+	return b.table.get(func() (map[string][]*IPRange, error) {
+		f.Logger.Info("Fetching AS infos from %s", bgpToolsTableURL)
+		table, err := f.GetBytes(ctx, bgpToolsTableURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get bgp tools table: %w", err)
+		}
+
+		asnRanges, err := parseBgpToolsTable(bytes.NewReader(table))
+		if err != nil {
+			return nil, err
+		}
+		f.Logger.Info("Got %d AS infos", len(asnRanges))
+		return asnRanges, nil
+	})
+}
+
+// parseBgpToolsTable parses https://bgp.tools/table.txt into the ASN -> CIDR map, private networks are skipped
+func parseBgpToolsTable(r io.Reader) (map[string][]*IPRange, error) {
+	asnRanges := make(map[string][]*IPRange)
+	scanner := bufio.NewScanner(r)
+	// Read lines
+	for scanner.Scan() {
+		line := scanner.Text()
+		// Line is formatted as "<CIDR> <ASN>"
+		x := strings.Split(line, " ")
+		if len(x) != 2 { // nolint: mnd
+			continue
+		}
+		cidr, asn := x[0], x[1]
+
+		n, cat, err := ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse bgp tools table: %w", err)
+		}
+		// Skip private networks
+		if isPrivateNetwork(n) {
+			continue
+		}
+		// Fill map
+		asnRanges[asn] = append(asnRanges[asn], &IPRange{
+			Prefix: n,
+			Cat:    cat,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read bgp tools table: %w", err)
+	}
+	return asnRanges, nil
+}
+
+// GetASNNames fetches the names of the ASes from bgp.tools
+func GetASNNames(ctx context.Context, f *Fetcher) (map[uint32]string, error) {
+	f.Logger.Info("Fetching AS names from %s", bgpToolsNamesURL)
+	body, err := f.GetBytes(ctx, bgpToolsNamesURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get AS names: %w", err)
+	}
+	names, err := asn.ParseNamesCSV(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse AS names: %w", err)
+	}
+	return names, nil
+}
@@ -0,0 +1,99 @@
+package source
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrNotCached is returned in offline mode for urls missing from the cache
+var ErrNotCached = errors.New("not in cache")
+
+// Cache stores the upstream feeds on disk, keyed by url. Each url has two files named after the sha256 of the url:
+// <hash>.body holds the raw body, <hash>.json the validators (ETag, Last-Modified) used for conditional requests.
+type Cache struct {
+	dir string
+}
+
+type cacheEntry struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	FetchedAt    time.Time `json:"fetched_at"`
+}
+
+// NewCache creates the cache directory if needed.
+func NewCache(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil { // nolint:mnd
+		return nil, fmt.Errorf("failed to create cache dir: %w", err)
+	}
+	return &Cache{dir: dir}, nil
+}
+
+func (c *Cache) path(url string, ext string) string {
+	hash := sha256.Sum256([]byte(url))
+	return filepath.Join(c.dir, hex.EncodeToString(hash[:])+ext)
+}
+
+// load returns the cached entry and body of url, ErrNotCached when missing.
+func (c *Cache) load(url string) (*cacheEntry, []byte, error) {
+	meta, err := os.ReadFile(c.path(url, ".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, ErrNotCached
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	entry := &cacheEntry{}
+	if err := json.Unmarshal(meta, entry); err != nil {
+		return nil, nil, fmt.Errorf("corrupted cache entry for %s: %w", url, err)
+	}
+	body, err := os.ReadFile(c.path(url, ".body"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, ErrNotCached
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return entry, body, nil
+}
+
+// store removes the old entry, writes the body, then its new entry: an interrupted write leaves the url uncached,
+// never a new body next to the ETag of the old one.
+func (c *Cache) store(entry *cacheEntry, body []byte) error {
+	if err := os.Remove(c.path(entry.URL, ".json")); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to cache %s: %w", entry.URL, err)
+	}
+	if err := writeFileAtomic(c.path(entry.URL, ".body"), body); err != nil {
+		return fmt.Errorf("failed to cache %s: %w", entry.URL, err)
+	}
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to cache %s: %w", entry.URL, err)
+	}
+	if err := writeFileAtomic(c.path(entry.URL, ".json"), meta); err != nil {
+		return fmt.Errorf("failed to cache %s: %w", entry.URL, err)
+	}
+	return nil
+}
+
+func writeFileAtomic(path string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,146 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFetcherCache(t *testing.T) {
+	body := atomic.Value{}
+	body.Store("v1")
+	down := atomic.Bool{}
+	notModified := atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		etag := `"` + body.Load().(string) + `"` // nolint:forcetypeassert
+		if r.Header.Get("If-None-Match") == etag {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(body.Load().(string))) // nolint:forcetypeassert
+	}))
+	defer server.Close()
+
+	cache, err := NewCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newTestFetcher()
+	f.Cache = cache
+	get := func(expected string) {
+		t.Helper()
+		b, err := f.GetString(context.Background(), server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b != expected {
+			t.Errorf("Expected %q, got %q", expected, b)
+		}
+	}
+
+	get("v1")
+	// Conditional request, answered from the cache
+	get("v1")
+	if notModified.Load() != 1 {
+		t.Errorf("Expected 1 not modified response, got %d", notModified.Load())
+	}
+
+	// Changed upstream
+	body.Store("v2")
+	get("v2")
+
+	// Unreachable upstream, answered from the cache
+	down.Store(true)
+	get("v2")
+
+	// Offline, answered from the cache without requests
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		t.Errorf("Expected no request offline")
+	})
+	f.Offline = true
+	get("v2")
+	if _, err := f.GetString(context.Background(), server.URL+"/missing"); !errors.Is(err, ErrNotCached) {
+		t.Errorf("Expected %v, got %v", ErrNotCached, err)
+	}
+}
+
+func TestFetcherCacheLastModified(t *testing.T) {
+	const lastModified = "Mon, 14 Oct 2024 12:00:00 GMT"
+	notModified := atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-Modified-Since") == lastModified {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Last-Modified", lastModified)
+		_, _ = w.Write([]byte("table"))
+	}))
+	defer server.Close()
+
+	cache, err := NewCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		// A new fetcher per run, as for pre-build runs sharing a cache directory
+		f := newTestFetcher()
+		f.Cache = cache
+		b, err := f.GetString(context.Background(), server.URL)
+		if err != nil || b != "table" {
+			t.Errorf("Expected table, got %q (%v)", b, err)
+		}
+	}
+	if notModified.Load() != 1 {
+		t.Errorf("Expected 1 not modified response, got %d", notModified.Load())
+	}
+}
+
+func TestFetcherNoCacheNotModified(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer server.Close()
+
+	// Without a conditional request, a 304 is an error
+	if _, err := newTestFetcher().GetString(context.Background(), server.URL); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
+
+func TestCacheStoreFailureDropsEntry(t *testing.T) {
+	cache, err := NewCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "https://example.com/ranges"
+	if err := cache.store(&cacheEntry{URL: url, ETag: `"v1"`}, []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A directory in place of the body makes the next write fail
+	body := cache.path(url, ".body")
+	if err := os.Remove(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(body, "busy"), 0o755); err != nil { // nolint:mnd
+		t.Fatal(err)
+	}
+	if err := cache.store(&cacheEntry{URL: url, ETag: `"v2"`}, []byte("v2")); err == nil {
+		t.Fatal("Expected an error writing the body")
+	}
+	if _, _, err := cache.load(url); !errors.Is(err, ErrNotCached) {
+		t.Errorf("Expected %v, got %v", ErrNotCached, err)
+	}
+}
@@ -0,0 +1,374 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
+)
+
+// The catalog describes the providers whose ranges follow a generic pattern, so that adding a provider or updating
+// its ASNs does not need any Go code. Providers missing from the enum are registered (see provider.Register) when the
+// sources are built, the trees store them by name along with their category.
+
+//go:embed catalog.json
+var defaultCatalog []byte
+
+// Kinds of catalog sources
+const (
+	// KindJSON reads the cidrs at Paths in a json document
+	KindJSON = "json"
+	// KindText reads one cidr per line, empty lines and lines starting with # are skipped
+	KindText = "text"
+	// KindCSV reads the cidrs in Column of a csv file
+	KindCSV = "csv"
+	// KindASN uses the ranges announced by ASNs, from an ASNBackend
+	KindASN = "asn"
+	// KindStatic uses the hardcoded Ranges
+	KindStatic = "static"
+)
+
+// Catalog lists providers and where to get their ranges, see catalog.json.
+type Catalog struct {
+	Providers []CatalogProvider `json:"providers"`
+}
+
+type CatalogProvider struct {
+	// Name of the provider, matched case insensitively with the existing providers
+	Name string `json:"name"`
+	Note string `json:"note,omitempty"`
+	// Default category of the provider ranges (see provider.Category), only for the providers missing from the enum:
+	// built-in providers have theirs in pkg/provider/category.go
+	Category string          `json:"category,omitempty"`
+	Sources  []CatalogSource `json:"sources"`
+}
+
+// CatalogSource is one feed of a provider, the fields used depend on its Kind.
+type CatalogSource struct {
+	Kind string `json:"kind"`
+	Note string `json:"note,omitempty"`
+	// Feed of the json, text and csv kinds
+	URL string `json:"url,omitempty"`
+	// json: paths of the cidrs, keys separated by dots, [] iterates over an array, eg. prefixes[].ip_prefix
+	Paths []string `json:"paths,omitempty"`
+	// csv: column of the cidrs, from 0. When Fields is set, lines with another number of fields are skipped.
+	Column int `json:"column,omitempty"`
+	Fields int `json:"fields,omitempty"`
+	// asn: AS numbers, without the AS prefix, and the backend announcing their ranges (see ASNBackend). The default
+	// backend of the fetcher is used when empty.
+	ASNs    []string `json:"asns,omitempty"`
+	Backend string   `json:"backend,omitempty"`
+	// static: cidrs
+	Ranges []string `json:"ranges,omitempty"`
+	// Optional metadata of all the ranges of the source
+	Region  string `json:"region,omitempty"`
+	Service string `json:"service,omitempty"`
+}
+
+// ParseCatalog reads and validates a json catalog. Unknown fields are rejected, to catch typos.
+func ParseCatalog(b []byte) (*Catalog, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	var c Catalog
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("failed to parse catalog: %w", err)
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// LoadCatalog reads a catalog file
+func LoadCatalog(path string) (*Catalog, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load catalog: %w", err)
+	}
+	c, err := ParseCatalog(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+func (c *Catalog) validate() error {
+	names := make(map[string]bool)
+	for i, p := range c.Providers {
+		name := strings.ToLower(strings.TrimSpace(p.Name))
+		if name == "" {
+			return fmt.Errorf("invalid catalog: provider %d has no name", i)
+		}
+		if names[name] {
+			return fmt.Errorf("invalid catalog: provider %s is listed twice", p.Name)
+		}
+		names[name] = true
+		if _, err := provider.ParseCategory(p.Category); err != nil {
+			return fmt.Errorf("invalid catalog: provider %s: %w", p.Name, err)
+		}
+		if builtin, err := provider.ParseProviderFold(p.Name); err == nil && !builtin.IsCustom() && p.Category != "" {
+			return fmt.Errorf("invalid catalog: provider %s is built-in, its category is in pkg/provider/category.go", p.Name)
+		}
+		if len(p.Sources) == 0 {
+			return fmt.Errorf("invalid catalog: provider %s has no source", p.Name)
+		}
+		for j, s := range p.Sources {
+			if err := s.validate(); err != nil {
+				return fmt.Errorf("invalid catalog: provider %s, source %d: %w", p.Name, j, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *CatalogSource) validate() error {
+	switch s.Kind {
+	case KindJSON, KindText, KindCSV:
+		if s.URL == "" {
+			return fmt.Errorf("%s source without url", s.Kind)
+		}
+	case KindASN:
+		if len(s.ASNs) == 0 {
+			return errors.New("asn source without asns")
+		}
+	case KindStatic:
+		if len(s.Ranges) == 0 {
+			return errors.New("static source without ranges")
+		}
+		if _, err := s.toRanges(s.Ranges); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown kind %q", s.Kind)
+	}
+	if s.Backend != "" && (s.Kind != KindASN || (s.Backend != BackendBgpTools && s.Backend != BackendMRT)) {
+		return fmt.Errorf("invalid backend %q, asn sources use %s or %s", s.Backend, BackendBgpTools, BackendMRT)
+	}
+	if s.Kind == KindJSON && len(s.Paths) == 0 {
+		return errors.New("json source without paths")
+	}
+	if s.Column < 0 || (s.Fields > 0 && s.Column >= s.Fields) {
+		return fmt.Errorf("invalid csv column %d", s.Column)
+	}
+	return nil
+}
+
+// Sources registers the providers of the catalog and returns their sources
+func (c *Catalog) Sources() ([]IPRangeSource, error) {
+	sources := make([]IPRangeSource, 0, len(c.Providers))
+	for _, p := range c.Providers {
+		registered, err := provider.Register(p.Name)
+		if err != nil {
+			return nil, err
+		}
+		if p.Category != "" {
+			// Validated by ParseCatalog
+			category, _ := provider.ParseCategory(p.Category)
+			provider.SetCategory(registered, category)
+		}
+		sources = append(sources, catalogSource{provider: registered, sources: p.Sources})
+	}
+	return sources, nil
+}
+
+// DefaultCatalog returns the embedded catalog (catalog.json)
+func DefaultCatalog() (*Catalog, error) {
+	c, err := ParseCatalog(defaultCatalog)
+	if err != nil {
+		return nil, fmt.Errorf("embedded catalog: %w", err)
+	}
+	return c, nil
+}
+
+// catalogSource fetches the ranges of a catalog provider
+type catalogSource struct {
+	provider provider.Provider
+	sources  []CatalogSource
+}
+
+func (c catalogSource) GetProvider() provider.Provider {
+	return c.provider
+}
+
+func (c catalogSource) GetIPRanges(ctx context.Context, f *Fetcher) ([]*IPRange, error) {
+	ranges := make([]*IPRange, 0)
+	for _, s := range c.sources {
+		sourceRanges, err := s.getIPRanges(ctx, f, c.provider)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, sourceRanges...)
+	}
+	return ranges, nil
+}
+
+func (s *CatalogSource) getIPRanges(ctx context.Context, f *Fetcher, p provider.Provider) ([]*IPRange, error) {
+	switch s.Kind {
+	case KindStatic:
+		f.Logger.Info("[%s] - Using static ranges", p)
+		return s.toRanges(s.Ranges)
+	case KindASN:
+		ranges := make([]*IPRange, 0)
+		for _, asn := range s.ASNs {
+			f.Logger.Info("[%s] - Using ranges from ASN list (AS%s)", p, asn)
+			asnRanges, err := getRangesForAsn(ctx, f, s.Backend, asn)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range asnRanges {
+				ranges = append(ranges, &IPRange{Prefix: r.Prefix, Cat: r.Cat, Region: s.Region, Service: s.Service})
+			}
+			f.Logger.Info("[%s] - Found %d ranges for AS%s", p, len(asnRanges), asn)
+		}
+		return ranges, nil
+	}
+
+	f.Logger.Info("[%s] - Fetching ip ranges from %s", p, s.URL)
+	body, err := f.GetBytes(ctx, s.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s ip ranges: %w", p, err)
+	}
+	ranges, err := s.parse(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s ip ranges from %s: %w", p, s.URL, err)
+	}
+	return ranges, nil
+}
+
+// parse extracts the ranges of a json, text or csv feed
+func (s *CatalogSource) parse(body []byte) ([]*IPRange, error) {
+	var cidrs []string
+	var err error
+	switch s.Kind {
+	case KindJSON:
+		cidrs, err = parseJSONPaths(body, s.Paths)
+	case KindText:
+		cidrs = parseTextLines(string(body))
+	case KindCSV:
+		cidrs, err = parseCSVColumn(body, s.Column, s.Fields)
+	default:
+		err = fmt.Errorf("%s source has no feed", s.Kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.toRanges(cidrs)
+}
+
+func (s *CatalogSource) toRanges(cidrs []string) ([]*IPRange, error) {
+	ranges := make([]*IPRange, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		network, cat, err := ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range: %w", err)
+		}
+		ranges = append(ranges, &IPRange{
+			Prefix:  network,
+			Cat:     cat,
+			Region:  s.Region,
+			Service: s.Service,
+		})
+	}
+	return ranges, nil
+}
+
+// parseJSONPaths returns the strings found at each path, a path ending on an array of strings returns all of them
+func parseJSONPaths(body []byte, paths []string) ([]string, error) {
+	var doc any
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+	cidrs := make([]string, 0)
+	for _, path := range paths {
+		values := []any{doc}
+		for _, key := range strings.Split(path, ".") {
+			key, iterate := strings.CutSuffix(key, "[]")
+			next := make([]any, 0, len(values))
+			for _, v := range values {
+				if key != "" {
+					obj, ok := v.(map[string]any)
+					if !ok {
+						return nil, fmt.Errorf("%s: expected an object at %q", path, key)
+					}
+					v = obj[key]
+				}
+				if !iterate {
+					next = append(next, v)
+					continue
+				}
+				array, ok := v.([]any)
+				if !ok {
+					return nil, fmt.Errorf("%s: expected an array at %q", path, key)
+				}
+				next = append(next, array...)
+			}
+			values = next
+		}
+
+		for _, v := range values {
+			switch v := v.(type) {
+			case string:
+				cidrs = append(cidrs, v)
+			case []any:
+				for _, item := range v {
+					s, ok := item.(string)
+					if !ok {
+						return nil, fmt.Errorf("%s: expected strings, got %v", path, item)
+					}
+					cidrs = append(cidrs, s)
+				}
+			case nil:
+				// Missing key, eg. an ipv4 only entry in a list of ipv4 and ipv6 prefixes
+			default:
+				return nil, fmt.Errorf("%s: expected strings, got %v", path, v)
+			}
+		}
+	}
+	return cidrs, nil
+}
+
+// parseTextLines returns the non empty lines, without spaces and # comments
+func parseTextLines(content string) []string {
+	cidrs := make([]string, 0)
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.ReplaceAll(strings.TrimSpace(line), " ", "")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cidrs = append(cidrs, line)
+	}
+	return cidrs
+}
+
+// parseCSVColumn returns the given column of each line. When fields is set, lines with another number of fields are
+// skipped: some feeds are broken, eg. the DigitalOcean geofeed has lines with missing fields.
+func parseCSVColumn(body []byte, column, fields int) ([]string, error) {
+	r := csv.NewReader(bytes.NewReader(body))
+	r.FieldsPerRecord = -1
+	r.Comment = '#'
+	cidrs := make([]string, 0)
+	for {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return cidrs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if fields > 0 && len(record) != fields {
+			continue
+		}
+		if column >= len(record) {
+			return nil, fmt.Errorf("line with %d fields, expected column %d", len(record), column)
+		}
+		cidrs = append(cidrs, strings.TrimSpace(record[column]))
+	}
+}
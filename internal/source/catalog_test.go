@@ -0,0 +1,136 @@
+package source
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
+)
+
+func TestParseCatalogErrors(t *testing.T) {
+	tests := map[string]string{
+		"json":             `{"providers": [`,
+		"unknown field":    `{"providers": [{"name": "x", "source": []}]}`,
+		"no name":          `{"providers": [{"sources": [{"kind": "asn", "asns": ["1"]}]}]}`,
+		"duplicate name":   `{"providers": [{"name": "x", "sources": [{"kind": "asn", "asns": ["1"]}]}, {"name": "X", "sources": [{"kind": "asn", "asns": ["2"]}]}]}`,
+		"no sources":       `{"providers": [{"name": "x"}]}`,
+		"unknown kind":     `{"providers": [{"name": "x", "sources": [{"kind": "xml", "url": "https://example.com"}]}]}`,
+		"no url":           `{"providers": [{"name": "x", "sources": [{"kind": "text"}]}]}`,
+		"no paths":         `{"providers": [{"name": "x", "sources": [{"kind": "json", "url": "https://example.com"}]}]}`,
+		"no asns":          `{"providers": [{"name": "x", "sources": [{"kind": "asn"}]}]}`,
+		"invalid range":    `{"providers": [{"name": "x", "sources": [{"kind": "static", "ranges": ["10.0.0.0"]}]}]}`,
+		"invalid column":   `{"providers": [{"name": "x", "sources": [{"kind": "csv", "url": "https://example.com", "column": 5, "fields": 5}]}]}`,
+		"negative column":  `{"providers": [{"name": "x", "sources": [{"kind": "csv", "url": "https://example.com", "column": -1}]}]}`,
+		"no static ranges": `{"providers": [{"name": "x", "sources": [{"kind": "static"}]}]}`,
+		"unknown backend":  `{"providers": [{"name": "x", "sources": [{"kind": "asn", "asns": ["1"], "backend": "ripe"}]}]}`,
+		"backend of text":  `{"providers": [{"name": "x", "sources": [{"kind": "text", "url": "https://example.com", "backend": "mrt"}]}]}`,
+		"unknown category": `{"providers": [{"name": "x", "category": "database", "sources": [{"kind": "asn", "asns": ["1"]}]}]}`,
+		"builtin category": `{"providers": [{"name": "ovh", "category": "cdn", "sources": [{"kind": "asn", "asns": ["1"]}]}]}`,
+	}
+	for name, catalog := range tests {
+		if _, err := ParseCatalog([]byte(catalog)); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+}
+
+func TestParseJSONPaths(t *testing.T) {
+	body, err := os.ReadFile(filepath.Join("testdata", "aws_ip-ranges.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cidrs, err := parseJSONPaths(body, []string{"prefixes[].ip_prefix", "ipv6_prefixes[].ipv6_prefix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Same prefixes as the Aws parser, before deduplication
+	if len(cidrs) != 5 || cidrs[0] != "3.5.140.0/22" || !strings.Contains(cidrs[4], ":") {
+		t.Errorf("Expected the 5 aws prefixes, got %v", cidrs)
+	}
+
+	errors := map[string]string{
+		"not an object": `{"prefixes": ["x"]}`,
+		"not an array":  `{"prefixes": {"ip_prefix": "x"}}`,
+		"not a string":  `{"prefixes": [{"ip_prefix": 1}]}`,
+	}
+	for name, body := range errors {
+		if _, err := parseJSONPaths([]byte(body), []string{"prefixes[].ip_prefix"}); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+}
+
+func TestCatalogSources(t *testing.T) {
+	catalog, err := ParseCatalog([]byte(`{"providers": [
+		{"name": "Cloudflare", "sources": [{"kind": "text", "url": "https://www.cloudflare.com/ips-v4/#"}]},
+		{"name": "Example Cloud", "sources": [
+			{"kind": "static", "ranges": ["192.0.2.0/24"], "region": "eu-1"},
+			{"kind": "json", "url": "https://api.fastly.com/public-ip-list", "paths": ["ipv6_addresses"], "service": "CDN"},
+			{"kind": "asn", "asns": ["12876"]}
+		]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources, err := catalog.Sources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 2 || sources[0].GetProvider() != provider.Cloudflare {
+		t.Fatalf("Expected the Cloudflare source first, got %v", sources)
+	}
+	example := sources[1].GetProvider()
+	if !example.IsCustom() || example.String() != "Example Cloud" {
+		t.Errorf("Expected Example Cloud to be registered, got %s", example)
+	}
+
+	ranges, err := GetAllIPRanges(context.Background(), newFixtureFetcher(t, fixtures), sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[provider.Provider]int{}
+	for _, r := range ranges {
+		counts[r.Provider]++
+		switch r.Prefix.String() {
+		case "192.0.2.0/24":
+			if r.Region != "eu-1" {
+				t.Errorf("Expected the static range in eu-1, got %q", r.Region)
+			}
+		case "2a04:4e40::/32":
+			if r.Service != "CDN" {
+				t.Errorf("Expected the json range to be a CDN, got %q", r.Service)
+			}
+		}
+	}
+	// 1 static, 1 from the json and 2 from the bgp.tools table
+	if counts[provider.Cloudflare] != 3 || counts[example] != 4 {
+		t.Errorf("Expected 3 Cloudflare and 4 Example Cloud ranges, got %v", counts)
+	}
+}
+
+func TestDefaultCatalogSharesAsnRanges(t *testing.T) {
+	// AS63949 is listed by both Akamai and Linode, each must keep its own ranges
+	f := newFixtureFetcher(t, map[string]string{bgpToolsTableURL: "bgptools_table.txt"})
+	ranges, err := GetAllIPRanges(context.Background(), f, []IPRangeSource{sourceFor(t, provider.Akamai), sourceFor(t, provider.Linode)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	providers := map[string]map[provider.Provider]bool{}
+	for _, r := range ranges {
+		if providers[r.Prefix.String()] == nil {
+			providers[r.Prefix.String()] = map[provider.Provider]bool{}
+		}
+		providers[r.Prefix.String()][r.Provider] = true
+	}
+	if len(providers) != 2 {
+		t.Errorf("Expected the 2 ranges of AS63949, got %v", providers)
+	}
+	for prefix, p := range providers {
+		if !p[provider.Akamai] || !p[provider.Linode] {
+			t.Errorf("Expected %s from both Akamai and Linode, got %v", prefix, p)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Escape-Technologies/cloudfinder/internal/log"
+)
+
+const (
+	DefaultTimeout   = 45 * time.Second
+	DefaultUserAgent = "cloudfinder (+https://github.com/Escape-Technologies/cloudfinder)"
+	// bgp tools requires a contact in the user agent in case the program gets out of control
+	DefaultBgpToolsContact = "nohe@escape.tech"
+	bgpToolsHost           = "bgp.tools"
+)
+
+// RetryPolicy controls how failed requests are retried. Network errors, 429 and 5xx responses are retried,
+// other responses fail right away.
+type RetryPolicy struct {
+	// Total number of attempts, 1 disables retries
+	Attempts int
+	// Wait before the second attempt, doubled for each next one
+	Backoff time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{Attempts: 3, Backoff: time.Second}
+
+// Fetcher performs the http requests of the sources. All its requests are bound to the context they are made with,
+// cancelling it aborts the request and the pending retries.
+// A Fetcher is safe for concurrent use, its fields must not be modified once it is in use.
+type Fetcher struct {
+	Client    *http.Client
+	UserAgent string
+	Retry     RetryPolicy
+	Logger    *log.Scoped
+	// Cache of the bodies, nil disables caching. When set, GetBytes sends conditional requests and falls back to the
+	// cached body when the upstream is not modified or cannot be reached.
+	Cache *Cache
+	// Offline answers GetBytes from Cache only, without any request. Urls missing from the cache fail with ErrNotCached.
+	Offline bool
+	// ASN backends by name, used by the asn sources. Sources which do not pick a backend use DefaultASNBackend.
+	ASNBackends       map[string]ASNBackend
+	DefaultASNBackend string
+	// Contact appended to the user agent of the bgp.tools requests only, eg. an email. Empty sends the plain user agent.
+	BgpToolsContact string
+}
+
+// NewFetcher returns a fetcher with the default client, user agent and retry policy.
+// The default client uses the proxy from the environment (HTTPS_PROXY, NO_PROXY ...), see SetProxy.
+func NewFetcher(logger *log.Scoped) *Fetcher {
+	return &Fetcher{
+		Client: &http.Client{
+			Transport: http.DefaultTransport.(*http.Transport).Clone(), // nolint:forcetypeassert
+			Timeout:   DefaultTimeout,
+		},
+		UserAgent:       DefaultUserAgent,
+		BgpToolsContact: DefaultBgpToolsContact,
+		Retry:           DefaultRetryPolicy,
+		Logger:          logger,
+		ASNBackends: map[string]ASNBackend{
+			BackendBgpTools: &BgpToolsBackend{},
+		},
+		DefaultASNBackend: BackendBgpTools,
+	}
+}
+
+// SetProxy sends all the requests through proxy (eg. http://proxy.corp:3128), the client must use a *http.Transport.
+func (f *Fetcher) SetProxy(proxy *url.URL) error {
+	transport, ok := f.Client.Transport.(*http.Transport)
+	if !ok {
+		return errors.New("failed to set proxy: client transport is not a *http.Transport")
+	}
+	transport.Proxy = http.ProxyURL(proxy)
+	return nil
+}
+
+// errRetryable marks the failures worth retrying
+var errRetryable = errors.New("retryable")
+
+func (f *Fetcher) do(ctx context.Context, url string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if userAgent := f.userAgent(req.URL.Hostname()); userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+
+	res, err := f.Client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("%w: %w", errRetryable, err)
+	}
+	// Not modified is only expected for conditional requests
+	if res.StatusCode == http.StatusOK || (res.StatusCode == http.StatusNotModified && len(header) > 0) {
+		return res, nil
+	}
+
+	res.Body.Close()
+	err = fmt.Errorf("status code is %d", res.StatusCode)
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= http.StatusInternalServerError {
+		return nil, fmt.Errorf("%w: %w", errRetryable, err)
+	}
+	return nil, err
+}
+
+// userAgent returns the user agent of the requests to host, with the contact for bgp.tools
+func (f *Fetcher) userAgent(host string) string {
+	if f.BgpToolsContact == "" || (host != bgpToolsHost && !strings.HasSuffix(host, "."+bgpToolsHost)) {
+		return f.UserAgent
+	}
+	return strings.TrimSpace(f.UserAgent + " - " + f.BgpToolsContact)
+}
+
+// Get requests url, retrying as configured. Only 200 responses are returned, the caller must close the body.
+// Get does not use the cache, see GetBytes.
+func (f *Fetcher) Get(ctx context.Context, url string) (*http.Response, error) {
+	return f.get(ctx, url, nil)
+}
+
+// get sends the request with the given headers, 304 responses are returned for conditional requests
+func (f *Fetcher) get(ctx context.Context, url string, header http.Header) (*http.Response, error) {
+	attempts := max(f.Retry.Attempts, 1)
+	backoff := f.Retry.Backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		var res *http.Response
+		res, err = f.do(ctx, url, header)
+		if err == nil {
+			return res, nil
+		}
+		if !errors.Is(err, errRetryable) || attempt >= attempts {
+			break
+		}
+
+		f.Logger.Warning(fmt.Sprintf("Failed to get %s (attempt %d/%d), retrying in %s", url, attempt, attempts, backoff), err)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to get %s: %w", url, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return nil, fmt.Errorf("failed to get %s: %w", url, err)
+}
+
+// GetBytes returns the body of url, through the cache when set.
+func (f *Fetcher) GetBytes(ctx context.Context, url string) ([]byte, error) {
+	if f.Cache == nil {
+		body, _, err := f.getBody(ctx, url, nil)
+		return body, err
+	}
+
+	entry, cached, cacheErr := f.Cache.load(url)
+	if f.Offline {
+		if cacheErr != nil {
+			return nil, fmt.Errorf("failed to get %s offline: %w", url, cacheErr)
+		}
+		f.Logger.Debug("Using cached %s (offline, fetched at %s)", url, entry.FetchedAt.Format(time.RFC3339))
+		return cached, nil
+	}
+	if cacheErr != nil && !errors.Is(cacheErr, ErrNotCached) {
+		f.Logger.Warning("Ignoring cache", cacheErr)
+	}
+
+	header := http.Header{}
+	if cacheErr == nil {
+		if entry.ETag != "" {
+			header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+
+	body, validators, err := f.getBody(ctx, url, header)
+	switch {
+	case err != nil && cacheErr == nil && ctx.Err() == nil:
+		f.Logger.Warning(fmt.Sprintf("Using cached %s (fetched at %s)", url, entry.FetchedAt.Format(time.RFC3339)), err)
+		return cached, nil
+	case err != nil:
+		return nil, err
+	case body == nil:
+		f.Logger.Debug("Not modified, using cached %s", url)
+		return cached, nil
+	}
+
+	validators.URL = url
+	validators.FetchedAt = time.Now()
+	if err := f.Cache.store(&validators, body); err != nil {
+		f.Logger.Warning("Failed to update cache", err)
+	}
+	return body, nil
+}
+
+// getBody reads the body of url with its validators (ETag, Last-Modified). The body is nil for 304 responses.
+func (f *Fetcher) getBody(ctx context.Context, url string, header http.Header) ([]byte, cacheEntry, error) {
+	res, err := f.get(ctx, url, header)
+	if err != nil {
+		return nil, cacheEntry{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotModified {
+		return nil, cacheEntry{}, nil
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, cacheEntry{}, fmt.Errorf("failed to read body of %s: %w", url, err)
+	}
+	if body == nil {
+		body = []byte{}
+	}
+	return body, cacheEntry{ETag: res.Header.Get("ETag"), LastModified: res.Header.Get("Last-Modified")}, nil
+}
+
+// GetString returns the body of url.
+func (f *Fetcher) GetString(ctx context.Context, url string) (string, error) {
+	body, err := f.GetBytes(ctx, url)
+	return string(body), err
+}
@@ -0,0 +1,123 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Escape-Technologies/cloudfinder/internal/log"
+)
+
+func newTestFetcher() *Fetcher {
+	f := NewFetcher(log.Discard)
+	f.Retry = RetryPolicy{Attempts: 3, Backoff: time.Millisecond}
+	return f
+}
+
+func TestFetcherUserAgent(t *testing.T) {
+	f := newTestFetcher()
+	contact := DefaultUserAgent + " - " + DefaultBgpToolsContact
+	tests := map[string]string{
+		"bgp.tools":         contact,
+		"api.bgp.tools":     contact,
+		"notbgp.tools":      DefaultUserAgent,
+		"ip-ranges.aws.com": DefaultUserAgent,
+		"bgp.tools.example": DefaultUserAgent,
+	}
+	for host, expected := range tests {
+		if userAgent := f.userAgent(host); userAgent != expected {
+			t.Errorf("Expected user agent %q for %s, got %q", expected, host, userAgent)
+		}
+	}
+	f.BgpToolsContact = ""
+	if userAgent := f.userAgent("bgp.tools"); userAgent != DefaultUserAgent {
+		t.Errorf("Expected no contact, got %q", userAgent)
+	}
+}
+
+func TestFetcherRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		ok       bool
+		calls    int32
+	}{
+		{"ok", []int{http.StatusOK}, true, 1},
+		{"retry server errors", []int{http.StatusBadGateway, http.StatusTooManyRequests, http.StatusOK}, true, 3},
+		{"give up after attempts", []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError}, false, 3},
+		{"no retry on client errors", []int{http.StatusNotFound, http.StatusOK}, false, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := atomic.Int32{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				i := calls.Add(1) - 1
+				if r.Header.Get("User-Agent") != DefaultUserAgent {
+					t.Errorf("Expected user agent %q, got %q", DefaultUserAgent, r.Header.Get("User-Agent"))
+				}
+				w.WriteHeader(test.statuses[i])
+				_, _ = w.Write([]byte("body"))
+			}))
+			defer server.Close()
+
+			body, err := newTestFetcher().GetString(context.Background(), server.URL)
+			if (err == nil) != test.ok {
+				t.Errorf("Expected ok=%t, got %v", test.ok, err)
+			}
+			if test.ok && body != "body" {
+				t.Errorf("Expected body, got %q", body)
+			}
+			if calls.Load() != test.calls {
+				t.Errorf("Expected %d calls, got %d", test.calls, calls.Load())
+			}
+		})
+	}
+}
+
+func TestFetcherCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	f := NewFetcher(log.Discard)
+	f.Retry = RetryPolicy{Attempts: 5, Backoff: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := f.GetString(ctx, server.URL)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("Expected cancellation to abort the backoff")
+	}
+}
+
+func TestFetcherProxy(t *testing.T) {
+	proxied := atomic.Bool{}
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Store(r.Host == "ranges.invalid")
+		_, _ = w.Write([]byte(`{"ok": true}`))
+	}))
+	defer proxy.Close()
+
+	f := newTestFetcher()
+	proxyURL, _ := url.Parse(proxy.URL)
+	if err := f.SetProxy(proxyURL); err != nil {
+		t.Fatal(err)
+	}
+	body, err := f.GetString(context.Background(), "http://ranges.invalid/ranges.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != `{"ok": true}` || !proxied.Load() {
+		t.Errorf("Expected the request to go through the proxy")
+	}
+}
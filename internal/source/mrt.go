@@ -0,0 +1,267 @@
+package source
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// MRT constants, see RFC 6396 (MRT), RFC 8050 (add-path) and RFC 4271 (BGP path attributes)
+const (
+	mrtHeaderSize = 12
+	// Larger records are considered corrupted, RIB records are at most a few hundred kB
+	mrtMaxRecordSize = 16 << 20
+
+	mrtTableDumpV2           = 13
+	mrtRibIPv4Unicast        = 2
+	mrtRibIPv6Unicast        = 4
+	mrtRibIPv4UnicastAddPath = 8
+	mrtRibIPv6UnicastAddPath = 10
+
+	bgpAttrFlagExtendedLength = 0x10
+	bgpAttrASPath             = 2
+	bgpASSet                  = 1
+	bgpASSequence             = 2
+)
+
+var errMRTTruncated = errors.New("truncated record")
+
+// MRTBackend reads the origin AS of each prefix from local MRT TABLE_DUMP_V2 RIB dumps, as published by RouteViews
+// and RIPE RIS. Gzip (.gz) and bzip2 (.bz2) dumps are decompressed. The dumps are read once, on first use.
+type MRTBackend struct {
+	Paths []string
+	table asnTable
+}
+
+func NewMRTBackend(paths ...string) *MRTBackend {
+	return &MRTBackend{Paths: paths}
+}
+
+func (b *MRTBackend) Table(ctx context.Context, f *Fetcher) (map[string][]*IPRange, error) {
+	return b.table.get(func() (map[string][]*IPRange, error) {
+		origins := newMRTOrigins()
+		for _, path := range b.Paths {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			f.Logger.Info("Reading AS infos from %s", path)
+			if err := origins.readFile(path); err != nil {
+				return nil, err
+			}
+		}
+		f.Logger.Info("Got %d AS infos", len(origins.ranges))
+		return origins.ranges, nil
+	})
+}
+
+// mrtOrigins accumulates the ranges of each origin AS, without duplicates
+type mrtOrigins struct {
+	ranges map[string][]*IPRange
+	seen   map[string]map[netip.Prefix]bool
+}
+
+func newMRTOrigins() *mrtOrigins {
+	return &mrtOrigins{
+		ranges: make(map[string][]*IPRange),
+		seen:   make(map[string]map[netip.Prefix]bool),
+	}
+}
+
+func (o *mrtOrigins) add(asn string, prefix netip.Prefix) {
+	if o.seen[asn] == nil {
+		o.seen[asn] = make(map[netip.Prefix]bool)
+	}
+	if o.seen[asn][prefix] {
+		return
+	}
+	o.seen[asn][prefix] = true
+	o.ranges[asn] = append(o.ranges[asn], &IPRange{Prefix: prefix, Cat: GetIPCat(prefix.Addr())})
+}
+
+func (o *mrtOrigins) readFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to read mrt dump: %w", err)
+	}
+	defer file.Close()
+
+	var r io.Reader = bufio.NewReader(file)
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("failed to read mrt dump %s: %w", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	case strings.HasSuffix(path, ".bz2"):
+		r = bzip2.NewReader(r)
+	}
+
+	if err := o.read(r); err != nil {
+		return fmt.Errorf("failed to read mrt dump %s: %w", path, err)
+	}
+	return nil
+}
+
+// read parses the records of an uncompressed dump. Records other than the IPv4 and IPv6 unicast RIBs are skipped,
+// private networks too.
+func (o *mrtOrigins) read(r io.Reader) error {
+	header := make([]byte, mrtHeaderSize)
+	for record := 0; ; record++ {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("record %d: %w", record, errMRTTruncated)
+		}
+		be := binary.BigEndian
+		typ, subtype, length := be.Uint16(header[4:]), be.Uint16(header[6:]), be.Uint32(header[8:])
+		if length > mrtMaxRecordSize {
+			return fmt.Errorf("record %d: invalid length %d", record, length)
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return fmt.Errorf("record %d: %w", record, errMRTTruncated)
+		}
+		if typ != mrtTableDumpV2 {
+			continue
+		}
+
+		var err error
+		switch subtype {
+		case mrtRibIPv4Unicast:
+			err = o.readRib(body, CatIPv4, false)
+		case mrtRibIPv6Unicast:
+			err = o.readRib(body, CatIPv6, false)
+		case mrtRibIPv4UnicastAddPath:
+			err = o.readRib(body, CatIPv4, true)
+		case mrtRibIPv6UnicastAddPath:
+			err = o.readRib(body, CatIPv6, true)
+		}
+		if err != nil {
+			return fmt.Errorf("record %d: %w", record, err)
+		}
+	}
+}
+
+// readRib parses a RIB record: the prefix and one entry per peer, each with the AS path the peer sees
+func (o *mrtOrigins) readRib(b []byte, cat IPCat, addPath bool) error {
+	// sequence number u32 | prefix length u8 | prefix
+	if len(b) < 5 { // nolint:mnd
+		return errMRTTruncated
+	}
+	bits := int(b[4])
+	addrSize := 4
+	if cat == CatIPv6 {
+		addrSize = 16
+	}
+	if bits > addrSize*8 {
+		return fmt.Errorf("invalid prefix length %d", bits)
+	}
+	prefixSize := (bits + 7) / 8 // nolint:mnd
+	b = b[5:]
+	if len(b) < prefixSize+2 {
+		return errMRTTruncated
+	}
+	addr := make([]byte, addrSize)
+	copy(addr, b[:prefixSize])
+	ip, _ := netip.AddrFromSlice(addr)
+	prefix := netip.PrefixFrom(ip, bits).Masked()
+	entries := int(binary.BigEndian.Uint16(b[prefixSize:]))
+	b = b[prefixSize+2:]
+
+	for range entries {
+		// peer index u16 | originated time u32 | [path id u32] | attributes length u16 | attributes
+		skip := 6
+		if addPath {
+			skip += 4
+		}
+		if len(b) < skip+2 {
+			return errMRTTruncated
+		}
+		attrLen := int(binary.BigEndian.Uint16(b[skip:]))
+		b = b[skip+2:]
+		if len(b) < attrLen {
+			return errMRTTruncated
+		}
+		origins, err := bgpOrigins(b[:attrLen])
+		if err != nil {
+			return err
+		}
+		b = b[attrLen:]
+
+		if isPrivateNetwork(prefix) {
+			continue
+		}
+		for _, origin := range origins {
+			o.add(strconv.FormatUint(uint64(origin), 10), prefix)
+		}
+	}
+	return nil
+}
+
+// bgpOrigins returns the origin AS found in the AS_PATH of BGP path attributes: the last AS of the path, or every AS
+// of the set ending it. AS numbers are always 4 bytes in TABLE_DUMP_V2.
+func bgpOrigins(b []byte) ([]uint32, error) {
+	for len(b) > 0 {
+		if len(b) < 3 { // nolint:mnd
+			return nil, errMRTTruncated
+		}
+		flags, code := b[0], b[1]
+		var length int
+		if flags&bgpAttrFlagExtendedLength != 0 {
+			if len(b) < 4 { // nolint:mnd
+				return nil, errMRTTruncated
+			}
+			length, b = int(binary.BigEndian.Uint16(b[2:])), b[4:]
+		} else {
+			length, b = int(b[2]), b[3:]
+		}
+		if len(b) < length {
+			return nil, errMRTTruncated
+		}
+		if code == bgpAttrASPath {
+			return asPathOrigins(b[:length])
+		}
+		b = b[length:]
+	}
+	return nil, nil
+}
+
+func asPathOrigins(b []byte) ([]uint32, error) {
+	var origins []uint32
+	for len(b) > 0 {
+		if len(b) < 2 { // nolint:mnd
+			return nil, errMRTTruncated
+		}
+		segType, count := b[0], int(b[1])
+		b = b[2:]
+		if len(b) < count*4 {
+			return nil, errMRTTruncated
+		}
+		switch segType {
+		case bgpASSequence:
+			if count > 0 {
+				origins = []uint32{binary.BigEndian.Uint32(b[(count-1)*4:])}
+			}
+		case bgpASSet:
+			origins = make([]uint32, 0, count)
+			for i := range count {
+				origins = append(origins, binary.BigEndian.Uint32(b[i*4:]))
+			}
+		}
+		// Confederation segments only appear before the others, they are skipped
+		b = b[count*4:]
+	}
+	return origins, nil
+}
@@ -0,0 +1,190 @@
+package source
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/Escape-Technologies/cloudfinder/internal/log"
+	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
+)
+
+// Encoders of the MRT TABLE_DUMP_V2 format, the dumps of the tests are synthesized with them
+
+func mrtRecord(typ, subtype uint16, body []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, 1729000000) // nolint:mnd
+	b = binary.BigEndian.AppendUint16(b, typ)
+	b = binary.BigEndian.AppendUint16(b, subtype)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(body))) // nolint:gosec
+	return append(b, body...)
+}
+
+// ribRecord encodes a RIB record of cidr, with one entry per attributes
+func ribRecord(cidr string, addPath bool, attributes ...[]byte) []byte {
+	prefix := netip.MustParsePrefix(cidr)
+	b := binary.BigEndian.AppendUint32(nil, 0)
+	b = append(b, byte(prefix.Bits()))
+	b = append(b, prefix.Addr().AsSlice()[:(prefix.Bits()+7)/8]...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(attributes))) // nolint:gosec
+	for i, attrs := range attributes {
+		b = binary.BigEndian.AppendUint16(b, uint16(i))  // nolint:gosec
+		b = binary.BigEndian.AppendUint32(b, 1729000000) // nolint:mnd
+		if addPath {
+			b = binary.BigEndian.AppendUint32(b, uint32(i)) // nolint:gosec
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(len(attrs))) // nolint:gosec
+		b = append(b, attrs...)
+	}
+	return b
+}
+
+// bgpAttr encodes a path attribute, with an extended length when asked
+func bgpAttr(code byte, extended bool, value []byte) []byte {
+	if extended {
+		b := []byte{0x40 | bgpAttrFlagExtendedLength, code}
+		b = binary.BigEndian.AppendUint16(b, uint16(len(value))) // nolint:gosec
+		return append(b, value...)
+	}
+	return append([]byte{0x40, code, byte(len(value))}, value...)
+}
+
+func asSegment(segType byte, asns ...uint32) []byte {
+	b := []byte{segType, byte(len(asns))}
+	for _, asn := range asns {
+		b = binary.BigEndian.AppendUint32(b, asn)
+	}
+	return b
+}
+
+func asPath(segments ...[]byte) []byte {
+	return bgpAttr(bgpAttrASPath, false, slices.Concat(segments...))
+}
+
+var originIGP = bgpAttr(1, false, []byte{0})
+
+func testMRTDump() []byte {
+	return slices.Concat(
+		// Peer index table and BGP4MP records are skipped
+		mrtRecord(mrtTableDumpV2, 1, []byte{1, 2, 3, 4}),
+		mrtRecord(16, 4, []byte{0, 0}), // nolint:mnd
+		// Seen by two peers, through different paths
+		mrtRecord(mrtTableDumpV2, mrtRibIPv4Unicast, ribRecord("5.39.0.0/17", false,
+			slices.Concat(originIGP, asPath(asSegment(bgpASSequence, 3356, 16276))),
+			asPath(asSegment(bgpASSequence, 174, 1299, 16276)),
+		)),
+		mrtRecord(mrtTableDumpV2, mrtRibIPv6Unicast, ribRecord("2001:41d0::/32", false,
+			slices.Concat(originIGP, bgpAttr(bgpAttrASPath, true, asSegment(bgpASSequence, 6939, 16276))),
+		)),
+		mrtRecord(mrtTableDumpV2, mrtRibIPv4UnicastAddPath, ribRecord("62.210.0.0/16", true,
+			asPath(asSegment(bgpASSequence, 12876)),
+		)),
+		mrtRecord(mrtTableDumpV2, mrtRibIPv6UnicastAddPath, ribRecord("2001:bc8::/32", true,
+			asPath(asSegment(bgpASSequence, 12876)),
+		)),
+		// Private networks are skipped
+		mrtRecord(mrtTableDumpV2, mrtRibIPv4Unicast, ribRecord("10.0.0.0/8", false,
+			asPath(asSegment(bgpASSequence, 16276)),
+		)),
+		// Aggregated route, every AS of the set is an origin
+		mrtRecord(mrtTableDumpV2, mrtRibIPv4Unicast, ribRecord("192.0.2.0/24", false,
+			asPath(asSegment(bgpASSequence, 3356), asSegment(bgpASSet, 64500, 64501)),
+		)),
+		// Multicast ribs are skipped
+		mrtRecord(mrtTableDumpV2, 3, ribRecord("1.0.0.0/24", false, asPath(asSegment(bgpASSequence, 13335)))), // nolint:mnd
+	)
+}
+
+func TestParseMRT(t *testing.T) {
+	origins := newMRTOrigins()
+	if err := origins.read(bytes.NewReader(testMRTDump())); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]string{
+		"16276": {"5.39.0.0/17", "2001:41d0::/32"},
+		"12876": {"62.210.0.0/16", "2001:bc8::/32"},
+		"64500": {"192.0.2.0/24"},
+		"64501": {"192.0.2.0/24"},
+	}
+	if len(origins.ranges) != len(expected) {
+		t.Errorf("Expected %d ASNs, got %d", len(expected), len(origins.ranges))
+	}
+	for asn, prefixes := range expected {
+		got := make([]string, 0)
+		for _, r := range origins.ranges[asn] {
+			got = append(got, r.Prefix.String())
+			if r.Cat != GetIPCat(r.Prefix.Addr()) {
+				t.Errorf("Expected %s to be IPv%d", r.Prefix, GetIPCat(r.Prefix.Addr()))
+			}
+		}
+		if !slices.Equal(got, prefixes) {
+			t.Errorf("Expected AS%s to announce %v, got %v", asn, prefixes, got)
+		}
+	}
+}
+
+func TestParseMRTErrors(t *testing.T) {
+	rib := ribRecord("5.39.0.0/17", false, asPath(asSegment(bgpASSequence, 16276)))
+	tests := map[string][]byte{
+		"truncated header": mrtRecord(mrtTableDumpV2, mrtRibIPv4Unicast, rib)[:8],
+		"truncated body":   mrtRecord(mrtTableDumpV2, mrtRibIPv4Unicast, rib)[:20],
+		"truncated rib":    mrtRecord(mrtTableDumpV2, mrtRibIPv4Unicast, rib[:len(rib)-3]),
+		"truncated attribute": mrtRecord(mrtTableDumpV2, mrtRibIPv4Unicast, ribRecord("5.39.0.0/17", false,
+			[]byte{0x40, bgpAttrASPath, 10, bgpASSequence})),
+		"truncated as path": mrtRecord(mrtTableDumpV2, mrtRibIPv4Unicast, ribRecord("5.39.0.0/17", false,
+			bgpAttr(bgpAttrASPath, false, []byte{bgpASSequence, 2, 0, 0, 0, 1}))),
+		"invalid prefix length": mrtRecord(mrtTableDumpV2, mrtRibIPv4Unicast, []byte{0, 0, 0, 0, 33, 0, 0}),
+	}
+	for name, dump := range tests {
+		if err := newMRTOrigins().read(bytes.NewReader(dump)); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+}
+
+func TestMRTBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rib.20241015.0000.gz")
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	_, _ = gz.Write(testMRTDump())
+	_ = gz.Close()
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	catalog, err := ParseCatalog([]byte(`{"providers": [{"name": "Ovh", "sources": [{"kind": "asn", "asns": ["16276"], "backend": "mrt"}]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources, err := catalog.Sources()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without dumps, the mrt backend is not configured
+	f := NewFetcher(log.Discard)
+	if _, err := sources[0].GetIPRanges(context.Background(), f); err == nil {
+		t.Errorf("Expected an error without mrt backend")
+	}
+
+	f.ASNBackends[BackendMRT] = NewMRTBackend(path)
+	ranges, err := GetAllIPRanges(context.Background(), f, sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 2 || ranges[0].Provider != provider.Ovh || ranges[0].Prefix.String() != "5.39.0.0/17" {
+		t.Errorf("Expected the 2 Ovh ranges from the dump, got %v", ranges)
+	}
+
+	missing := NewMRTBackend(filepath.Join(t.TempDir(), "missing.bz2"))
+	if _, err := missing.Table(context.Background(), f); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected a not exist error, got %v", err)
+	}
+}
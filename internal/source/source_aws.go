@@ -1,7 +1,10 @@
 package source
 
 import (
-	"github.com/Escape-Technologies/cloudfinder/internal/log"
+	"context"
+	"encoding/json"
+	"fmt"
+
 	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
 )
 
@@ -9,35 +12,65 @@ type Aws struct{}
 
 const awsFileURL = "https://ip-ranges.amazonaws.com/ip-ranges.json"
 
+// The AMAZON service is a superset of all the others, prefer the specific service when a prefix is listed twice
+const awsGenericService = "AMAZON"
+
+type awsPrefix struct {
+	IPPrefix   string `json:"ip_prefix"`
+	IPv6Prefix string `json:"ipv6_prefix"`
+	Region     string `json:"region"`
+	Service    string `json:"service"`
+}
+
 type awsJSON struct {
-	Prefixes []struct {
-		IPPrefix string `json:"ip_prefix"`
-		Region   string `json:"region"`
-		Service  string `json:"service"`
-	} `json:"prefixes"`
+	Prefixes     []awsPrefix `json:"prefixes"`
+	IPv6Prefixes []awsPrefix `json:"ipv6_prefixes"`
 }
 
 func (a Aws) GetProvider() provider.Provider {
 	return provider.Aws
 }
 
-func (a Aws) GetIPRanges() []*IPRange {
-	log.Info("Fetching AWS ip ranges from %s", awsFileURL)
+func (a Aws) GetIPRanges(ctx context.Context, f *Fetcher) ([]*IPRange, error) {
+	f.Logger.Info("Fetching AWS ip ranges from %s", awsFileURL)
+
+	body, err := f.GetBytes(ctx, awsFileURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch AWS ip ranges: %w", err)
+	}
+	return parseAws(body)
+}
 
-	var awsJSON *awsJSON
-	err := LoadFileURLToJSON(awsFileURL, &awsJSON)
-	if err != nil { 
-		log.Fatal("Failed to load file url to json for AWS", err)
+// parseAws parses https://ip-ranges.amazonaws.com/ip-ranges.json
+func parseAws(body []byte) ([]*IPRange, error) {
+	var awsJSON awsJSON
+	if err := json.Unmarshal(body, &awsJSON); err != nil {
+		return nil, fmt.Errorf("failed to parse AWS ip ranges: %w", err)
 	}
 
 	ranges := make([]*IPRange, 0)
-	for _, prefix := range awsJSON.Prefixes {
-		network, cat := ParseCIDR(prefix.IPPrefix)
+	// IPv6 prefixes are listed apart, under ipv6_prefix
+	for _, prefix := range append(awsJSON.Prefixes, awsJSON.IPv6Prefixes...) {
+		cidr := prefix.IPPrefix
+		if cidr == "" {
+			cidr = prefix.IPv6Prefix
+		}
+		network, cat, err := ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AWS range: %w", err)
+		}
 		ranges = append(ranges, &IPRange{
-			Network: network,
+			Prefix:  network,
 			Cat:     cat,
+			Region:  prefix.Region,
+			Service: prefix.Service,
 		})
 	}
 
-	return ranges
+	return dedupeRanges(ranges, func(r *IPRange) int {
+		if r.Service == awsGenericService {
+			return 0
+		}
+		return 1
+	}), nil
 }
@@ -2,13 +2,12 @@ package source
 
 import (
 	"context"
-	"errors"
+	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
 	"regexp"
+	"slices"
+	"strings"
 
-	"github.com/Escape-Technologies/cloudfinder/internal/log"
 	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
 )
 
@@ -20,84 +19,111 @@ func (a Azure) GetProvider() provider.Provider {
 
 type azureJSON struct {
 	Values []struct {
+		// Service tag name, eg. AzureFrontDoor.Frontend or AzureCloud.westeurope
+		Name       string `json:"name"`
 		Properties struct {
+			Region          string   `json:"region"`
 			AddressPrefixes []string `json:"addressPrefixes"`
 		} `json:"properties"`
 	} `json:"values"`
 }
 
-/*
-- Gets https://azservicetags.azurewebsites.net
-- Extracts urls https://download.microsoft.com/download/**\/*.json from html
-*/
-func getAzureFileUrls() ([]string, error) {
-	url := "https://azservicetags.azurewebsites.net"
+// The same prefix is listed under several tags (eg. AzureCloud, AzureCloud.westeurope and Storage.WestEurope)
+const azureGenericService = "AzureCloud"
 
-	ctx, cancel := context.WithTimeout(context.Background(), defaultHTTPTimeout)
-	defer cancel()
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
-		return nil, err
+// azureServiceName strips the region suffix of a service tag: Storage.WestEurope -> Storage
+func azureServiceName(name string, region string) string {
+	if region == "" {
+		return name
 	}
-
-	file, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
+	service, suffix, found := strings.Cut(name, ".")
+	if found && strings.EqualFold(suffix, region) {
+		return service
 	}
-	if file == nil {
-		return nil, errors.New("response is nil")
+	return name
+}
+
+// Rank regional and specific tags over global and generic ones
+func azureRank(r *IPRange) int {
+	rank := 0
+	if r.Region != "" {
+		rank++
 	}
-	if file.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("status code is %d", file.StatusCode)
+	if r.Service != azureGenericService {
+		rank += 2
 	}
-	defer file.Body.Close()
+	return rank
+}
 
-	bodyText, err := io.ReadAll(file.Body)
-	if err != nil {
-		return nil, err
-	}
+const azureServiceTagsPageURL = "https://azservicetags.azurewebsites.net"
 
-	fileRegex := regexp.MustCompile(`"(https:\/\/download\.microsoft\.com\/download\/.*\.json)"`)
+var azureFileRegex = regexp.MustCompile(`"(https:\/\/download\.microsoft\.com\/download\/[^"]*\.json)"`)
 
-	matches := fileRegex.FindAllStringSubmatch(string(bodyText), -1)
+// parseAzureFileUrls extracts the service tags files urls (https://download.microsoft.com/download/**\/*.json)
+// from the html of https://azservicetags.azurewebsites.net, in order of first appearance
+func parseAzureFileUrls(page string) []string {
+	matches := azureFileRegex.FindAllStringSubmatch(page, -1)
 
 	urls := make([]string, 0)
 
 	for _, match := range matches {
-		urls = append(urls, match[1])
+		if !slices.Contains(urls, match[1]) {
+			urls = append(urls, match[1])
+		}
 	}
 
-	return urls, nil
+	return urls
 }
 
-func (a Azure) GetIPRanges() []*IPRange {
-	log.Info("Fetching Azure ip ranges from %s", awsFileURL)
-	prefixes := make([]string, 0)
-	urls, err := getAzureFileUrls()
+// parseAzureServiceTags parses a service tags file, ranges are not deduplicated
+func parseAzureServiceTags(body []byte) ([]*IPRange, error) {
+	var azureJSON azureJSON
+	if err := json.Unmarshal(body, &azureJSON); err != nil {
+		return nil, fmt.Errorf("failed to parse Azure service tags: %w", err)
+	}
+
+	ranges := make([]*IPRange, 0)
+	for _, value := range azureJSON.Values {
+		service := azureServiceName(value.Name, value.Properties.Region)
+		for _, prefix := range value.Properties.AddressPrefixes {
+			network, cat, err := ParseCIDR(prefix)
+			if err != nil {
+				return nil, fmt.Errorf("invalid Azure range: %w", err)
+			}
+			ranges = append(ranges, &IPRange{
+				Prefix:  network,
+				Cat:     cat,
+				Region:  value.Properties.Region,
+				Service: service,
+			})
+		}
+	}
+	return ranges, nil
+}
+
+func (a Azure) GetIPRanges(ctx context.Context, f *Fetcher) ([]*IPRange, error) {
+	f.Logger.Info("Fetching Azure ip ranges from %s", azureServiceTagsPageURL)
+	page, err := f.GetString(ctx, azureServiceTagsPageURL)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to get Azure file urls: %w", err)
 	}
-	for _, url := range urls {
-		var azureJSON *azureJSON
-		err := LoadFileURLToJSON(url, &azureJSON)
+
+	ranges := make([]*IPRange, 0)
+	for _, url := range parseAzureFileUrls(page) {
+		body, err := f.GetBytes(ctx, url)
 		if err != nil {
-			log.Warning("Failed to load file url to json for Azure", err)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			f.Logger.Warning("Failed to load file url for Azure", err)
 			continue
 		}
-		for _, value := range azureJSON.Values {
-			prefixes = append(prefixes, value.Properties.AddressPrefixes...)
+		fileRanges, err := parseAzureServiceTags(body)
+		if err != nil {
+			return nil, err
 		}
+		ranges = append(ranges, fileRanges...)
 	}
 
-	ranges := make([]*IPRange, 0)
-	for _, prefix := range prefixes {
-		network, cat := ParseCIDR(prefix)
-		ranges = append(ranges, &IPRange{
-			Network: network,
-			Cat:     cat,
-		})
-	}
-
-	return ranges
+	return dedupeRanges(ranges, azureRank), nil
 }
@@ -0,0 +1,95 @@
+package source
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
+)
+
+// RangesFileExt is the extension of the files written by pre-build -write-ranges, named after the provider (eg. aws.txt)
+const RangesFileExt = ".txt"
+
+// ReadRanges parses a ranges file: one cidr per line, optionally followed by the region and the service of the range,
+// separated by commas (eg. 3.5.140.0/22,ap-northeast-2,S3). Empty lines and lines starting with # are skipped.
+func ReadRanges(r io.Reader, p provider.Provider) ([]*IPRange, error) {
+	ranges := make([]*IPRange, 0)
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Split(text, ",")
+		if len(fields) > 3 { // nolint:mnd
+			return nil, fmt.Errorf("line %d: expected cidr[,region[,service]], got %q", line, text)
+		}
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		ipRange := &IPRange{
+			Prefix:   prefix.Masked(),
+			Cat:      GetIPCat(prefix.Addr()),
+			Provider: p,
+		}
+		if len(fields) > 1 {
+			ipRange.Region = strings.TrimSpace(fields[1])
+		}
+		if len(fields) > 2 { // nolint:mnd
+			ipRange.Service = strings.TrimSpace(fields[2])
+		}
+		ranges = append(ranges, ipRange)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ranges, nil
+}
+
+// ReadRangesFile reads a ranges file, the provider is taken from the file name (eg. ranges/aws.txt -> Aws).
+func ReadRangesFile(path string) ([]*IPRange, error) {
+	name := strings.TrimSuffix(filepath.Base(path), RangesFileExt)
+	p, err := provider.ParseProviderFold(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get provider for %s: %w", path, err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ranges, err := ReadRanges(f, p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ranges from %s: %w", path, err)
+	}
+	return ranges, nil
+}
+
+// WriteRanges writes ranges in the format of ReadRanges, the region and service are only written when known.
+func WriteRanges(w io.Writer, ranges []*IPRange) error {
+	bw := bufio.NewWriter(w)
+	for _, r := range ranges {
+		line := r.Prefix.String()
+		switch {
+		case r.Service != "":
+			line += "," + r.Region + "," + r.Service
+		case r.Region != "":
+			line += "," + r.Region
+		}
+		if _, err := bw.WriteString(line + "\n"); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
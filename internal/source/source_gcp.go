@@ -1,9 +1,11 @@
 package source
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 
-	"github.com/Escape-Technologies/cloudfinder/internal/log"
 	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
 )
 
@@ -18,6 +20,9 @@ type gcpJSON struct {
 	Prefixes []struct {
 		IPv4Prefix string `json:"ipv4Prefix"`
 		IPv6Prefix string `json:"ipv6Prefix"`
+		// Only set in cloud.json
+		Service string `json:"service"`
+		Scope   string `json:"scope"`
 	} `json:"prefixes"`
 }
 
@@ -25,35 +30,60 @@ func (a Gcp) GetProvider() provider.Provider {
 	return provider.Gcp
 }
 
-func (a Gcp) GetIPRanges() []*IPRange {
+func (a Gcp) GetIPRanges(ctx context.Context, f *Fetcher) ([]*IPRange, error) {
 	ranges := make([]*IPRange, 0)
 
 	for _, gcpFileURL := range gcpFileURLs {
-		log.Info("Fetching GCP ip ranges from %s", gcpFileURL)
+		f.Logger.Info("Fetching GCP ip ranges from %s", gcpFileURL)
 
-		var gcpJSON *gcpJSON
-		err := LoadFileURLToJSON(gcpFileURL, &gcpJSON)
+		body, err := f.GetBytes(ctx, gcpFileURL)
 		if err != nil {
-			log.Fatal("Failed to load file url to json for GCP", err)
+			return nil, fmt.Errorf("failed to fetch GCP ip ranges: %w", err)
 		}
+		fileRanges, err := parseGcp(body)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, fileRanges...)
+	}
 
-		for _, prefix := range gcpJSON.Prefixes {
-			cidr := prefix.IPv4Prefix
-			if cidr == "" {
-				cidr = prefix.IPv6Prefix
-			}
-
-			if cidr == "" {
-				log.Fatal("both ipv4 and ipv6 prefixes are empty", errors.New("must have IP"))
-			}
-
-			network, cat := ParseCIDR(cidr)
-			ranges = append(ranges, &IPRange{
-				Network: network,
-				Cat:     cat,
-			})
+	// goog.json lists every Google prefix without metadata, prefer the cloud.json entry when available
+	return dedupeRanges(ranges, func(r *IPRange) int {
+		if r.Service == "" {
+			return 0
 		}
+		return 1
+	}), nil
+}
+
+// parseGcp parses https://www.gstatic.com/ipranges/goog.json and cloud.json, ranges are not deduplicated
+func parseGcp(body []byte) ([]*IPRange, error) {
+	var gcpJSON gcpJSON
+	if err := json.Unmarshal(body, &gcpJSON); err != nil {
+		return nil, fmt.Errorf("failed to parse GCP ip ranges: %w", err)
 	}
 
-	return ranges
+	ranges := make([]*IPRange, 0)
+	for _, prefix := range gcpJSON.Prefixes {
+		cidr := prefix.IPv4Prefix
+		if cidr == "" {
+			cidr = prefix.IPv6Prefix
+		}
+
+		if cidr == "" {
+			return nil, errors.New("invalid GCP range: both ipv4 and ipv6 prefixes are empty")
+		}
+
+		network, cat, err := ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GCP range: %w", err)
+		}
+		ranges = append(ranges, &IPRange{
+			Prefix:  network,
+			Cat:     cat,
+			Region:  prefix.Scope,
+			Service: prefix.Service,
+		})
+	}
+	return ranges, nil
 }
@@ -1,9 +1,12 @@
 package source
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
 
-	"github.com/Escape-Technologies/cloudfinder/internal/log"
 	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
 )
 
@@ -16,16 +19,22 @@ type cat []*struct {
 	CidrBlocks []string `json:"cidr_blocks"`
 }
 
+type ibmNetworks struct {
+	Public        cat `json:"front_end_public_network"`
+	LoadBalancers cat `json:"load_balancers_ips"`
+	Service       cat `json:"service_network"`
+	FileBlock     cat `json:"file_block"`
+	Icons         cat `json:"icos"`
+	AdvMon        cat `json:"advmon"`
+	RheLs         cat `json:"rhe_ls"`
+	Ims           cat `json:"ims"`
+}
+
 type ibmJSON struct {
 	DataCenters []struct {
-		Public        cat `json:"front_end_public_network"`
-		LoadBalancers cat `json:"load_balancers_ips"`
-		Service       cat `json:"service_network"`
-		FileBlock     cat `json:"file_block"`
-		Icons         cat `json:"icos"`
-		AdvMon        cat `json:"advmon"`
-		RheLs         cat `json:"rhe_ls"`
-		Ims           cat `json:"ims"`
+		// Data center name, eg. dal10
+		Name string `json:"name"`
+		ibmNetworks
 	} `json:"data_centers"`
 }
 
@@ -33,41 +42,61 @@ func (a Ibm) GetProvider() provider.Provider {
 	return provider.Ibm
 }
 
-func (a Ibm) GetIPRanges() []*IPRange {
-	log.Info("Fetching ibm ranges")
+func (a Ibm) GetIPRanges(ctx context.Context, f *Fetcher) ([]*IPRange, error) {
+	f.Logger.Info("Fetching ibm ranges from %s", ibmFileURL)
 
-	ranges := make([]*IPRange, 0)
-	j := &ibmJSON{}
-	err := LoadFileURLToJSON(ibmFileURL, j)
+	body, err := f.GetBytes(ctx, ibmFileURL)
 	if err != nil {
-		log.Fatal("Failed to load json from url for IBM", err)
+		return nil, fmt.Errorf("failed to fetch IBM ip ranges: %w", err)
 	}
+	return parseIbm(body)
+}
 
+// parseIbm parses the data centers file of https://ibm.biz/cidr-calculator, private networks are skipped
+func parseIbm(body []byte) ([]*IPRange, error) {
+	j := &ibmJSON{}
+	if err := json.Unmarshal(body, j); err != nil {
+		return nil, fmt.Errorf("failed to parse IBM ip ranges: %w", err)
+	}
+
+	ranges := make([]*IPRange, 0)
 	// Much nesting lol
 	for _, d := range j.DataCenters {
 		// convert to map to iterate over fields easily
-		b, _ := json.Marshal(d)
+		b, err := json.Marshal(d.ibmNetworks)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read IBM networks: %w", err)
+		}
 		m := map[string]cat{}
 		err = json.Unmarshal(b, &m)
 		if err != nil {
-			log.Fatal("Failed to load json from url for IBM", err)
+			return nil, fmt.Errorf("failed to read IBM networks: %w", err)
 		}
 
-		for _, c := range m {
-			for _, cidrs := range c {
+		// The network kind (eg. front_end_public_network) is used as the service
+		for _, service := range slices.Sorted(maps.Keys(m)) {
+			for _, cidrs := range m[service] {
+				if cidrs == nil {
+					continue
+				}
 				for _, cidr := range cidrs.CidrBlocks {
-					network, cat := ParseCIDR(cidr)
+					network, cat, err := ParseCIDR(cidr)
+					if err != nil {
+						return nil, fmt.Errorf("invalid IBM range: %w", err)
+					}
 					if isPrivateNetwork(network) {
 						continue
 					}
 					ranges = append(ranges, &IPRange{
-						Network: network,
+						Prefix:  network,
 						Cat:     cat,
+						Region:  d.Name,
+						Service: service,
 					})
 				}
 			}
 		}
 	}
 
-	return ranges
+	return ranges, nil
 }
@@ -1,7 +1,11 @@
 package source
 
 import (
-	"github.com/Escape-Technologies/cloudfinder/internal/log"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
 	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
 )
 
@@ -11,8 +15,10 @@ const oracleFileURL = "https://docs.oracle.com/en-us/iaas/tools/public_ip_ranges
 
 type oracleJSON struct {
 	Regions []struct {
-		Cidrs []struct {
-			Cidr string `json:"cidr"`
+		Region string `json:"region"`
+		Cidrs  []struct {
+			Cidr string   `json:"cidr"`
+			Tags []string `json:"tags"`
 		} `json:"cidrs"`
 	} `json:"regions"`
 }
@@ -21,24 +27,39 @@ func (a Oracle) GetProvider() provider.Provider {
 	return provider.Oracle
 }
 
-func (a Oracle) GetIPRanges() []*IPRange {
-	log.Info("Using static Oracle ip ranges")
-	var oracleJSON oracleJSON
-	err := LoadFileURLToJSON(oracleFileURL, &oracleJSON)
+func (a Oracle) GetIPRanges(ctx context.Context, f *Fetcher) ([]*IPRange, error) {
+	f.Logger.Info("Fetching Oracle ip ranges from %s", oracleFileURL)
+
+	body, err := f.GetBytes(ctx, oracleFileURL)
 	if err != nil {
-		log.Fatal("Failed to load file url to json for Oracle", err)
+		return nil, fmt.Errorf("failed to fetch Oracle ip ranges: %w", err)
+	}
+	return parseOracle(body)
+}
+
+// parseOracle parses https://docs.oracle.com/en-us/iaas/tools/public_ip_ranges.json
+func parseOracle(body []byte) ([]*IPRange, error) {
+	var oracleJSON oracleJSON
+	if err := json.Unmarshal(body, &oracleJSON); err != nil {
+		return nil, fmt.Errorf("failed to parse Oracle ip ranges: %w", err)
 	}
 
 	ranges := make([]*IPRange, 0)
 	for _, region := range oracleJSON.Regions {
 		for _, cidrs := range region.Cidrs {
-			network, cat := ParseCIDR(cidrs.Cidr)
+			network, cat, err := ParseCIDR(cidrs.Cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid Oracle range: %w", err)
+			}
 			ranges = append(ranges, &IPRange{
-				Network: network,
-				Cat:     cat,
+				Prefix: network,
+				Cat:    cat,
+				Region: region.Region,
+				// Tags are the services using the range, eg. OCI, OSN, OBJECT_STORAGE
+				Service: strings.Join(cidrs.Tags, ","),
 			})
 		}
 	}
 
-	return ranges
+	return ranges, nil
 }
@@ -1,11 +1,13 @@
 package source
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"net"
+	"net/netip"
+	"slices"
 	"sync"
 
-	"github.com/Escape-Technologies/cloudfinder/internal/log"
 	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
 )
 
@@ -17,90 +19,111 @@ const (
 )
 
 type IPRange struct {
-	Network  *net.IPNet        `json:"n"`
+	// Always masked, eg. 8.8.4.0/24
+	Prefix   netip.Prefix      `json:"n"`
 	Cat      IPCat             `json:"c"`
 	Provider provider.Provider `json:"p"`
+	// Optional metadata from the upstream feed, empty when unknown.
+	Region  string `json:"r,omitempty"`
+	Service string `json:"s,omitempty"`
 }
 
 func (r *IPRange) String() string {
-	return r.Network.String() + fmt.Sprint(r.Cat) + r.Provider.String()
+	return r.Prefix.String() + fmt.Sprint(r.Cat) + r.Provider.String() + r.Region + r.Service
 }
 
 type IPRangeSource interface {
-	GetIPRanges() []*IPRange
+	// GetIPRanges fetches the ranges of the provider with f. Cancelling ctx aborts the pending requests.
+	GetIPRanges(ctx context.Context, f *Fetcher) ([]*IPRange, error)
 	GetProvider() provider.Provider
 }
 
-var AllSources = []IPRangeSource{
-	Alibaba{},
+// builtinSources are the providers with a dedicated parser
+var builtinSources = []IPRangeSource{
 	Aws{},
 	Azure{},
-	Cloudflare{},
-	Digitalocean{},
-	Fastly{},
 	Gcp{},
 	Ibm{},
-	Linode{},
 	Oracle{},
-	Ovh{},
-	Scaleway{},
-	Tencent{},
-	Ucloud{},
-	Vercel{},
-	Akamai{},
 }
 
-func GetAllIPRanges(sources []IPRangeSource) []*IPRange {
+// AllSources returns the providers with a dedicated parser, then the providers of the embedded catalog (catalog.json),
+// see NewSources.
+func AllSources() ([]IPRangeSource, error) {
+	catalog, err := DefaultCatalog()
+	if err != nil {
+		return nil, err
+	}
+	return NewSources(catalog)
+}
+
+// NewSources returns the providers with a dedicated parser, then the providers of catalog, registering the providers
+// missing from the enum. Fails if a provider has no source or several ones.
+func NewSources(catalog *Catalog) ([]IPRangeSource, error) {
+	catalogSources, err := catalog.Sources()
+	if err != nil {
+		return nil, err
+	}
+	sources := append(slices.Clone(builtinSources), catalogSources...)
+	if err := checkSources(sources); err != nil {
+		return nil, err
+	}
+	return sources, nil
+}
+
+// GetAllIPRanges fetches the ranges of all the sources concurrently.
+// Fails if any source fails, the error joins the errors of every failed source.
+func GetAllIPRanges(ctx context.Context, f *Fetcher, sources []IPRangeSource) ([]*IPRange, error) {
 	rangeLock := &sync.Mutex{}
 	wg := &sync.WaitGroup{}
 	ranges := make([]*IPRange, 0)
+	errs := make([]error, 0)
 	for _, source := range sources {
 		wg.Add(1)
 		go func(s IPRangeSource) {
+			defer wg.Done()
 			p := s.GetProvider()
-			sourceRanges := s.GetIPRanges()
-			addProviderToRanges(p, sourceRanges)
+			sourceRanges, err := s.GetIPRanges(ctx, f)
 			rangeLock.Lock()
+			defer rangeLock.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", p.String(), err))
+				return
+			}
+			addProviderToRanges(p, sourceRanges)
 			ranges = append(ranges, sourceRanges...)
-			rangeLock.Unlock()
-			wg.Done()
 		}(source)
 	}
 	wg.Wait()
-	return ranges
-}
-
-// Validate at compile time that we have exactly one range per provider
-func init() { //nolint:gochecknoinits
-	// Check that len(AllSources) = len(provider.ProviderMap) - 1 (Unknown)
-	if len(AllSources) != (len(provider.ProviderMap) - 1) {
-		err := fmt.Errorf("len(AllSources) = %d != len(provider.ProviderMap) - 1 = %d. Ensure the enum and sources are up to date", len(AllSources), (len(provider.ProviderMap) - 1))
-		log.Fatal("Error", err)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("failed to get ip ranges: %w", errors.Join(errs...))
 	}
+	return ranges, nil
+}
 
+// checkSources checks that there is exactly one source per provider, the catalog may add providers to the enum ones
+func checkSources(sources []IPRangeSource) error {
 	providers := make(map[provider.Provider]bool)
 
-	// Check that each source reagisters a different provider
-	for _, source := range AllSources {
+	// Check that each source registers a different provider
+	for _, source := range sources {
 		p := source.GetProvider()
-		if _, ok := providers[p]; ok {
-			err := fmt.Errorf("provider %s used more than once", p.String())
-			log.Fatal("Error", err)
+		if providers[p] {
+			return fmt.Errorf("invalid sources: provider %s used more than once", p.String())
 		}
 		providers[p] = true
 	}
 
 	// Check that each provider has a source
-	for p := range provider.ProviderMap {
+	for _, p := range provider.Builtins() {
 		if p == provider.Unknown {
 			continue
 		}
-
-		if _, ok := providers[p]; !ok {
-			err := fmt.Errorf("provider %s has no source", p.String())
-			log.Fatal("Error", err)
+		if !providers[p] {
+			return fmt.Errorf("invalid sources: provider %s has no source", p.String())
 		}
 	}
+	return nil
 }
 
 func addProviderToRanges(p provider.Provider, ranges []*IPRange) {
@@ -0,0 +1,308 @@
+package source
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Escape-Technologies/cloudfinder/internal/log"
+	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
+)
+
+// fixtures maps the upstream urls to the recorded files in testdata
+var fixtures = map[string]string{
+	awsFileURL:              "aws_ip-ranges.json",
+	azureServiceTagsPageURL: "azure_servicetags_page.html",
+	"https://download.microsoft.com/download/7/1/D/71D86715-5596-4529-9B13-DA13A5DE5B63/ServiceTags_Public_20241014.json":          "azure_ServiceTags_Public.json",
+	"https://download.microsoft.com/download/6/4/D/64DB03BF-895B-4173-A8B1-BA4AD5D4DF22/ServiceTags_AzureGovernment_20241014.json": "azure_ServiceTags_AzureGovernment.json",
+	gcpFileURLs[0]: "gcp_goog.json",
+	gcpFileURLs[1]: "gcp_cloud.json",
+	oracleFileURL:  "oracle_public_ip_ranges.json",
+	ibmFileURL:     "ibm_datacenters.json",
+	"https://digitalocean.com/geo/google.csv": "digitalocean_google.csv",
+	"https://www.cloudflare.com/ips-v4/#":     "cloudflare_ips-v4.txt",
+	"https://www.cloudflare.com/ips-v6/#":     "cloudflare_ips-v6.txt",
+	"https://api.fastly.com/public-ip-list":   "fastly_public-ip-list.json",
+	bgpToolsTableURL:                          "bgptools_table.txt",
+}
+
+// Header holding the upstream url of a request sent to the fixture server
+const fixtureURLHeader = "X-Fixture-Url"
+
+// fixtureTransport sends every request to the fixture server
+type fixtureTransport struct {
+	server *url.URL
+	next   http.RoundTripper
+}
+
+func (t fixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set(fixtureURLHeader, req.URL.String())
+	req.URL.Scheme = t.server.Scheme
+	req.URL.Host = t.server.Host
+	return t.next.RoundTrip(req)
+}
+
+// fixtureKey normalizes an url the way it is sent, eg. without empty fragments
+func fixtureKey(t *testing.T, rawURL string) string {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.String()
+}
+
+// newFixtureFetcher returns a fetcher answering from the fixtures, urls missing from files are 404
+func newFixtureFetcher(t *testing.T, files map[string]string) *Fetcher {
+	t.Helper()
+	byURL := make(map[string]string, len(files))
+	for u, file := range files {
+		byURL[fixtureKey(t, u)] = file
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, ok := byURL[r.Header.Get(fixtureURLHeader)]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join("testdata", file))
+	}))
+	t.Cleanup(server.Close)
+
+	serverURL, _ := url.Parse(server.URL)
+	f := NewFetcher(log.Discard)
+	f.Retry = RetryPolicy{Attempts: 1}
+	f.Client.Transport = fixtureTransport{server: serverURL, next: server.Client().Transport}
+	return f
+}
+
+// sourceFor returns the source of p in AllSources, nil if there is none
+func sourceFor(t *testing.T, p provider.Provider) IPRangeSource {
+	t.Helper()
+	sources, err := AllSources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range sources {
+		if s.GetProvider() == p {
+			return s
+		}
+	}
+	return nil
+}
+
+func TestSourcesFromFixtures(t *testing.T) {
+	type expectedRange struct{ region, service string }
+	tests := []struct {
+		source IPRangeSource
+		count  int
+		ranges map[string]expectedRange
+	}{
+		{Aws{}, 4, map[string]expectedRange{
+			"3.5.140.0/22":            {"ap-northeast-2", "S3"},
+			"13.34.37.64/27":          {"ap-southeast-4", "AMAZON"},
+			"2600:1f14:fff:f800::/53": {"us-west-2", "ROUTE53_HEALTHCHECKS"},
+		}},
+		{Azure{}, 6, map[string]expectedRange{
+			"4.144.0.0/15":    {"", "AzureCloud"},
+			"20.38.64.0/22":   {"westeurope", "Storage"},
+			"13.107.246.0/24": {"", "AzureFrontDoor.Frontend"},
+			"13.72.48.0/20":   {"usgovvirginia", "AzureCloud"},
+		}},
+		{Gcp{}, 4, map[string]expectedRange{
+			"8.8.4.0/24":          {"", ""},
+			"34.1.208.0/20":       {"africa-south1", "Google Cloud"},
+			"2600:1900:8000::/44": {"us-east4", "Google Cloud"},
+		}},
+		{Oracle{}, 3, map[string]expectedRange{
+			"130.61.0.0/16":  {"eu-frankfurt-1", "OCI"},
+			"134.70.32.0/22": {"eu-frankfurt-1", "OSN,OBJECT_STORAGE"},
+		}},
+		{Ibm{}, 5, map[string]expectedRange{
+			"159.8.64.0/19":       {"ams03", "front_end_public_network"},
+			"2a03:8180:1000::/40": {"ams03", "front_end_public_network"},
+			"161.26.0.0/16":       {"ams03", "rhe_ls"},
+			"169.46.0.0/17":       {"dal10", "front_end_public_network"},
+		}},
+		// The line with a missing field is skipped
+		{sourceFor(t, provider.Digitalocean), 5, map[string]expectedRange{
+			"5.101.96.0/21":         {"", ""},
+			"2604:a880:400:d0::/60": {"", ""},
+		}},
+		{sourceFor(t, provider.Cloudflare), 5, map[string]expectedRange{
+			"104.16.0.0/13":  {"", ""},
+			"2606:4700::/32": {"", ""},
+		}},
+		{sourceFor(t, provider.Fastly), 3, map[string]expectedRange{
+			"151.101.0.0/16": {"", ""},
+			"2a04:4e40::/32": {"", ""},
+		}},
+		// From the bgp.tools table, private networks are skipped
+		{sourceFor(t, provider.Ovh), 3, map[string]expectedRange{
+			"5.39.0.0/17":    {"", ""},
+			"2001:41d0::/32": {"", ""},
+		}},
+		{sourceFor(t, provider.Scaleway), 2, map[string]expectedRange{
+			"62.210.0.0/16": {"", ""},
+		}},
+	}
+
+	f := newFixtureFetcher(t, fixtures)
+	for _, test := range tests {
+		t.Run(test.source.GetProvider().String(), func(t *testing.T) {
+			ranges, err := test.source.GetIPRanges(context.Background(), f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ranges) != test.count {
+				t.Errorf("Expected %d ranges, got %d", test.count, len(ranges))
+			}
+			byPrefix := make(map[string]*IPRange, len(ranges))
+			for _, r := range ranges {
+				if _, ok := byPrefix[r.Prefix.String()]; ok {
+					t.Errorf("Expected %s once", r.Prefix)
+				}
+				byPrefix[r.Prefix.String()] = r
+				if r.Cat != GetIPCat(r.Prefix.Addr()) {
+					t.Errorf("Expected %s to be IPv%d, got IPv%d", r.Prefix, GetIPCat(r.Prefix.Addr()), r.Cat)
+				}
+			}
+			for prefix, expected := range test.ranges {
+				r, ok := byPrefix[prefix]
+				if !ok {
+					t.Errorf("Expected %s to be found", prefix)
+					continue
+				}
+				if r.Region != expected.region || r.Service != expected.service {
+					t.Errorf("Expected %s in %q %q, got %q %q", prefix, expected.region, expected.service, r.Region, r.Service)
+				}
+			}
+		})
+	}
+}
+
+func TestAllSourcesOffline(t *testing.T) {
+	sources, err := AllSources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges, err := GetAllIPRanges(context.Background(), newFixtureFetcher(t, fixtures), sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) == 0 {
+		t.Errorf("Expected ranges")
+	}
+}
+
+func TestSourcesUpstreamErrors(t *testing.T) {
+	// Missing upstream files are 404s
+	f := newFixtureFetcher(t, map[string]string{azureServiceTagsPageURL: "azure_servicetags_page.html"})
+	for _, s := range []IPRangeSource{Aws{}, Gcp{}, Oracle{}, Ibm{}, sourceFor(t, provider.Digitalocean), sourceFor(t, provider.Cloudflare), sourceFor(t, provider.Fastly), sourceFor(t, provider.Ovh)} {
+		if _, err := s.GetIPRanges(context.Background(), f); err == nil {
+			t.Errorf("Expected an error for %s", s.GetProvider())
+		}
+	}
+
+	// Azure skips the service tags files it cannot get
+	ranges, err := Azure{}.GetIPRanges(context.Background(), f)
+	if err != nil || len(ranges) != 0 {
+		t.Errorf("Expected no Azure ranges and no error, got %d ranges and %v", len(ranges), err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := map[string]func() error{
+		"aws json": func() error { _, err := parseAws([]byte(`{"prefixes": [`)); return err },
+		"aws cidr": func() error {
+			_, err := parseAws([]byte(`{"prefixes": [{"ip_prefix": "3.5.140.0"}]}`))
+			return err
+		},
+		"azure cidr": func() error {
+			_, err := parseAzureServiceTags([]byte(`{"values": [{"properties": {"addressPrefixes": ["nope"]}}]}`))
+			return err
+		},
+		"gcp empty prefix": func() error { _, err := parseGcp([]byte(`{"prefixes": [{}]}`)); return err },
+		"oracle json":      func() error { _, err := parseOracle([]byte(`[]`)); return err },
+		"ibm cidr": func() error {
+			_, err := parseIbm([]byte(`{"data_centers": [{"name": "x", "ims": [{"cidr_blocks": ["x"]}]}]}`))
+			return err
+		},
+		"csv cidr": func() error {
+			_, err := (&CatalogSource{Kind: KindCSV, Fields: 5}).parse([]byte("nope,NL,NL-NH,Amsterdam,1098 XH\n"))
+			return err
+		},
+		"text cidr": func() error {
+			_, err := (&CatalogSource{Kind: KindText}).parse([]byte("104.16.0.0/13\n<html>\n"))
+			return err
+		},
+		"json cidr": func() error {
+			_, err := (&CatalogSource{Kind: KindJSON, Paths: []string{"addresses"}}).parse([]byte(`{"addresses": ["x"]}`))
+			return err
+		},
+	}
+	for name, parse := range tests {
+		if err := parse(); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+}
+
+func TestParseAzureFileUrls(t *testing.T) {
+	// Several urls on a single line, and duplicates
+	urls := parseAzureFileUrls(`<a href="https://download.microsoft.com/download/a/ServiceTags_Public.json">x</a>` +
+		`"https://download.microsoft.com/download/b/ServiceTags_China.json" https://example.com/x.json` +
+		`"https://download.microsoft.com/download/a/ServiceTags_Public.json"`)
+	if len(urls) != 2 || urls[1] != "https://download.microsoft.com/download/b/ServiceTags_China.json" {
+		t.Errorf("Expected the 2 download urls, got %v", urls)
+	}
+}
+
+func TestRangesRoundTrip(t *testing.T) {
+	ranges := []*IPRange{
+		{Prefix: netip.MustParsePrefix("3.5.140.0/22"), Cat: CatIPv4, Provider: provider.Aws, Region: "ap-northeast-2", Service: "S3"},
+		{Prefix: netip.MustParsePrefix("13.34.0.0/16"), Cat: CatIPv4, Provider: provider.Aws, Region: "eu-west-3"},
+		{Prefix: netip.MustParsePrefix("15.230.0.0/16"), Cat: CatIPv4, Provider: provider.Aws, Service: "EC2"},
+		{Prefix: netip.MustParsePrefix("2600:1f00::/24"), Cat: CatIPv6, Provider: provider.Aws},
+	}
+	b := strings.Builder{}
+	if err := WriteRanges(&b, ranges); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadRanges(strings.NewReader(b.String()), provider.Aws)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != len(ranges) {
+		t.Fatalf("Expected %d ranges, got %d", len(ranges), len(read))
+	}
+	for i, r := range read {
+		if *r != *ranges[i] {
+			t.Errorf("Expected %+v, got %+v", *ranges[i], *r)
+		}
+	}
+
+	if _, err := ReadRanges(strings.NewReader("1.2.3.0/24,a,b,c\n"), provider.Aws); err == nil {
+		t.Errorf("Expected an error for extra fields")
+	}
+}
+
+func TestCheckSources(t *testing.T) {
+	sources, err := AllSources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSources(append(sources, Aws{})); err == nil {
+		t.Errorf("Expected an error for a provider with two sources")
+	}
+	if err := checkSources(sources[1:]); err == nil {
+		t.Errorf("Expected an error for a provider without source")
+	}
+}
@@ -1,226 +1,60 @@
 package source
 
 import (
-	"bufio"
-	"context"
-	"encoding/json"
-	"errors"
-	"fmt"
-	"io"
-	"math"
-	"net"
-	"net/http"
-	"strings"
-	"sync"
-	"time"
-
-	"github.com/Escape-Technologies/cloudfinder/internal/log"
+	"net/netip"
 )
 
-const defaultHTTPTimeout = 30 * time.Second
-
-func GetIPCat(ip net.IP) IPCat {
-	if ip.To4() != nil {
+func GetIPCat(addr netip.Addr) IPCat {
+	if addr.Unmap().Is4() {
 		return CatIPv4
 	}
 	return CatIPv6
 }
 
-// ParseIpRange parses an ip range string into start, end, and ip type
-// eg. ParseIpRange(8.8.4.0/24) -> (ip.Net, IP_TYPE_IPV4)
-func ParseCIDR(cidr string) (*net.IPNet, IPCat) {
-	ip, network, err := net.ParseCIDR(cidr)
-	if err != nil {
-		panic(err)
-	}
-
-	return network, GetIPCat(ip)
-}
-
-func FileURLToString(url string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultHTTPTimeout)
-	defer cancel()
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
-		return "", err
-	}
-
-	file, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", err
-	}
-	if file == nil {
-		return "", errors.New("response is nil")
-	}
-	if file.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("status code is %d", file.StatusCode)
-	}
-	defer file.Body.Close()
-
-	bodyText, err := io.ReadAll(file.Body)
-	if err != nil {
-		return "", err
-	}
-
-	return string(bodyText), nil
-}
-
-func LoadFileURLToJSON(url string, to interface{}) error {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultHTTPTimeout)
-	defer cancel()
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
-		return err
-	}
-
-	file, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
-	if file == nil {
-		return errors.New("response is nil")
-	}
-	if file.StatusCode != http.StatusOK {
-		return fmt.Errorf("status code is %d", file.StatusCode)
-	}
-	defer file.Body.Close()
-
-	return json.NewDecoder(file.Body).Decode(&to)
-}
-
-func LoadTextURLToRange(url string) ([]string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultHTTPTimeout)
-	defer cancel()
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-
-	resp, err := http.DefaultClient.Do(req)
+// ParseCIDR parses a cidr string into its masked prefix and ip type
+// eg. ParseCIDR(8.8.4.1/24) -> (8.8.4.0/24, CatIPv4, nil)
+func ParseCIDR(cidr string) (netip.Prefix, IPCat, error) {
+	prefix, err := netip.ParsePrefix(cidr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get %s", url)
+		return netip.Prefix{}, 0, err
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		err := fmt.Errorf("failed to read body %s", url)
-		panic(err)
-	}
-	return strings.Split(string(body), "\n"), nil
+	return prefix.Masked(), GetIPCat(prefix.Addr()), nil
 }
 
-func isPrivateNetwork(n *net.IPNet) bool {
-	// Source: https://en.wikipedia.org/wiki/Private_network
-	for _, cidr := range []string{
-		"10.0.0.0/8",
-		"172.16.0.0/12",
-		"192.168.0.0/16",
-		"100.64.0.0/10",
-		"fc00::/7",
-	} {
-		_, pn, err := net.ParseCIDR(cidr)
-		if err != nil {
-			panic(err)
+// dedupeRanges keeps a single range per network. Among duplicates, the one with the highest rank wins,
+// ties keep the first seen. Order of first occurrence is preserved.
+func dedupeRanges(ranges []*IPRange, rank func(r *IPRange) int) []*IPRange {
+	index := make(map[netip.Prefix]int, len(ranges))
+	deduped := make([]*IPRange, 0, len(ranges))
+	for _, r := range ranges {
+		i, ok := index[r.Prefix]
+		if !ok {
+			index[r.Prefix] = len(deduped)
+			deduped = append(deduped, r)
+			continue
 		}
-
-		if pn.Contains(n.IP) {
-			return true
+		if rank(r) > rank(deduped[i]) {
+			deduped[i] = r
 		}
 	}
-	return false
+	return deduped
 }
 
-/// BGP TOOLS
-
-// ensure we fill the map only once
-var bgpToolsMutex = sync.Mutex{}
-
-// ASN -> CIDR
-var bgpToolsAsnRanges map[string][]*IPRange
-var bgpToolsTableURL = "https://bgp.tools/table.txt"
-
-func requestWithRetry(req *http.Request, maxRetries int) (*http.Response, error) {
-	TIMEOUT := 45 // to avoid linter cries
-	httpClient := &http.Client{
-		Timeout: time.Duration(TIMEOUT) * time.Second,
-	}
-
-	var globalErr error
-	for i := range maxRetries { // retry 3 times
-		// exponential backoff to avoid overwhelming the server
-		two := 2.0 // linter cries a lot
-		time.Sleep(time.Duration(math.Pow(two, float64(i))) * time.Second)
-
-		res, err := httpClient.Do(req)
-		globalErr = err
-
-		if err == nil && res.StatusCode == http.StatusOK {
-			return res, nil
-		}
-
-		if res != nil && res.StatusCode != http.StatusOK {
-			err = fmt.Errorf("status code: %d", res.StatusCode)
-			log.Error("Error getting bgp tools table", err)
-		} else if err != nil {
-			log.Error("Error getting bgp tools table", err)
-		}
-	}
-	return nil, globalErr
+// Source: https://en.wikipedia.org/wiki/Private_network
+var privateNetworks = []netip.Prefix{
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("fc00::/7"),
 }
 
-// Fetches https://bgp.tools/table.txt and parses it into the ASN -> CIDR map
-func getRangesForAsn(asn string) []*IPRange {
-	bgpToolsMutex.Lock()
-	if bgpToolsAsnRanges == nil {
-		bgpToolsAsnRanges = make(map[string][]*IPRange)
-
-		// Fill the map
-		log.Info("Fetching AS infos from %s", bgpToolsTableURL)
-		req, _ := http.NewRequest(http.MethodGet, bgpToolsTableURL, nil) // nolint: noctx
-		// bgp tools requires a descriptive user agent in case the program gets out of control
-		req.Header.Add("user-agent", "https://github.com/Escape-Technologies/cloudfinder - nohe@escape.tech")
-
-		const MaxRetries = 3
-		res, err := requestWithRetry(req, MaxRetries)
-		if err != nil {
-			log.Fatal("Error getting bgp tools table", err)
-		}
-
-		scanner := bufio.NewScanner(res.Body)
-		// Read lines
-		for scanner.Scan() {
-			line := scanner.Text()
-			// Line is formatted as "<CIDR> <ASN>"
-			x := strings.Split(line, " ")
-			if len(x) != 2 { // nolint: mnd
-				continue
-			}
-			cidr, asn := x[0], x[1]
-
-			n, cat := ParseCIDR(cidr)
-			// Skip private networks
-			if isPrivateNetwork(n) {
-				continue
-			}
-			// Fill map
-			if _, ok := bgpToolsAsnRanges[asn]; !ok {
-				bgpToolsAsnRanges[asn] = make([]*IPRange, 0)
-			}
-			bgpToolsAsnRanges[asn] = append(bgpToolsAsnRanges[asn], &IPRange{
-				Network: n,
-				Cat:     cat,
-			})
+func isPrivateNetwork(n netip.Prefix) bool {
+	for _, pn := range privateNetworks {
+		if pn.Contains(n.Addr()) {
+			return true
 		}
-		res.Body.Close()
-		log.Info("Got %d AS infos", len(bgpToolsAsnRanges))
-	}
-	bgpToolsMutex.Unlock()
-	if val, ok := bgpToolsAsnRanges[asn]; ok {
-		return val
 	}
-	return []*IPRange{}
+	return false
 }
@@ -0,0 +1,113 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Escape-Technologies/cloudfinder/internal/log"
+	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
+)
+
+func TestDedupeRanges(t *testing.T) {
+	ranges := []*IPRange{}
+	for _, r := range []struct{ cidr, service string }{
+		{"3.5.140.0/22", "AMAZON"},
+		{"3.5.140.0/22", "S3"},
+		{"13.34.0.0/16", "AMAZON"},
+		{"3.5.140.0/22", "EC2"},
+	} {
+		network, cat, err := ParseCIDR(r.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ranges = append(ranges, &IPRange{Prefix: network, Cat: cat, Service: r.service})
+	}
+
+	deduped := dedupeRanges(ranges, func(r *IPRange) int {
+		if r.Service == awsGenericService {
+			return 0
+		}
+		return 1
+	})
+
+	if len(deduped) != 2 {
+		t.Fatalf("Expected 2 ranges, got %d", len(deduped))
+	}
+	if deduped[0].Prefix.String() != "3.5.140.0/22" || deduped[0].Service != "S3" {
+		t.Errorf("Expected first specific service to win, got %s %s", deduped[0].Prefix, deduped[0].Service)
+	}
+	if deduped[1].Prefix.String() != "13.34.0.0/16" || deduped[1].Service != "AMAZON" {
+		t.Errorf("Expected generic service to be kept when alone, got %s %s", deduped[1].Prefix, deduped[1].Service)
+	}
+}
+
+func TestAzureServiceName(t *testing.T) {
+	tests := []struct{ name, region, expected string }{
+		{"AzureFrontDoor.Frontend", "", "AzureFrontDoor.Frontend"},
+		{"AzureCloud.westeurope", "westeurope", "AzureCloud"},
+		{"Storage.WestEurope", "westeurope", "Storage"},
+		{"AzureCloud", "", "AzureCloud"},
+	}
+	for _, test := range tests {
+		if got := azureServiceName(test.name, test.region); got != test.expected {
+			t.Errorf("azureServiceName(%s, %s) = %s, expected %s", test.name, test.region, got, test.expected)
+		}
+	}
+}
+
+func TestParseCIDR(t *testing.T) {
+	tests := []struct {
+		cidr     string
+		expected string
+		cat      IPCat
+		valid    bool
+	}{
+		{"8.8.4.1/24", "8.8.4.0/24", CatIPv4, true},
+		{"2001:db8::1/32", "2001:db8::/32", CatIPv6, true},
+		{"8.8.4.1", "", 0, false},
+		{"not a cidr", "", 0, false},
+		{"", "", 0, false},
+	}
+	for _, test := range tests {
+		prefix, cat, err := ParseCIDR(test.cidr)
+		if (err == nil) != test.valid {
+			t.Errorf("Expected valid=%t for %q, got %v", test.valid, test.cidr, err)
+			continue
+		}
+		if test.valid && (prefix.String() != test.expected || cat != test.cat) {
+			t.Errorf("Expected %s (IPv%d) for %q, got %s (IPv%d)", test.expected, test.cat, test.cidr, prefix, cat)
+		}
+	}
+}
+
+type fakeSource struct {
+	p      provider.Provider
+	ranges []*IPRange
+	err    error
+}
+
+func (f fakeSource) GetProvider() provider.Provider { return f.p }
+
+func (f fakeSource) GetIPRanges(_ context.Context, _ *Fetcher) ([]*IPRange, error) {
+	return f.ranges, f.err
+}
+
+func TestGetAllIPRanges(t *testing.T) {
+	network, cat, _ := ParseCIDR("192.0.2.0/24")
+	ok := fakeSource{p: provider.Aws, ranges: []*IPRange{{Prefix: network, Cat: cat}}}
+
+	ranges, err := GetAllIPRanges(context.Background(), NewFetcher(log.Discard), []IPRangeSource{ok})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 1 || ranges[0].Provider != provider.Aws {
+		t.Errorf("Expected 1 Aws range, got %+v", ranges)
+	}
+
+	errFeed := errors.New("corrupted feed")
+	_, err = GetAllIPRanges(context.Background(), NewFetcher(log.Discard), []IPRangeSource{ok, fakeSource{p: provider.Gcp, err: errFeed}})
+	if !errors.Is(err, errFeed) {
+		t.Errorf("Expected %v, got %v", errFeed, err)
+	}
+}
@@ -0,0 +1,16 @@
+package static
+
+import (
+	_ "embed"
+	"strings"
+)
+
+// Written by pre-build along with the trees, it only changes when the ranges do
+
+//go:embed hash.txt
+var hash string
+
+// Hash returns the hash of the ranges of the embedded trees.
+func Hash() string {
+	return strings.TrimSpace(hash)
+}
@@ -1,29 +1,36 @@
 package static
 
 import (
-	"bytes"
 	_ "embed"
+	"fmt"
 
 	"github.com/Escape-Technologies/cloudfinder/internal/source"
 	"github.com/Escape-Technologies/cloudfinder/internal/tree"
 )
 
-//go:embed ipv4.gob
+// Trees are stored in the flat format, read in place from the binary: loading does not decode them.
+
+//go:embed ipv4.bin
 var ipv4Content []byte
 
-//go:embed ipv6.gob
+//go:embed ipv6.bin
 var ipv6Content []byte
 
-func loadTreeFromBytes(b []byte, cat source.IPCat) tree.Tree {
-	reader := bytes.NewReader(b)
-	// log.Info("Loading IPv%d tree.", cat)
-	return tree.NewTreeFrom(reader, cat)
+func loadTreeFromBytes(b []byte, cat source.IPCat) (*tree.Flat, error) {
+	t, err := tree.NewFlatFrom(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load embedded tree: %w", err)
+	}
+	if t.Header().Cat != cat {
+		return nil, fmt.Errorf("failed to load embedded tree: %w", tree.ErrInvalidFlat)
+	}
+	return t, nil
 }
 
-func LoadIPv4Tree() tree.Tree {
+func LoadIPv4Tree() (*tree.Flat, error) {
 	return loadTreeFromBytes(ipv4Content, source.CatIPv4)
 }
 
-func LoadIPv6Tree() tree.Tree {
+func LoadIPv6Tree() (*tree.Flat, error) {
 	return loadTreeFromBytes(ipv6Content, source.CatIPv6)
 }
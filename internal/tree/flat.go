@@ -0,0 +1,514 @@
+package tree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/netip"
+	"sort"
+	"time"
+
+	"github.com/Escape-Technologies/cloudfinder/internal/source"
+	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
+)
+
+// The flat format stores a tree as an array of prefixes sorted by (address, prefix length), each entry pointing to
+// its closest enclosing prefix. It is read in place: loading only validates the data and decodes the small string
+// and metadata tables, lookups binary search the entries directly in the underlying bytes.
+//
+// Layout (integers are little endian, addresses big endian):
+//
+//	header:    magic "CFTR" | version u16 | cat u8 | reserved u8 | build date i64 (unix) | data hash [32]byte
+//	counts:    strings u32 | providers u32 | metas u32 | entries u32
+//	strings:   (length u16 | bytes)*
+//	providers: (name u32 | category u32)*                  name and category index the strings
+//	metas:     (provider u16 | region u32 | service u32)*  provider indexes the providers, the others the strings
+//	entries:   (address [4|16]byte | prefix length u8 | parent u32 | meta u32)*
+//
+// Providers are stored by name: the values of the providers missing from the enum depend on the order they were
+// registered in (see provider.Register), which differs between pre-build and the processes loading the trees.
+// Loading registers the providers unknown to the process, with their category. The category of the built-in providers
+// is not stored, and known providers keep theirs.
+//
+// For the exact same network from several providers, overlaps are stored first and the main range last, so that
+// following the parents from the main range lists the overlaps before the enclosing prefixes.
+const (
+	FlatVersion = 2
+
+	flatMagic        = "CFTR"
+	flatHeaderSize   = 4 + 2 + 1 + 1 + 8 + HashSize + 4 + 4 + 4 + 4
+	flatProviderSize = 4 + 4
+	flatMetaSize     = 2 + 4 + 4
+	flatNoParent     = math.MaxUint32
+
+	// HashSize is the size of the data hash stored in the header (sha256).
+	HashSize = 32
+)
+
+var ErrInvalidFlat = errors.New("invalid flat tree")
+
+// Header describes the data stored in a flat tree.
+type Header struct {
+	Version   uint16
+	Cat       source.IPCat
+	BuildDate time.Time
+	// Hash of the ranges the tree was built from.
+	Hash [HashSize]byte
+}
+
+type flatMeta struct {
+	provider provider.Provider
+	region   string
+	service  string
+}
+
+// Flat is a read only tree backed by a byte slice in the flat format.
+type Flat struct {
+	header    Header
+	addrSize  int
+	entrySize int
+	count     int
+	entries   []byte
+	metas     []flatMeta
+}
+
+// Check interface
+var _ Reader = &Flat{}
+
+func addrSizeFor(cat source.IPCat) (int, error) {
+	switch cat {
+	case source.CatIPv4:
+		return net.IPv4len, nil
+	case source.CatIPv6:
+		return net.IPv6len, nil
+	default:
+		return 0, fmt.Errorf("%w: unknown ip category %d", ErrInvalidFlat, cat)
+	}
+}
+
+// NewFlatFrom loads a flat tree from b. b is used in place and must not be modified afterwards.
+func NewFlatFrom(b []byte) (*Flat, error) {
+	if len(b) < flatHeaderSize || string(b[:4]) != flatMagic {
+		return nil, fmt.Errorf("%w: bad magic", ErrInvalidFlat)
+	}
+
+	le := binary.LittleEndian
+	f := &Flat{}
+	f.header.Version = le.Uint16(b[4:])
+	if f.header.Version != FlatVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidFlat, f.header.Version)
+	}
+	f.header.Cat = source.IPCat(b[6])
+	f.header.BuildDate = time.Unix(int64(le.Uint64(b[8:])), 0).UTC() // nolint:gosec
+	copy(f.header.Hash[:], b[16:16+HashSize])
+
+	var err error
+	f.addrSize, err = addrSizeFor(f.header.Cat)
+	if err != nil {
+		return nil, err
+	}
+	f.entrySize = f.addrSize + 1 + 4 + 4
+
+	counts := b[16+HashSize:]
+	stringCount := int(le.Uint32(counts))
+	providerCount := int(le.Uint32(counts[4:]))
+	metaCount := int(le.Uint32(counts[8:]))
+	f.count = int(le.Uint32(counts[12:]))
+	b = b[flatHeaderSize:]
+
+	strs := make([]string, 0, stringCount)
+	for range stringCount {
+		if len(b) < 2 { // nolint:mnd
+			return nil, fmt.Errorf("%w: truncated strings", ErrInvalidFlat)
+		}
+		l := int(le.Uint16(b))
+		if len(b) < 2+l {
+			return nil, fmt.Errorf("%w: truncated strings", ErrInvalidFlat)
+		}
+		strs = append(strs, string(b[2:2+l]))
+		b = b[2+l:]
+	}
+
+	if len(b) < providerCount*flatProviderSize {
+		return nil, fmt.Errorf("%w: truncated providers", ErrInvalidFlat)
+	}
+	providers := make([]flatProvider, 0, providerCount)
+	for i := range providerCount {
+		p := b[i*flatProviderSize:]
+		name, category := int(le.Uint32(p)), int(le.Uint32(p[4:]))
+		if name >= len(strs) || category >= len(strs) || strs[name] == "" {
+			return nil, fmt.Errorf("%w: provider %d references an unknown string", ErrInvalidFlat, i)
+		}
+		c, err := provider.ParseCategory(strs[category])
+		if err != nil {
+			return nil, fmt.Errorf("%w: provider %s: %w", ErrInvalidFlat, strs[name], err)
+		}
+		providers = append(providers, flatProvider{name: strs[name], category: c})
+	}
+	b = b[providerCount*flatProviderSize:]
+
+	if len(b) < metaCount*flatMetaSize {
+		return nil, fmt.Errorf("%w: truncated metadata", ErrInvalidFlat)
+	}
+	metaProviders := make([]int, 0, metaCount)
+	f.metas = make([]flatMeta, 0, metaCount)
+	for i := range metaCount {
+		m := b[i*flatMetaSize:]
+		p, region, service := int(le.Uint16(m)), int(le.Uint32(m[2:])), int(le.Uint32(m[6:]))
+		if p >= len(providers) {
+			return nil, fmt.Errorf("%w: metadata %d references an unknown provider", ErrInvalidFlat, i)
+		}
+		if region >= len(strs) || service >= len(strs) {
+			return nil, fmt.Errorf("%w: metadata %d references an unknown string", ErrInvalidFlat, i)
+		}
+		metaProviders = append(metaProviders, p)
+		f.metas = append(f.metas, flatMeta{region: strs[region], service: strs[service]})
+	}
+	b = b[metaCount*flatMetaSize:]
+
+	if len(b) != f.count*f.entrySize {
+		return nil, fmt.Errorf("%w: expected %d entries", ErrInvalidFlat, f.count)
+	}
+	f.entries = b
+
+	// Validate references once, so that lookups never go out of bounds or loop
+	for i := range f.count {
+		parent := f.parent(i)
+		if parent != flatNoParent && parent >= uint32(i) { // nolint:gosec
+			return nil, fmt.Errorf("%w: entry %d has an invalid parent", ErrInvalidFlat, i)
+		}
+		if int(f.prefixLen(i)) > f.addrSize*8 {
+			return nil, fmt.Errorf("%w: entry %d has an invalid prefix length", ErrInvalidFlat, i)
+		}
+		if int(f.meta(i)) >= len(f.metas) {
+			return nil, fmt.Errorf("%w: entry %d references an unknown metadata", ErrInvalidFlat, i)
+		}
+	}
+
+	// Only register providers once the whole tree is valid
+	values := make([]provider.Provider, 0, len(providers))
+	for _, p := range providers {
+		value, err := p.register()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidFlat, err)
+		}
+		values = append(values, value)
+	}
+	for i, p := range metaProviders {
+		f.metas[i].provider = values[p]
+	}
+
+	return f, nil
+}
+
+// flatProvider is a provider as stored in a flat tree
+type flatProvider struct {
+	name     string
+	category provider.Category
+}
+
+// register returns the provider named p.name, registered with its category when the process does not know it yet
+func (p flatProvider) register() (provider.Provider, error) {
+	if value, err := provider.ParseProviderFold(p.name); err == nil {
+		return value, nil
+	}
+	value, err := provider.Register(p.name)
+	if err != nil {
+		return value, err
+	}
+	if p.category != provider.CategoryUnknown {
+		provider.SetCategory(value, p.category)
+	}
+	return value, nil
+}
+
+func (f *Flat) Header() Header {
+	return f.header
+}
+
+func (f *Flat) entry(i int) []byte {
+	return f.entries[i*f.entrySize : (i+1)*f.entrySize]
+}
+
+func (f *Flat) addr(i int) []byte {
+	return f.entry(i)[:f.addrSize]
+}
+
+func (f *Flat) prefixLen(i int) uint8 {
+	return f.entry(i)[f.addrSize]
+}
+
+func (f *Flat) parent(i int) uint32 {
+	return binary.LittleEndian.Uint32(f.entry(i)[f.addrSize+1:])
+}
+
+func (f *Flat) meta(i int) uint32 {
+	return binary.LittleEndian.Uint32(f.entry(i)[f.addrSize+5:])
+}
+
+// contains checks that the first prefixLen bits of ip and the entry address are equal
+func (f *Flat) contains(i int, ip []byte) bool {
+	return hasPrefix(f.addr(i), int(f.prefixLen(i)), ip)
+}
+
+// hasPrefix checks that the first bits of ip and addr are equal
+func hasPrefix(addr []byte, bits int, ip []byte) bool {
+	full := bits / 8 // nolint:mnd
+	if !bytes.Equal(addr[:full], ip[:full]) {
+		return false
+	}
+	rest := bits % 8 // nolint:mnd
+	if rest == 0 {
+		return true
+	}
+	mask := byte(0xff) << (8 - rest) // nolint:mnd
+	return addr[full]&mask == ip[full]&mask
+}
+
+// find returns the index of the most specific entry containing addr, -1 if none.
+// The last entry starting before addr is either the match or nested in it, so the match is found by following parents.
+func (f *Flat) find(addr netip.Addr) int {
+	addr, ok := accepts(f.header.Cat, addr)
+	if !ok {
+		return -1
+	}
+	ip16 := addr.As16()
+	ip := ip16[net.IPv6len-f.addrSize:]
+	next := sort.Search(f.count, func(i int) bool {
+		return bytes.Compare(f.addr(i), ip) > 0
+	})
+	for i := next - 1; i >= 0; i = f.parentIndex(i) {
+		if f.contains(i, ip) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *Flat) parentIndex(i int) int {
+	p := f.parent(i)
+	if p == flatNoParent {
+		return -1
+	}
+	return int(p)
+}
+
+func (f *Flat) ipRange(i int) source.IPRange {
+	var addr netip.Addr
+	if f.addrSize == net.IPv4len {
+		addr = netip.AddrFrom4([net.IPv4len]byte(f.addr(i)))
+	} else {
+		addr = netip.AddrFrom16([net.IPv6len]byte(f.addr(i)))
+	}
+	m := f.metas[f.meta(i)]
+	return source.IPRange{
+		Prefix:   netip.PrefixFrom(addr, int(f.prefixLen(i))),
+		Cat:      f.header.Cat,
+		Provider: m.provider,
+		Region:   m.region,
+		Service:  m.service,
+	}
+}
+
+func (f *Flat) FindIPRange(addr netip.Addr) (source.IPRange, bool) {
+	i := f.find(addr)
+	if i < 0 {
+		return source.IPRange{}, false
+	}
+	return f.ipRange(i), true
+}
+
+func (f *Flat) FindAllIPRanges(addr netip.Addr) []source.IPRange {
+	ranges := []source.IPRange{}
+	for i := f.find(addr); i >= 0; i = f.parentIndex(i) {
+		ranges = append(ranges, f.ipRange(i))
+	}
+	return ranges
+}
+
+func (f *Flat) FindIPRangesWithin(prefix netip.Prefix) []source.IPRange {
+	ranges := []source.IPRange{}
+	prefix, ok := acceptsPrefix(f.header.Cat, prefix)
+	if !ok {
+		return ranges
+	}
+	ip16 := prefix.Addr().As16()
+	ip := ip16[net.IPv6len-f.addrSize:]
+	bits := prefix.Bits()
+	// Entries inside the prefix are contiguous, from its first address
+	first := sort.Search(f.count, func(i int) bool {
+		return bytes.Compare(f.addr(i), ip) >= 0
+	})
+	for i := first; i < f.count && hasPrefix(ip, bits, f.addr(i)); i++ {
+		if int(f.prefixLen(i)) <= bits {
+			continue
+		}
+		// Overlaps of a network come before its main range
+		if i+1 < f.count && f.prefixLen(i+1) == f.prefixLen(i) && bytes.Equal(f.addr(i+1), f.addr(i)) {
+			continue
+		}
+		ranges = append(ranges, f.ipRange(i))
+	}
+	return ranges
+}
+
+func (f *Flat) GetAllRanges() []*source.IPRange {
+	ranges := make([]*source.IPRange, 0, f.count)
+	for i := range f.count {
+		r := f.ipRange(i)
+		ranges = append(ranges, &r)
+	}
+	return ranges
+}
+
+// flatWriter accumulates the tables while walking the tree
+type flatWriter struct {
+	strings     []string
+	stringIDs   map[string]uint32
+	providers   []provider.Provider
+	providerIDs map[provider.Provider]uint16
+	metas       []flatMeta
+	metaIDs     map[flatMeta]uint32
+	entries     bytes.Buffer
+	count       uint32
+	addrSize    int
+}
+
+func (w *flatWriter) stringID(s string) uint32 {
+	if id, ok := w.stringIDs[s]; ok {
+		return id
+	}
+	id := uint32(len(w.strings)) // nolint:gosec
+	w.strings = append(w.strings, s)
+	w.stringIDs[s] = id
+	return id
+}
+
+// providerName returns the name and the category to store for p, the category of the built-in providers is not stored
+func providerName(p provider.Provider) (string, provider.Category) {
+	if p.IsCustom() {
+		return p.String(), p.Category()
+	}
+	return p.String(), provider.CategoryUnknown
+}
+
+func (w *flatWriter) providerID(p provider.Provider) uint16 {
+	if id, ok := w.providerIDs[p]; ok {
+		return id
+	}
+	name, category := providerName(p)
+	w.stringID(name)
+	w.stringID(string(category))
+	id := uint16(len(w.providers)) // nolint:gosec
+	w.providers = append(w.providers, p)
+	w.providerIDs[p] = id
+	return id
+}
+
+func (w *flatWriter) metaID(r *source.IPRange) uint32 {
+	m := flatMeta{provider: r.Provider, region: r.Region, service: r.Service}
+	if id, ok := w.metaIDs[m]; ok {
+		return id
+	}
+	w.providerID(m.provider)
+	w.stringID(m.region)
+	w.stringID(m.service)
+	id := uint32(len(w.metas)) // nolint:gosec
+	w.metas = append(w.metas, m)
+	w.metaIDs[m] = id
+	return id
+}
+
+func (w *flatWriter) addEntry(r *source.IPRange, parent uint32) uint32 {
+	ip := r.Prefix.Addr().As16()
+
+	le := binary.LittleEndian
+	w.entries.Write(ip[net.IPv6len-w.addrSize:])
+	w.entries.WriteByte(byte(r.Prefix.Bits()))
+	w.entries.Write(le.AppendUint32(nil, parent))
+	w.entries.Write(le.AppendUint32(nil, w.metaID(r)))
+
+	id := w.count
+	w.count++
+	return id
+}
+
+// walk visits the nodes in pre-order, 0 before 1, which yields the entries sorted by (address, prefix length)
+func (w *flatWriter) walk(n *node, parent uint32) {
+	if n == nil {
+		return
+	}
+	if n.IPRange != nil {
+		for i := len(n.Overlaps) - 1; i >= 0; i-- {
+			parent = w.addEntry(n.Overlaps[i], parent)
+		}
+		parent = w.addEntry(n.IPRange, parent)
+	}
+	w.walk(n.Nodes[0], parent)
+	w.walk(n.Nodes[1], parent)
+}
+
+// WriteFlat serializes t to w in the flat format. hash identifies the source data.
+func WriteFlat(w io.Writer, t Tree, hash [HashSize]byte, buildDate time.Time) error {
+	tr, ok := t.(*tree)
+	if !ok {
+		return fmt.Errorf("unsupported tree type %T", t)
+	}
+	addrSize, err := addrSizeFor(tr.Cat)
+	if err != nil {
+		return err
+	}
+
+	fw := &flatWriter{
+		stringIDs:   map[string]uint32{},
+		providerIDs: map[provider.Provider]uint16{},
+		metaIDs:     map[flatMeta]uint32{},
+		addrSize:    addrSize,
+	}
+	fw.walk(tr.Root, flatNoParent)
+	if len(fw.providers) > math.MaxUint16 {
+		return fmt.Errorf("too many providers: %d", len(fw.providers))
+	}
+
+	le := binary.LittleEndian
+	out := bufio.NewWriter(w)
+	header := make([]byte, 0, flatHeaderSize)
+	header = append(header, flatMagic...)
+	header = le.AppendUint16(header, FlatVersion)
+	header = append(header, byte(tr.Cat), 0)
+	header = le.AppendUint64(header, uint64(buildDate.Unix())) // nolint:gosec
+	header = append(header, hash[:]...)
+	header = le.AppendUint32(header, uint32(len(fw.strings)))   // nolint:gosec
+	header = le.AppendUint32(header, uint32(len(fw.providers))) // nolint:gosec
+	header = le.AppendUint32(header, uint32(len(fw.metas)))     // nolint:gosec
+	header = le.AppendUint32(header, fw.count)
+	_, _ = out.Write(header)
+
+	for _, s := range fw.strings {
+		if len(s) > math.MaxUint16 {
+			return fmt.Errorf("string too long: %d bytes", len(s))
+		}
+		_, _ = out.Write(le.AppendUint16(nil, uint16(len(s)))) // nolint:gosec
+		_, _ = out.WriteString(s)
+	}
+	for _, p := range fw.providers {
+		name, category := providerName(p)
+		entry := le.AppendUint32(nil, fw.stringIDs[name])
+		entry = le.AppendUint32(entry, fw.stringIDs[string(category)])
+		_, _ = out.Write(entry)
+	}
+	for _, m := range fw.metas {
+		meta := le.AppendUint16(nil, fw.providerIDs[m.provider])
+		meta = le.AppendUint32(meta, fw.stringIDs[m.region])
+		meta = le.AppendUint32(meta, fw.stringIDs[m.service])
+		_, _ = out.Write(meta)
+	}
+	_, _ = out.Write(fw.entries.Bytes())
+
+	return out.Flush()
+}
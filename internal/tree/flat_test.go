@@ -0,0 +1,300 @@
+package tree
+
+import (
+	"bytes"
+	"errors"
+	"math/rand/v2"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/Escape-Technologies/cloudfinder/internal/source"
+	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
+)
+
+var testHash = [HashSize]byte{0xde, 0xad, 0xbe, 0xef}
+
+func writeFlatHelper(t testing.TB, tr Tree) []byte {
+	t.Helper()
+	buffer := bytes.NewBuffer([]byte{})
+	err := WriteFlat(buffer, tr, testHash, time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatalf("Failed to write flat tree: %s", err)
+	}
+	return buffer.Bytes()
+}
+
+// randomTree builds a tree with n random prefixes from random providers, with some nested and duplicated networks
+func randomTree(n int, cat source.IPCat) Tree {
+	rnd := rand.New(rand.NewPCG(42, uint64(cat))) // nolint:gosec
+	t := NewIPv4Tree()
+	minLen, maxLen := 8, 32
+	if cat == source.CatIPv6 {
+		t = NewIPv6Tree()
+		minLen, maxLen = 16, 64
+	}
+	services := []string{"", "EC2", "CLOUDFRONT", "S3"}
+	providers := []provider.Provider{provider.Aws, provider.Gcp, provider.Vercel, provider.Cloudflare}
+
+	for range n {
+		prefixLen := minLen + rnd.IntN(maxLen-minLen+1)
+		prefix, _ := randomAddr(rnd, cat).Prefix(prefixLen)
+		r := &source.IPRange{
+			Prefix:   prefix,
+			Cat:      cat,
+			Provider: providers[rnd.IntN(len(providers))],
+			Service:  services[rnd.IntN(len(services))],
+		}
+		t.Add(r)
+	}
+	return t
+}
+
+func randomAddr(rnd *rand.Rand, cat source.IPCat) netip.Addr {
+	var ip [16]byte
+	for i := range ip {
+		ip[i] = byte(rnd.UintN(256))
+	}
+	if cat == source.CatIPv4 {
+		return netip.AddrFrom4([4]byte(ip[:4]))
+	}
+	return netip.AddrFrom16(ip)
+}
+
+func rangesEqual(a, b []source.IPRange) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Prefix != b[i].Prefix || a[i].Provider != b[i].Provider || a[i].Service != b[i].Service {
+			return false
+		}
+	}
+	return true
+}
+
+func TestFlatMatchesTree(t *testing.T) {
+	for _, cat := range []source.IPCat{source.CatIPv4, source.CatIPv6} {
+		tr := randomTree(5000, cat)
+		// Nested and overlapping ranges
+		for _, c := range []string{"76.0.0.0/8", "76.76.21.0/24", "76.76.21.128/25", "2600::/16", "2600:1f18::/32"} {
+			network, rCat := mustParseCIDR(c)
+			if rCat == cat {
+				tr.Add(&source.IPRange{Prefix: network, Cat: rCat, Provider: provider.Aws})
+				tr.Add(&source.IPRange{Prefix: network, Cat: rCat, Provider: provider.Vercel})
+			}
+		}
+
+		flat, err := NewFlatFrom(writeFlatHelper(t, tr))
+		if err != nil {
+			t.Fatalf("Failed to load flat tree: %s", err)
+		}
+
+		if len(flat.GetAllRanges()) != len(tr.GetAllRanges()) {
+			t.Errorf("IPv%d: expected %d ranges, got %d", cat, len(tr.GetAllRanges()), len(flat.GetAllRanges()))
+		}
+
+		rnd := rand.New(rand.NewPCG(1, 2)) // nolint:gosec
+		ips := []netip.Addr{
+			netip.MustParseAddr("76.76.21.200"),
+			netip.MustParseAddr("::ffff:76.76.21.200"),
+			netip.MustParseAddr("2600:1f18::1"),
+			netip.MustParseAddr("0.0.0.0"),
+			netip.MustParseAddr("::"),
+			{},
+		}
+		for range 20000 {
+			ips = append(ips, randomAddr(rnd, cat))
+		}
+
+		for _, ip := range ips {
+			expected := tr.FindAllIPRanges(ip)
+			got := flat.FindAllIPRanges(ip)
+			if !rangesEqual(expected, got) {
+				t.Fatalf("IPv%d %s: expected %+v, got %+v", cat, ip, expected, got)
+			}
+			one, ok := flat.FindIPRange(ip)
+			if ok != (len(expected) != 0) || (ok && !rangesEqual([]source.IPRange{one}, expected[:1])) {
+				t.Fatalf("IPv%d %s: FindIPRange expected %+v, got %+v", cat, ip, expected, one)
+			}
+		}
+
+		for i, ip := range ips[:500] {
+			prefix, _ := ip.Prefix(i % (ip.BitLen() + 1))
+			expected := tr.FindIPRangesWithin(prefix)
+			if got := flat.FindIPRangesWithin(prefix); !rangesEqual(expected, got) {
+				t.Fatalf("IPv%d %s: FindIPRangesWithin expected %+v, got %+v", cat, prefix, expected, got)
+			}
+		}
+	}
+}
+
+func TestFlatHeader(t *testing.T) {
+	flat, err := NewFlatFrom(writeFlatHelper(t, makeTreeHelper()))
+	if err != nil {
+		t.Fatalf("Failed to load flat tree: %s", err)
+	}
+
+	h := flat.Header()
+	if h.Version != FlatVersion || h.Cat != source.CatIPv4 || h.Hash != testHash {
+		t.Errorf("Unexpected header %+v", h)
+	}
+	if !h.BuildDate.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("Unexpected build date %s", h.BuildDate)
+	}
+	if _, ok := flat.FindIPRange(netip.MustParseAddr("3.5.141.2")); !ok {
+		t.Errorf("Expected range for 3.5.141.2")
+	}
+}
+
+func TestFlatInvalid(t *testing.T) {
+	valid := writeFlatHelper(t, makeTreeHelper())
+
+	wrongVersion := bytes.Clone(valid)
+	wrongVersion[4] = 42
+
+	tests := map[string][]byte{
+		"empty":         {},
+		"bad magic":     append([]byte("XXXX"), valid[4:]...),
+		"wrong version": wrongVersion,
+		"truncated":     valid[:len(valid)-3],
+		"trailing data": append(bytes.Clone(valid), 0),
+	}
+	for name, b := range tests {
+		if _, err := NewFlatFrom(b); !errors.Is(err, ErrInvalidFlat) {
+			t.Errorf("[%s] Expected ErrInvalidFlat, got %v", name, err)
+		}
+	}
+}
+
+func TestFindDoesNotAllocate(t *testing.T) {
+	for _, cat := range []source.IPCat{source.CatIPv4, source.CatIPv6} {
+		tr := randomTree(1000, cat)
+		flat, err := NewFlatFrom(writeFlatHelper(t, tr))
+		if err != nil {
+			t.Fatalf("Failed to load flat tree: %s", err)
+		}
+		rnd := rand.New(rand.NewPCG(1, 2)) // nolint:gosec
+		for name, r := range map[string]Reader{"tree": tr, "flat": flat} {
+			allocs := testing.AllocsPerRun(1000, func() {
+				r.FindIPRange(randomAddr(rnd, cat))
+			})
+			if allocs != 0 {
+				t.Errorf("IPv%d %s: expected no allocation, got %f", cat, name, allocs)
+			}
+		}
+	}
+}
+
+// Benchmarks against the gob format, on a tree with a size close to the embedded IPv4 one
+
+const benchRanges = 25000
+
+func BenchmarkLoadGob(b *testing.B) {
+	buffer := bytes.NewBuffer([]byte{})
+	if err := randomTree(benchRanges, source.CatIPv4).SerializeTo(buffer); err != nil {
+		b.Fatal(err)
+	}
+	data := buffer.Bytes()
+	b.ResetTimer()
+	for range b.N {
+		if _, err := NewTreeFrom(bytes.NewReader(data), source.CatIPv4); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(len(data)), "size-bytes")
+}
+
+func BenchmarkLoadFlat(b *testing.B) {
+	data := writeFlatHelper(b, randomTree(benchRanges, source.CatIPv4))
+	b.ResetTimer()
+	for range b.N {
+		if _, err := NewFlatFrom(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(len(data)), "size-bytes")
+}
+
+func benchmarkFind(b *testing.B, r Reader) {
+	b.Helper()
+	rnd := rand.New(rand.NewPCG(1, 2)) // nolint:gosec
+	ips := make([]netip.Addr, 1024)
+	for i := range ips {
+		ips[i] = randomAddr(rnd, source.CatIPv4)
+	}
+	b.ResetTimer()
+	for i := range b.N {
+		r.FindIPRange(ips[i%len(ips)])
+	}
+}
+
+func BenchmarkFindGob(b *testing.B) {
+	buffer := bytes.NewBuffer([]byte{})
+	if err := randomTree(benchRanges, source.CatIPv4).SerializeTo(buffer); err != nil {
+		b.Fatal(err)
+	}
+	t, err := NewTreeFrom(buffer, source.CatIPv4)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkFind(b, t)
+}
+
+func BenchmarkFindFlat(b *testing.B) {
+	flat, err := NewFlatFrom(writeFlatHelper(b, randomTree(benchRanges, source.CatIPv4)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkFind(b, flat)
+}
+
+func TestFlatProviderNames(t *testing.T) {
+	writer, err := provider.Register("FlatWriterCorp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.SetCategory(writer, provider.CategoryHosting)
+	tr := NewIPv4Tree()
+	tr.Add(&source.IPRange{Prefix: netip.MustParsePrefix("192.0.2.0/24"), Cat: source.CatIPv4, Provider: writer})
+	tr.Add(&source.IPRange{Prefix: netip.MustParsePrefix("198.51.100.0/24"), Cat: source.CatIPv4, Provider: provider.Aws})
+	b := writeFlatHelper(t, tr)
+
+	// Same process: the provider is known
+	flat, err := NewFlatFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := flat.FindIPRange(netip.MustParseAddr("192.0.2.1")); r.Provider != writer {
+		t.Errorf("Expected %s, got %s", writer, r.Provider)
+	}
+
+	// Another process, which does not know the provider: it is registered with its category
+	b = bytes.ReplaceAll(b, []byte("FlatWriterCorp"), []byte("FlatReaderCorp"))
+	flat, err = NewFlatFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := provider.ParseProvider("FlatReaderCorp")
+	if err != nil {
+		t.Fatalf("Expected the provider of the tree to be registered: %s", err)
+	}
+	if reader.Category() != provider.CategoryHosting {
+		t.Errorf("Expected %s, got %s", provider.CategoryHosting, reader.Category())
+	}
+	if r, _ := flat.FindIPRange(netip.MustParseAddr("192.0.2.1")); r.Provider != reader {
+		t.Errorf("Expected %s, got %s", reader, r.Provider)
+	}
+	if r, _ := flat.FindIPRange(netip.MustParseAddr("198.51.100.1")); r.Provider != provider.Aws {
+		t.Errorf("Expected %s, got %s", provider.Aws, r.Provider)
+	}
+
+	// Invalid trees do not register anything
+	invalid := bytes.ReplaceAll(b, []byte("FlatReaderCorp"), []byte("FlatInvalidCor"))
+	if _, err := NewFlatFrom(invalid[:len(invalid)-1]); !errors.Is(err, ErrInvalidFlat) {
+		t.Errorf("Expected ErrInvalidFlat, got %v", err)
+	}
+	if _, err := provider.ParseProvider("FlatInvalidCor"); err == nil {
+		t.Errorf("Expected the providers of an invalid tree not to be registered")
+	}
+}
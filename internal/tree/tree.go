@@ -4,38 +4,63 @@ import (
 	"encoding/gob"
 	"fmt"
 	"io"
-	"net"
+	"net/netip"
+	"slices"
 
-	"github.com/Escape-Technologies/cloudfinder/internal/log"
 	"github.com/Escape-Technologies/cloudfinder/internal/source"
 )
 
-// This package implements a segement tree for ip ranges, that can be saved & loaded to/from a file at build time.
-type Tree interface {
-	// Find the IpRange for a given ip, returns nil if none matches.
-	FindIPRange(ip net.IP) *source.IPRange
+// Reader is the read only part of a tree, implemented by both the in memory Tree and the Flat format.
+// Lookups do not allocate, except FindAllIPRanges and FindIPRangesWithin for the returned slice.
+type Reader interface {
+	// Find the most specific IpRange for a given ip, returns false if none matches.
+	FindIPRange(addr netip.Addr) (source.IPRange, bool)
 
-	// Add a new IpRange to the tree.
-	Add(ipRange *source.IPRange)
+	// Find all the IpRanges containing a given ip, from the most to the least specific.
+	FindAllIPRanges(addr netip.Addr) []source.IPRange
 
-	// Serialize the tree to a buffer.
-	SerializeTo(w io.Writer)
+	// Find the ranges inside a prefix and more specific than it, in address order (the shortest first for the same
+	// address). Overlaps of the same network are not listed, only the main range.
+	FindIPRangesWithin(prefix netip.Prefix) []source.IPRange
 
 	// Get all ranges stored in tree, after duduplication ...
 	GetAllRanges() []*source.IPRange
 }
 
+// This package implements a segement tree for ip ranges, that can be saved & loaded to/from a file at build time.
+// Nested ranges are all kept, lookups return the longest matching prefix.
+type Tree interface {
+	Reader
+
+	// Add a new IpRange to the tree. If the exact same network was already added, the first one is kept
+	// as the main range, the others are kept as overlaps when they come from a different provider.
+	// Fails if the range is invalid or not of the tree category, the tree is then left unchanged.
+	Add(ipRange *source.IPRange) error
+
+	// Serialize the tree to a buffer, using gob. See WriteFlat for the compact format.
+	SerializeTo(w io.Writer) error
+}
+
 type tree struct {
 	Root *node        `json:"r"`
 	Cat  source.IPCat `json:"c"`
 }
 
+// Addresses are handled in their 16 bytes form, IPv4 as IPv4-mapped IPv6 addresses: their first bit is at index 96.
+const (
+	addrBits     = 128
+	ipv4BitStart = 96
+)
+
 type node struct {
 	// Child Nodes. Size is always 2 (0 and 1), but a [2] array won't work as it will contain nil values. This is less space efficient, but serializable
 	Nodes map[byte]*node `json:"n"`
 
-	// The ip range for this node, nil if not a leaf.
+	// The ip range for this node, nil if no range ends at this prefix. Nodes holding a range can still have children (more specific ranges).
 	IPRange *source.IPRange `json:"i"`
+
+	// Ranges for the exact same network from other providers, in insertion order.
+	Overlaps []*source.IPRange `json:"o"`
 }
 
 // NewTree creates a new tree, returns the root node.
@@ -59,33 +84,45 @@ func newNode() *node {
 	}
 }
 
-func (t *tree) Add(ipRange *source.IPRange) {
-	if ipRange.Cat != t.Cat {
-		log.Fatal("Invalid IP category", fmt.Errorf("%d != %d", ipRange.Cat, t.Cat))
+func (t *tree) Add(ipRange *source.IPRange) error {
+	if !ipRange.Prefix.IsValid() {
+		return fmt.Errorf("invalid range: %s", ipRange.Prefix)
 	}
-
-	var ip net.IP
-	if ipRange.Cat == source.CatIPv4 {
-		ip = ipRange.Network.IP.To4()
-	} else {
-		ip = ipRange.Network.IP.To16()
+	// IPv4-mapped IPv6 prefixes are rejected from both trees, their length does not match either
+	if ipRange.Cat != t.Cat || ipRange.Prefix.Addr().Is4() != (t.Cat == source.CatIPv4) {
+		return fmt.Errorf("invalid IP category for %s: %d != %d", ipRange.Prefix, ipRange.Cat, t.Cat)
 	}
 
-	prefixLen, _ := ipRange.Network.Mask.Size()
-
-	t.Root.add(ip, prefixLen, ipRange, 0)
+	ip := ipRange.Prefix.Addr().As16()
+	start := t.bitStart()
+	t.Root.add(&ip, start+ipRange.Prefix.Bits(), ipRange, start)
+	return nil
 }
 
-func (n *node) add(ip net.IP, prefixLen int, ipRange *source.IPRange, bitIndex int) {
-	if n.IPRange != nil {
-		// A larger network already exists; skip adding
-		return
+func (t *tree) bitStart() int {
+	if t.Cat == source.CatIPv4 {
+		return ipv4BitStart
 	}
+	return 0
+}
 
+// prefixLen is the absolute index of the last bit of the prefix in the 16 bytes form
+func (n *node) add(ip *[16]byte, prefixLen int, ipRange *source.IPRange, bitIndex int) {
 	if bitIndex >= prefixLen {
-		// Reached the node corresponding to the prefix length
-		n.IPRange = ipRange
-		n.Nodes = make(map[byte]*node) // Prune any subtrees
+		// Reached the node corresponding to the prefix length, the first range added for a network wins
+		if n.IPRange == nil {
+			n.IPRange = ipRange
+			return
+		}
+		if n.IPRange.Provider == ipRange.Provider {
+			return
+		}
+		for _, o := range n.Overlaps {
+			if o.Provider == ipRange.Provider {
+				return
+			}
+		}
+		n.Overlaps = append(n.Overlaps, ipRange)
 		return
 	}
 
@@ -101,13 +138,14 @@ func (n *node) add(ip net.IP, prefixLen int, ipRange *source.IPRange, bitIndex i
 	n.Nodes[bit].add(ip, prefixLen, ipRange, bitIndex+1)
 }
 
-func (n *node) find(ip net.IP, bitIndex int) *source.IPRange {
+// find returns the deepest range on the path of ip, best is the deepest range found so far.
+func (n *node) find(ip *[16]byte, bitIndex int, best *source.IPRange) *source.IPRange {
 	if n.IPRange != nil {
-		return n.IPRange
+		best = n.IPRange
 	}
 
-	if bitIndex >= len(ip)*8 {
-		return nil
+	if bitIndex >= addrBits {
+		return best
 	}
 
 	byteIndex := bitIndex / 8       // nolint:mnd
@@ -115,21 +153,119 @@ func (n *node) find(ip net.IP, bitIndex int) *source.IPRange {
 	bit := (ip[byteIndex] >> bitOffset) & 1
 
 	if _, ok := n.Nodes[bit]; !ok {
-		return nil
+		return best
 	}
 
-	return n.Nodes[bit].find(ip, bitIndex+1)
+	return n.Nodes[bit].find(ip, bitIndex+1, best)
 }
 
-func (t *tree) FindIPRange(ip net.IP) *source.IPRange {
-	var correctCatIP net.IP
-	if t.Cat == source.CatIPv4 {
-		correctCatIP = ip.To4()
-	} else {
-		correctCatIP = ip.To16()
+// findAll appends all the ranges on the path of ip, from the least to the most specific.
+func (n *node) findAll(ip *[16]byte, bitIndex int, ranges []source.IPRange) []source.IPRange {
+	if n.IPRange != nil {
+		// Overlaps first, so that the main range stays first once reversed
+		for i := len(n.Overlaps) - 1; i >= 0; i-- {
+			ranges = append(ranges, *n.Overlaps[i])
+		}
+		ranges = append(ranges, *n.IPRange)
+	}
+
+	if bitIndex >= addrBits {
+		return ranges
+	}
+
+	byteIndex := bitIndex / 8       // nolint:mnd
+	bitOffset := 7 - (bitIndex % 8) // nolint:mnd
+	bit := (ip[byteIndex] >> bitOffset) & 1
+
+	if _, ok := n.Nodes[bit]; !ok {
+		return ranges
+	}
+
+	return n.Nodes[bit].findAll(ip, bitIndex+1, ranges)
+}
+
+// accepts checks that addr belongs to the tree category, IPv4-mapped IPv6 addresses are handled as IPv4
+func accepts(cat source.IPCat, addr netip.Addr) (netip.Addr, bool) {
+	addr = addr.Unmap()
+	if !addr.IsValid() || addr.Is4() != (cat == source.CatIPv4) {
+		return addr, false
 	}
+	return addr, true
+}
 
-	return t.Root.find(correctCatIP, 0)
+func (t *tree) FindIPRange(addr netip.Addr) (source.IPRange, bool) {
+	addr, ok := accepts(t.Cat, addr)
+	if !ok {
+		return source.IPRange{}, false
+	}
+	ip := addr.As16()
+	r := t.Root.find(&ip, t.bitStart(), nil)
+	if r == nil {
+		return source.IPRange{}, false
+	}
+	return *r, true
+}
+
+func (t *tree) FindAllIPRanges(addr netip.Addr) []source.IPRange {
+	ranges := []source.IPRange{}
+	addr, ok := accepts(t.Cat, addr)
+	if !ok {
+		return ranges
+	}
+	ip := addr.As16()
+	ranges = t.Root.findAll(&ip, t.bitStart(), ranges)
+	slices.Reverse(ranges)
+	return ranges
+}
+
+// acceptsPrefix checks that prefix belongs to the tree category, IPv4-mapped IPv6 prefixes are handled as IPv4
+func acceptsPrefix(cat source.IPCat, prefix netip.Prefix) (netip.Prefix, bool) {
+	if !prefix.IsValid() {
+		return prefix, false
+	}
+	if prefix.Addr().Is4In6() {
+		bits := prefix.Bits() - ipv4BitStart
+		if bits < 0 {
+			return prefix, false
+		}
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), bits)
+	}
+	if prefix.Addr().Is4() != (cat == source.CatIPv4) {
+		return prefix, false
+	}
+	return prefix.Masked(), true
+}
+
+func (t *tree) FindIPRangesWithin(prefix netip.Prefix) []source.IPRange {
+	ranges := []source.IPRange{}
+	prefix, ok := acceptsPrefix(t.Cat, prefix)
+	if !ok {
+		return ranges
+	}
+	ip := prefix.Addr().As16()
+	n := t.Root
+	for bitIndex := t.bitStart(); bitIndex < t.bitStart()+prefix.Bits(); bitIndex++ {
+		bit := (ip[bitIndex/8] >> (7 - bitIndex%8)) & 1 // nolint:mnd
+		if n = n.Nodes[bit]; n == nil {
+			return ranges
+		}
+	}
+	return n.within(ranges)
+}
+
+// within appends the main ranges of the descendants of n, in address order
+func (n *node) within(ranges []source.IPRange) []source.IPRange {
+	for _, bit := range []byte{0, 1} {
+		child, ok := n.Nodes[bit]
+		if !ok {
+			continue
+		}
+		if child.IPRange != nil {
+			ranges = append(ranges, *child.IPRange)
+		}
+		ranges = child.within(ranges)
+	}
+	return ranges
 }
 
 func (n *node) walk() []*source.IPRange {
@@ -142,6 +278,7 @@ func (n *node) walk() []*source.IPRange {
 
 	if n.IPRange != nil {
 		ranges = append(ranges, n.IPRange)
+		ranges = append(ranges, n.Overlaps...)
 	}
 
 	for _, leaf := range n.Nodes {
@@ -155,14 +292,15 @@ func (t *tree) GetAllRanges() []*source.IPRange {
 	return t.Root.walk()
 }
 
-func (t *tree) SerializeTo(w io.Writer) {
+func (t *tree) SerializeTo(w io.Writer) error {
 	err := gob.NewEncoder(w).Encode(t)
 	if err != nil {
-		log.Fatal("Failed to serialize tree", err)
+		return fmt.Errorf("failed to serialize tree: %w", err)
 	}
+	return nil
 }
 
-func NewTreeFrom(r io.Reader, cat source.IPCat) Tree {
+func NewTreeFrom(r io.Reader, cat source.IPCat) (Tree, error) {
 	var t Tree
 	if cat == source.CatIPv4 {
 		t = NewIPv4Tree()
@@ -172,7 +310,7 @@ func NewTreeFrom(r io.Reader, cat source.IPCat) Tree {
 
 	err := gob.NewDecoder(r).Decode(t)
 	if err != nil {
-		log.Fatal("Failed to deserialize tree", err)
+		return nil, fmt.Errorf("failed to deserialize tree: %w", err)
 	}
-	return t
+	return t, nil
 }
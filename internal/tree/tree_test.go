@@ -3,12 +3,13 @@ package tree
 import (
 	"bytes"
 	"errors"
-	"net"
+	"net/netip"
 	"slices"
 	"testing"
 
 	"github.com/Escape-Technologies/cloudfinder/internal/log"
 	source "github.com/Escape-Technologies/cloudfinder/internal/source"
+	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
 )
 
 func makeTreeHelper() *tree {
@@ -23,17 +24,17 @@ func makeTreeHelper() *tree {
 
 	// build the tree
 	for _, networkCidr := range networksCidrs {
-		_, network, err := net.ParseCIDR(networkCidr)
+		network, err := netip.ParsePrefix(networkCidr)
 		if err != nil {
 			log.Error("Failed to parse CIDR", err)
 		}
-		if network == nil {
-			log.Error("Failed to parse CIDR", errors.New("network is nil"))
+		if !network.IsValid() {
+			log.Error("Failed to parse CIDR", errors.New("network is invalid"))
 		}
 
 		ipRange := &source.IPRange{
-			Network: network,
-			Cat:     source.CatIPv4,
+			Prefix: network.Masked(),
+			Cat:    source.CatIPv4,
 		}
 
 		tree.Add(ipRange)
@@ -43,13 +44,13 @@ func makeTreeHelper() *tree {
 }
 
 func TestNetworkIp(t *testing.T) {
-	_, network, err := net.ParseCIDR("0.0.0.2/24")
-	if err != nil {
-		t.Errorf("Failed to parse")
+	network, cat := mustParseCIDR("0.0.0.2/24")
+	if cat != source.CatIPv4 {
+		t.Errorf("Expected IPv4, got %d", cat)
 	}
 
-	if network.IP.String() != net.ParseIP("0.0.0.0").String() {
-		t.Errorf("Expected network IP to be 0.0.0.0, got %s", network.IP.String())
+	if network.Addr() != netip.MustParseAddr("0.0.0.0") {
+		t.Errorf("Expected network IP to be 0.0.0.0, got %s", network.Addr())
 	}
 }
 
@@ -74,21 +75,21 @@ func TestIPv4Tree(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		ip := net.ParseIP(test.ip)
-		if ip == nil {
+		ip, err := netip.ParseAddr(test.ip)
+		if err != nil {
 			t.Errorf("Failed to parse %s", test.ip)
 		}
 
-		result := tree.FindIPRange(ip)
-		if result == nil && test.matchingRange != "" {
+		result, ok := tree.FindIPRange(ip)
+		if !ok && test.matchingRange != "" {
 			t.Errorf("Expected result for %s", test.ip)
 		}
-		if result != nil && test.matchingRange == "" {
+		if ok && test.matchingRange == "" {
 			t.Errorf("Expected no result for %s", test.ip)
 		}
-		if result != nil && test.matchingRange != "" {
-			if result.Network.String() != test.matchingRange {
-				t.Errorf("Expected result %s, got %s", test.matchingRange, result.Network.String())
+		if ok && test.matchingRange != "" {
+			if result.Prefix.String() != test.matchingRange {
+				t.Errorf("Expected result %s, got %s", test.matchingRange, result.Prefix.String())
 			}
 		}
 	}
@@ -105,13 +106,18 @@ func TestGetAllRanges(t *testing.T) {
 func TestSerializeAndLoad(t *testing.T) {
 	tree := makeTreeHelper()
 	buffer := bytes.NewBuffer([]byte{})
-	tree.SerializeTo(buffer)
+	if err := tree.SerializeTo(buffer); err != nil {
+		t.Fatal(err)
+	}
 
 	if buffer.Len() == 0 {
 		t.Errorf("Expected encoded tree to be non-empty")
 	}
 
-	tree2 := NewTreeFrom(buffer, source.CatIPv4)
+	tree2, err := NewTreeFrom(buffer, source.CatIPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	t1ranges := tree.GetAllRanges()
 	t2ranges := tree2.GetAllRanges()
@@ -119,11 +125,11 @@ func TestSerializeAndLoad(t *testing.T) {
 		t.Errorf("Expected tree2 to have %d ranges", len(t1ranges))
 	}
 
-	testIP := net.ParseIP("3.5.141.2")
-	if tree.FindIPRange(testIP) == nil {
+	testIP := netip.MustParseAddr("3.5.141.2")
+	if _, ok := tree.FindIPRange(testIP); !ok {
 		t.Errorf("Expected tree1 to contain range for %s", testIP)
 	}
-	if tree2.FindIPRange(testIP) == nil {
+	if _, ok := tree2.FindIPRange(testIP); !ok {
 		t.Errorf("Expected tree2 to contain range for %s", testIP)
 	}
 }
@@ -131,10 +137,10 @@ func TestSerializeAndLoad(t *testing.T) {
 func cidrsToRanges(cidrs []string) []*source.IPRange {
 	ranges := make([]*source.IPRange, 0)
 	for _, c := range cidrs {
-		net, cat := source.ParseCIDR(c)
+		network, cat := mustParseCIDR(c)
 		ranges = append(ranges, &source.IPRange{
-			Network: net,
-			Cat:     cat,
+			Prefix: network,
+			Cat:    cat,
 		})
 	}
 	return ranges
@@ -143,7 +149,7 @@ func cidrsToRanges(cidrs []string) []*source.IPRange {
 func rangesToCidrs(ranges []*source.IPRange) []string {
 	cidrs := make([]string, 0)
 	for _, r := range ranges {
-		cidrs = append(cidrs, r.Network.String())
+		cidrs = append(cidrs, r.Prefix.String())
 	}
 	return cidrs
 }
@@ -172,12 +178,12 @@ func TestOverlapCases(t *testing.T) {
 		{
 			name:     "overlapping networks",
 			ranges:   []string{"1.2.3.0/24", "1.2.0.0/16"},
-			expected: []string{"1.2.0.0/16"},
+			expected: []string{"1.2.0.0/16", "1.2.3.0/24"},
 		},
 		{
 			name:     "overlapping networks (reversed)",
 			ranges:   []string{"1.2.0.0/16", "1.2.3.0/24"},
-			expected: []string{"1.2.0.0/16"},
+			expected: []string{"1.2.0.0/16", "1.2.3.0/24"},
 		},
 	}
 
@@ -197,3 +203,217 @@ func TestOverlapCases(t *testing.T) {
 		}
 	}
 }
+
+func TestLongestPrefixMatch(t *testing.T) {
+	ranges := []struct {
+		cidr     string
+		provider provider.Provider
+	}{
+		{"76.0.0.0/8", provider.Aws},
+		{"76.76.0.0/16", provider.Akamai},
+		{"76.76.21.0/24", provider.Vercel},
+		{"76.76.21.128/25", provider.Cloudflare},
+		// Same network from another provider, the first one is kept
+		{"76.76.21.0/24", provider.Fastly},
+		{"2600:1f00::/24", provider.Aws},
+		{"2600:1f18:4000::/36", provider.Vercel},
+	}
+
+	tests := []struct {
+		ip string
+		// "" for nil
+		matchingRange string
+		provider      provider.Provider
+	}{
+		{"76.1.2.3", "76.0.0.0/8", provider.Aws},
+		{"76.76.1.2", "76.76.0.0/16", provider.Akamai},
+		{"76.76.21.21", "76.76.21.0/24", provider.Vercel},
+		{"76.76.21.200", "76.76.21.128/25", provider.Cloudflare},
+		{"76.76.22.1", "76.76.0.0/16", provider.Akamai},
+		{"77.0.0.1", "", provider.Unknown},
+		{"2600:1f00::1", "2600:1f00::/24", provider.Aws},
+		{"2600:1f18:4000::1", "2600:1f18:4000::/36", provider.Vercel},
+		{"2600:1f18:5000::1", "2600:1f00::/24", provider.Aws},
+	}
+
+	// The result must not depend on the insertion order
+	for _, reversed := range []bool{false, true} {
+		v4 := NewIPv4Tree()
+		v6 := NewIPv6Tree()
+		order := make([]int, len(ranges))
+		for i := range ranges {
+			order[i] = i
+		}
+		if reversed {
+			// Keep the Vercel range before the Fastly duplicate
+			order = []int{6, 5, 3, 2, 4, 1, 0}
+		}
+		for _, i := range order {
+			network, cat := mustParseCIDR(ranges[i].cidr)
+			r := &source.IPRange{Prefix: network, Cat: cat, Provider: ranges[i].provider}
+			if cat == source.CatIPv4 {
+				v4.Add(r)
+			} else {
+				v6.Add(r)
+			}
+		}
+
+		if got := len(v4.GetAllRanges()); got != 5 {
+			t.Errorf("Expected 5 IPv4 ranges to be kept, got %d", got)
+		}
+
+		for _, test := range tests {
+			ip := netip.MustParseAddr(test.ip)
+			var result source.IPRange
+			var ok bool
+			if ip.Is4() {
+				result, ok = v4.FindIPRange(ip)
+			} else {
+				result, ok = v6.FindIPRange(ip)
+			}
+
+			if test.matchingRange == "" {
+				if ok {
+					t.Errorf("Expected no result for %s, got %s", test.ip, result.Prefix)
+				}
+				continue
+			}
+			if !ok {
+				t.Errorf("Expected result for %s", test.ip)
+				continue
+			}
+			if result.Prefix.String() != test.matchingRange || result.Provider != test.provider {
+				t.Errorf("[reversed=%t] %s: expected %s (%s), got %s (%s)", reversed, test.ip, test.matchingRange, test.provider, result.Prefix, result.Provider)
+			}
+		}
+	}
+}
+
+func TestFindAllIPRanges(t *testing.T) {
+	tree := NewIPv4Tree()
+	for _, r := range []struct {
+		cidr     string
+		provider provider.Provider
+	}{
+		{"76.0.0.0/8", provider.Aws},
+		{"76.76.21.0/24", provider.Vercel},
+		{"76.76.21.0/24", provider.Fastly},
+		// Duplicate from the same provider is dropped
+		{"76.76.21.0/24", provider.Vercel},
+		{"76.76.21.128/25", provider.Cloudflare},
+	} {
+		network, cat := mustParseCIDR(r.cidr)
+		tree.Add(&source.IPRange{Prefix: network, Cat: cat, Provider: r.provider})
+	}
+
+	tests := []struct {
+		ip       string
+		expected []string
+	}{
+		{"77.0.0.1", []string{}},
+		{"76.1.1.1", []string{"76.0.0.0/8 Aws"}},
+		{"76.76.21.1", []string{"76.76.21.0/24 Vercel", "76.76.21.0/24 Fastly", "76.0.0.0/8 Aws"}},
+		{"76.76.21.200", []string{"76.76.21.128/25 Cloudflare", "76.76.21.0/24 Vercel", "76.76.21.0/24 Fastly", "76.0.0.0/8 Aws"}},
+	}
+
+	for _, test := range tests {
+		got := []string{}
+		for _, r := range tree.FindAllIPRanges(netip.MustParseAddr(test.ip)) {
+			got = append(got, r.Prefix.String()+" "+r.Provider.String())
+		}
+		if !slices.Equal(got, test.expected) {
+			t.Errorf("%s: got %+v, expected %+v", test.ip, got, test.expected)
+		}
+	}
+
+	if got := len(tree.GetAllRanges()); got != 4 {
+		t.Errorf("Expected 4 ranges, got %d", got)
+	}
+}
+
+func mustParseCIDR(cidr string) (netip.Prefix, source.IPCat) {
+	network, cat, err := source.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network, cat
+}
+
+func TestAddErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		tree Tree
+		r    *source.IPRange
+	}{
+		{"invalid prefix", NewIPv4Tree(), &source.IPRange{Cat: source.CatIPv4}},
+		{"IPv6 in IPv4 tree", NewIPv4Tree(), &source.IPRange{Prefix: netip.MustParsePrefix("2001:db8::/32"), Cat: source.CatIPv6}},
+		{"IPv4 in IPv6 tree", NewIPv6Tree(), &source.IPRange{Prefix: netip.MustParsePrefix("192.0.2.0/24"), Cat: source.CatIPv4}},
+		{"IPv4-mapped", NewIPv4Tree(), &source.IPRange{Prefix: netip.MustParsePrefix("::ffff:192.0.2.0/120"), Cat: source.CatIPv4}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.tree.Add(test.r); err == nil {
+				t.Errorf("Expected an error")
+			}
+			if len(test.tree.GetAllRanges()) != 0 {
+				t.Errorf("Expected the tree to be left empty")
+			}
+		})
+	}
+}
+
+func TestNewTreeFromInvalid(t *testing.T) {
+	if _, err := NewTreeFrom(bytes.NewReader([]byte("not a tree")), source.CatIPv4); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
+
+func TestFindIPRangesWithin(t *testing.T) {
+	tree := NewIPv4Tree()
+	for _, r := range []struct {
+		cidr     string
+		provider provider.Provider
+	}{
+		{"76.0.0.0/8", provider.Aws},
+		{"76.76.21.0/24", provider.Vercel},
+		{"76.76.21.0/24", provider.Fastly},
+		{"76.76.21.128/25", provider.Cloudflare},
+		{"76.76.20.0/24", provider.Gcp},
+		{"76.77.0.0/16", provider.Oracle},
+	} {
+		network, cat := mustParseCIDR(r.cidr)
+		tree.Add(&source.IPRange{Prefix: network, Cat: cat, Provider: r.provider})
+	}
+	flat, err := NewFlatFrom(writeFlatHelper(t, tree))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		prefix   string
+		expected []string
+	}{
+		{"76.76.0.0/16", []string{"76.76.20.0/24 Gcp", "76.76.21.0/24 Vercel", "76.76.21.128/25 Cloudflare"}},
+		{"76.76.21.0/24", []string{"76.76.21.128/25 Cloudflare"}},
+		{"::ffff:76.76.21.0/120", []string{"76.76.21.128/25 Cloudflare"}},
+		{"76.76.21.128/25", []string{}},
+		{"77.0.0.0/8", []string{}},
+		// Not masked
+		{"76.76.21.1/16", []string{"76.76.20.0/24 Gcp", "76.76.21.0/24 Vercel", "76.76.21.128/25 Cloudflare"}},
+		{"0.0.0.0/0", []string{"76.0.0.0/8 Aws", "76.76.20.0/24 Gcp", "76.76.21.0/24 Vercel", "76.76.21.128/25 Cloudflare",
+			"76.77.0.0/16 Oracle"}},
+		{"2600::/16", []string{}},
+	}
+
+	for _, test := range tests {
+		for name, r := range map[string]Reader{"tree": tree, "flat": flat} {
+			got := []string{}
+			for _, r := range r.FindIPRangesWithin(netip.MustParsePrefix(test.prefix)) {
+				got = append(got, r.Prefix.String()+" "+r.Provider.String())
+			}
+			if !slices.Equal(got, test.expected) {
+				t.Errorf("%s %s: got %+v, expected %+v", name, test.prefix, got, test.expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package cloud
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
+)
+
+// Many SaaS and CDN fronts are easier to identify from the CNAME chain of a host than from its ips: eg. Vercel runs
+// on Aws ranges, but its customers point their hosts to cname.vercel-dns.com. The rules of cname_rules.json map the
+// domains of the CNAME targets to their provider.
+
+//go:embed cname_rules.json
+var defaultCNAMERules []byte
+
+// Signal is what decided the provider of a Result.
+type Signal string
+
+const (
+	// SignalNone when nothing matched
+	SignalNone Signal = ""
+	// SignalRange when the ip is in a range of the provider
+	SignalRange Signal = "range"
+	// SignalCNAME when a name of the CNAME chain of the host matches a CNAME rule of the provider
+	SignalCNAME Signal = "cname"
+)
+
+// CNAMERule maps the names under a domain to a provider, see WithCNAMERules.
+type CNAMERule struct {
+	// Domain matching itself and its subdomains, eg. cloudfront.net
+	Suffix   string            `json:"suffix"`
+	Provider provider.Provider `json:"-"`
+	Service  string            `json:"service,omitempty"`
+	// From the service or the provider when empty, see provider.ServiceCategory
+	Category provider.Category `json:"category,omitempty"`
+}
+
+// cnameRuleJSON is the format of cname_rules.json, providers are named
+type cnameRuleJSON struct {
+	CNAMERule
+	Provider string `json:"provider"`
+}
+
+// DefaultCNAMERules returns the rules embedded in the package (cname_rules.json), used by every resolver. Providers
+// missing from the enum, eg. Heroku, are registered (see provider.Register) on the first call.
+func DefaultCNAMERules() ([]CNAMERule, error) {
+	rules, err := loadDefaultCNAMERules()
+	if err != nil {
+		return nil, err
+	}
+	return append([]CNAMERule{}, rules...), nil
+}
+
+var loadDefaultCNAMERules = sync.OnceValues(func() ([]CNAMERule, error) {
+	return ParseCNAMERules(defaultCNAMERules)
+})
+
+// ParseCNAMERules reads a json list of rules, eg. [{"suffix": "herokudns.com", "provider": "Heroku"}], and registers
+// their providers once every rule is valid: invalid rules register nothing. Unknown fields are rejected, to catch
+// typos.
+func ParseCNAMERules(b []byte) ([]CNAMERule, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	var parsed []cnameRuleJSON
+	if err := dec.Decode(&parsed); err != nil {
+		return nil, fmt.Errorf("invalid cname rules: %w", err)
+	}
+	for i, r := range parsed {
+		suffix := normalizeName(r.Suffix)
+		if suffix == "" {
+			return nil, fmt.Errorf("invalid cname rule for provider %s: empty suffix", r.Provider)
+		}
+		if strings.TrimSpace(r.Provider) == "" {
+			return nil, fmt.Errorf("invalid cname rule %s: empty provider", suffix)
+		}
+		category, err := provider.ParseCategory(string(r.Category))
+		if err != nil {
+			return nil, fmt.Errorf("invalid cname rule %s: %w", suffix, err)
+		}
+		parsed[i].Suffix, parsed[i].Category = suffix, category
+	}
+
+	rules := make([]CNAMERule, 0, len(parsed))
+	for _, r := range parsed {
+		p, err := provider.Register(r.Provider)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cname rule %s: %w", r.Suffix, err)
+		}
+		rule := r.CNAMERule
+		rule.Provider = p
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// cnameRules matches names with the most specific suffix
+type cnameRules map[string]CNAMERule
+
+func newCNAMERules(rules []CNAMERule) cnameRules {
+	m := make(cnameRules, len(rules))
+	for _, r := range rules {
+		m[normalizeName(r.Suffix)] = r
+	}
+	return m
+}
+
+// match returns the rule with the longest suffix of name
+func (m cnameRules) match(name string) (CNAMERule, bool) {
+	for {
+		if r, ok := m[name]; ok {
+			return r, true
+		}
+		_, parent, found := strings.Cut(name, ".")
+		if !found {
+			return CNAMERule{}, false
+		}
+		name = parent
+	}
+}
+
+// normalizeName returns name lower case, without the final dot
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+// lookupCNAME returns the result of the first name of chain matching a rule, custom rules first
+func lookupCNAME(custom, defaults cnameRules, chain []string) Result {
+	for _, name := range chain {
+		name = normalizeName(name)
+		rule, found := custom.match(name)
+		if !found {
+			rule, found = defaults.match(name)
+		}
+		if !found {
+			continue
+		}
+		category := rule.Category
+		if category == provider.CategoryUnknown {
+			category = provider.ServiceCategory(rule.Provider, rule.Service)
+		}
+		return Result{
+			Provider: rule.Provider,
+			Service:  rule.Service,
+			Category: category,
+			Signal:   SignalCNAME,
+			CNAME:    name,
+		}
+	}
+	return Result{Provider: provider.Unknown}
+}
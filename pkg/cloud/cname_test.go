@@ -0,0 +1,99 @@
+package cloud
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
+)
+
+func TestLookupCNAME(t *testing.T) {
+	corp, err := provider.Register("CnameCorp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewResolver(WithCNAMERules(
+		CNAMERule{Suffix: "edge.corp.test.", Provider: corp, Category: provider.CategoryEgress},
+		// Wins over the more specific default rule
+		CNAMERule{Suffix: "Amazonaws.com", Provider: corp},
+	))
+	heroku, err := provider.ParseProviderFold("heroku")
+	if err != nil || !heroku.IsCustom() {
+		t.Fatalf("Expected Heroku to be registered, got %s (%v)", heroku, err)
+	}
+
+	tests := []struct {
+		chain    []string
+		provider provider.Provider
+		service  string
+		category provider.Category
+		cname    string
+	}{
+		{[]string{"www.example.com", "d111.cloudfront.net"}, provider.Aws, "CLOUDFRONT", provider.CategoryCDN,
+			"d111.cloudfront.net"},
+		{[]string{"app.example.com", "cname.vercel-dns.com."}, provider.Vercel, "", provider.CategoryServerless,
+			"cname.vercel-dns.com"},
+		// The first matching name wins
+		{[]string{"shop.example.com", "shop.azureedge.net", "shop.ec.edgekey.net"}, provider.Azure, "AzureCDN",
+			provider.CategoryCDN, "shop.azureedge.net"},
+		{[]string{"App.HerokuDNS.com"}, heroku, "", provider.CategoryHosting, "app.herokudns.com"},
+		{[]string{"a.b.edge.corp.test"}, corp, "", provider.CategoryEgress, "a.b.edge.corp.test"},
+		{[]string{"bucket.s3.amazonaws.com"}, corp, "", provider.CategoryUnknown, "bucket.s3.amazonaws.com"},
+		// The suffix matches whole labels only
+		{[]string{"www.example.com", "notcloudfront.net"}, provider.Unknown, "", provider.CategoryUnknown, ""},
+		{[]string{"cloudfront.net"}, provider.Aws, "CLOUDFRONT", provider.CategoryCDN, "cloudfront.net"},
+		{nil, provider.Unknown, "", provider.CategoryUnknown, ""},
+	}
+	for _, test := range tests {
+		res := r.LookupCNAME(test.chain)
+		if res.Provider != test.provider || res.Service != test.service || res.Category != test.category ||
+			res.CNAME != test.cname {
+			t.Errorf("Expected %v to be %s %s %s %s, got %+v", test.chain, test.provider, test.service, test.category,
+				test.cname, res)
+		}
+		signal := SignalCNAME
+		if test.provider == provider.Unknown {
+			signal = SignalNone
+		}
+		if res.Signal != signal || res.Prefix.IsValid() {
+			t.Errorf("Expected %v to be signaled by %q without prefix, got %+v", test.chain, signal, res)
+		}
+	}
+
+	if res := r.LookupAddr(netip.MustParseAddr("76.76.21.21")); res.Signal != SignalRange {
+		t.Errorf("Expected a range match to be signaled by range, got %+v", res)
+	}
+}
+
+func TestParseCNAMERules(t *testing.T) {
+	if defaults, err := DefaultCNAMERules(); err != nil || len(defaults) == 0 {
+		t.Errorf("Expected default cname rules, got %d rules, %v", len(defaults), err)
+	}
+	rules, err := ParseCNAMERules([]byte(`[{"suffix": "Example.TEST.", "provider": "aws", "service": "S3"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || rules[0].Suffix != "example.test" || rules[0].Provider != provider.Aws {
+		t.Errorf("Expected an Aws rule for example.test, got %+v", rules)
+	}
+
+	for _, invalid := range []string{
+		`[{"suffix": "example.test", "provider": "Aws", "category": "database"}]`,
+		`[{"suffix": "", "provider": "Aws"}]`,
+		`[{"suffix": "example.test", "provider": ""}]`,
+		`[{"suffix": "example.test", "provider": "Aws", "region": "eu-west-3"}]`,
+	} {
+		if _, err := ParseCNAMERules([]byte(invalid)); err == nil {
+			t.Errorf("Expected an error for %s", invalid)
+		}
+	}
+
+	// Nothing is registered when a rule is invalid
+	_, err = ParseCNAMERules([]byte(`[{"suffix": "valid.test", "provider": "Cnameinvalidtest"}, {"suffix": "", "provider": "Aws"}]`))
+	if err == nil {
+		t.Errorf("Expected an error for the empty suffix")
+	}
+	if p, err := provider.ParseProviderFold("Cnameinvalidtest"); err == nil {
+		t.Errorf("Expected the provider of the valid rule not to be registered, got %s", p)
+	}
+}
@@ -0,0 +1,122 @@
+package cloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+
+	"github.com/Escape-Technologies/cloudfinder/internal/source"
+	"github.com/Escape-Technologies/cloudfinder/internal/tree"
+	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
+)
+
+// CustomRange tags a prefix with a provider, see WithCustomRanges.
+// The provider can be a built-in one (to add or override ranges) or a custom one, see provider.Register.
+type CustomRange struct {
+	Provider provider.Provider
+	Prefix   netip.Prefix
+	Region   string
+	Service  string
+}
+
+// Config is the custom ranges configuration file format, eg:
+//
+//	{
+//	  "providers": [
+//	    {"name": "Corp", "service": "vpn", "category": "egress", "ranges": ["203.0.113.0/24", "2001:db8::/32"]},
+//	    {"name": "Aws", "region": "eu-west-3", "ranges": ["198.51.100.0/24"]}
+//	  ]
+//	}
+//
+// Unknown provider names are registered as custom providers. The category, when set, becomes the default category of
+// the provider (see provider.Category).
+type Config struct {
+	Providers []ConfigProvider `json:"providers"`
+}
+
+type ConfigProvider struct {
+	Name    string `json:"name"`
+	Region  string `json:"region,omitempty"`
+	Service string `json:"service,omitempty"`
+	// One of the provider.Categories
+	Category string   `json:"category,omitempty"`
+	Ranges   []string `json:"ranges"`
+}
+
+// CustomRanges registers the providers of the configuration and returns its ranges.
+func (c *Config) CustomRanges() ([]CustomRange, error) {
+	ranges := make([]CustomRange, 0)
+	for _, cp := range c.Providers {
+		p, err := provider.Register(cp.Name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid provider %q: %w", cp.Name, err)
+		}
+		if cp.Category != "" {
+			category, err := provider.ParseCategory(cp.Category)
+			if err != nil {
+				return nil, fmt.Errorf("invalid provider %s: %w", cp.Name, err)
+			}
+			provider.SetCategory(p, category)
+		}
+		for _, cidr := range cp.Ranges {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid range for provider %s: %w", cp.Name, err)
+			}
+			ranges = append(ranges, CustomRange{
+				Provider: p,
+				Prefix:   prefix.Masked(),
+				Region:   cp.Region,
+				Service:  cp.Service,
+			})
+		}
+	}
+	return ranges, nil
+}
+
+// LoadConfig reads a custom ranges configuration file (see Config), registers its providers and returns its ranges.
+func LoadConfig(path string) ([]CustomRange, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	c := &Config{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	return c.CustomRanges()
+}
+
+// newCustomTrees builds the trees of the custom ranges, nil when there are none for a family.
+func newCustomTrees(ranges []CustomRange) (tree.Tree, tree.Tree, error) {
+	var ipv4Tree, ipv6Tree tree.Tree
+	for _, cr := range ranges {
+		if !cr.Prefix.IsValid() {
+			continue
+		}
+		r := &source.IPRange{
+			Prefix:   cr.Prefix.Masked(),
+			Cat:      source.GetIPCat(cr.Prefix.Addr()),
+			Provider: cr.Provider,
+			Region:   cr.Region,
+			Service:  cr.Service,
+		}
+		var err error
+		if r.Cat == source.CatIPv4 {
+			if ipv4Tree == nil {
+				ipv4Tree = tree.NewIPv4Tree()
+			}
+			err = ipv4Tree.Add(r)
+		} else {
+			if ipv6Tree == nil {
+				ipv6Tree = tree.NewIPv6Tree()
+			}
+			err = ipv6Tree.Add(r)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to add custom range: %w", err)
+		}
+	}
+	return ipv4Tree, ipv6Tree, nil
+}
@@ -0,0 +1,88 @@
+package cloud
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
+)
+
+func TestCustomRanges(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(config, []byte(`{"providers": [
+		{"name": "Corp", "service": "vpn", "category": "egress", "ranges": ["76.76.21.128/25", "2001:db8::1/32"]},
+		{"name": "aws", "region": "eu-west-3", "ranges": ["192.0.2.0/24"]}
+	]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges, err := LoadConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corp, err := provider.ParseProviderFold("corp")
+	if err != nil || !corp.IsCustom() {
+		t.Fatalf("Expected Corp to be registered, got %s (%v)", corp, err)
+	}
+
+	r := NewResolver(WithCustomRanges(ranges...))
+
+	tests := []struct {
+		addr     string
+		provider provider.Provider
+		prefix   string
+		service  string
+		category provider.Category
+		layers   int
+	}{
+		// Custom range wins over the more generic Vercel range
+		{"76.76.21.200", corp, "76.76.21.128/25", "vpn", provider.CategoryEgress, 2},
+		{"76.76.21.21", provider.Vercel, "76.76.21.0/24", "", provider.CategoryServerless, 1},
+		{"2001:db8::42", corp, "2001:db8::/32", "vpn", provider.CategoryEgress, 1},
+		{"192.0.2.1", provider.Aws, "192.0.2.0/24", "", provider.CategoryCompute, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.addr, func(t *testing.T) {
+			res := r.LookupAddr(netip.MustParseAddr(test.addr))
+			if res.Provider != test.provider || res.Prefix.String() != test.prefix || res.Service != test.service ||
+				res.Category != test.category {
+				t.Errorf("Expected %s %s %s %s, got %+v", test.provider, test.prefix, test.service, test.category, res)
+			}
+			all := r.LookupAllAddr(netip.MustParseAddr(test.addr))
+			if len(all) != test.layers || all[0] != res {
+				t.Errorf("Expected %d layers starting with %+v, got %+v", test.layers, res, all)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	configs := map[string]string{
+		"invalid json":     `{"providers": [`,
+		"invalid range":    `{"providers": [{"name": "Corp", "ranges": ["not a cidr"]}]}`,
+		"empty name":       `{"providers": [{"name": "", "ranges": ["192.0.2.0/24"]}]}`,
+		"unknown category": `{"providers": [{"name": "Corp", "category": "vpn", "ranges": ["192.0.2.0/24"]}]}`,
+	}
+	for name, content := range configs {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name+".json")
+			if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadConfig(path); err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+}
+
+func TestNewInvalidCustomRange(t *testing.T) {
+	_, err := New(WithCustomRanges(CustomRange{Provider: provider.Aws, Prefix: netip.MustParsePrefix("::ffff:192.0.2.0/120")}))
+	if err == nil {
+		t.Errorf("Expected an error for an IPv4-mapped custom range")
+	}
+}
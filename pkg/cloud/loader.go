@@ -0,0 +1,142 @@
+package cloud
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/Escape-Technologies/cloudfinder/internal/source"
+	"github.com/Escape-Technologies/cloudfinder/internal/tree"
+)
+
+// Tree files names, as written by pre-build in internal/static
+const (
+	IPv4TreeFile = "ipv4.bin"
+	IPv6TreeFile = "ipv6.bin"
+)
+
+// NewResolverFromPath creates a resolver from range data on disk instead of the embedded snapshot. path can be:
+//   - a directory holding the trees written by pre-build (ipv4.bin and ipv6.bin, see internal/static), both trees must
+//     come from the same pre-build run
+//   - a directory of ranges files, as written by pre-build -write-ranges (<provider>.txt, see ./ranges)
+//   - a single ranges file
+func NewResolverFromPath(path string, opts ...Option) (Resolver, error) {
+	o := newOptions(opts)
+	o.logger.Debug("Loading range data from %s", path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load range data: %w", err)
+	}
+
+	if !info.IsDir() {
+		ranges, err := source.ReadRangesFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return newResolverFromRanges(ranges, o)
+	}
+
+	_, err = os.Stat(filepath.Join(path, IPv4TreeFile))
+	switch {
+	case err == nil:
+		return newResolverFromTrees(path, o)
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, fmt.Errorf("failed to load range data: %w", err)
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load range data: %w", err)
+	}
+	ranges := make([]*source.IPRange, 0)
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), source.RangesFileExt) {
+			continue
+		}
+		fileRanges, err := source.ReadRangesFile(filepath.Join(path, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, fileRanges...)
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("failed to load range data: no %s or *%s files in %s", IPv4TreeFile, source.RangesFileExt, path)
+	}
+	o.logger.Debug("Loaded %d ranges from %s", len(ranges), path)
+	return newResolverFromRanges(ranges, o)
+}
+
+func loadFlatFile(path string, cat source.IPCat) (*tree.Flat, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tree: %w", err)
+	}
+	t, err := tree.NewFlatFrom(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tree %s: %w", path, err)
+	}
+	if t.Header().Cat != cat {
+		return nil, fmt.Errorf("failed to load tree %s: expected IPv%d, got IPv%d", path, cat, t.Header().Cat)
+	}
+	return t, nil
+}
+
+func newResolverFromTrees(dir string, o *options) (Resolver, error) {
+	ipv4Tree, err := loadFlatFile(filepath.Join(dir, IPv4TreeFile), source.CatIPv4)
+	if err != nil {
+		return nil, err
+	}
+	ipv6Tree, err := loadFlatFile(filepath.Join(dir, IPv6TreeFile), source.CatIPv6)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSameBuild(ipv4Tree, ipv6Tree); err != nil {
+		return nil, fmt.Errorf("failed to load trees from %s: %w", dir, err)
+	}
+	r, err := newResolver(ipv4Tree, ipv6Tree, o)
+	if err != nil {
+		return nil, err
+	}
+	r.dataHash = flatHash(ipv4Tree)
+	return r, nil
+}
+
+// flatHash returns the hash of the ranges t was built from, in the hex form of pre-build
+func flatHash(t *tree.Flat) string {
+	hash := t.Header().Hash
+	return hex.EncodeToString(hash[:])
+}
+
+// checkSameBuild fails when the trees were not written by the same pre-build run, eg. when a tree was loaded while
+// pre-build was replacing the other one.
+func checkSameBuild(ipv4Tree, ipv6Tree *tree.Flat) error {
+	if ipv4Tree.Header().Hash != ipv6Tree.Header().Hash {
+		return fmt.Errorf("%s and %s are from different builds (hash %x and %x)", IPv4TreeFile, IPv6TreeFile,
+			ipv4Tree.Header().Hash, ipv6Tree.Header().Hash)
+	}
+	return nil
+}
+
+func newResolverFromRanges(ranges []*source.IPRange, o *options) (Resolver, error) {
+	// Same order as pre-build: for the exact same network, the provider declared first in the enum is the main range
+	slices.SortStableFunc(ranges, func(a, b *source.IPRange) int {
+		return int(a.Provider) - int(b.Provider)
+	})
+
+	ipv4Tree := tree.NewIPv4Tree()
+	ipv6Tree := tree.NewIPv6Tree()
+	for _, r := range ranges {
+		t := ipv6Tree
+		if r.Cat == source.CatIPv4 {
+			t = ipv4Tree
+		}
+		if err := t.Add(r); err != nil {
+			return nil, fmt.Errorf("failed to load range data: %w", err)
+		}
+	}
+	return newResolver(ipv4Tree, ipv6Tree, o)
+}
@@ -0,0 +1,146 @@
+package cloud
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Escape-Technologies/cloudfinder/internal/source"
+	"github.com/Escape-Technologies/cloudfinder/internal/static"
+	"github.com/Escape-Technologies/cloudfinder/internal/tree"
+	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
+)
+
+func TestNewResolverFromPath(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "vercel.txt"), []byte("# comment\n76.76.21.0/24\n\n2001:db8::/32\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "aws.txt"), []byte("76.76.0.0/16\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		addr     string
+		provider provider.Provider
+	}{
+		{"embedded trees", "../../internal/static", "76.76.21.21", provider.Vercel},
+		{"ranges dir", "../../ranges", "76.76.21.21", provider.Vercel},
+		{"custom ranges dir", dir, "76.76.21.21", provider.Vercel},
+		{"custom ranges dir (enclosing)", dir, "76.76.1.1", provider.Aws},
+		{"custom ranges dir (IPv6)", dir, "2001:db8::1", provider.Vercel},
+		{"single ranges file", filepath.Join(dir, "aws.txt"), "76.76.21.21", provider.Aws},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := NewResolverFromPath(test.path)
+			if err != nil {
+				t.Fatalf("Failed to load %s: %s", test.path, err)
+			}
+			if p := r.GetProviderForAddr(netip.MustParseAddr(test.addr)); p != test.provider {
+				t.Errorf("Expected %s for %s, got %s", test.provider, test.addr, p)
+			}
+		})
+	}
+}
+
+func TestNewResolverFromPathErrors(t *testing.T) {
+	dir := t.TempDir()
+	badProvider := filepath.Join(dir, "notaprovider.txt")
+	if err := os.WriteFile(badProvider, []byte("1.2.3.0/24\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	badRange := filepath.Join(t.TempDir(), "aws.txt")
+	if err := os.WriteFile(badRange, []byte("1.2.3.0/24\nnot a cidr\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	badTree := t.TempDir()
+	if err := os.WriteFile(filepath.Join(badTree, IPv4TreeFile), []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{
+		filepath.Join(dir, "missing"),
+		t.TempDir(),
+		badProvider,
+		badRange,
+		badTree,
+	} {
+		if _, err := NewResolverFromPath(path); err == nil {
+			t.Errorf("Expected an error for %s", path)
+		}
+	}
+}
+
+func writeFlatTree(t *testing.T, path string, prefix string, hash byte) {
+	t.Helper()
+	tr := tree.NewIPv4Tree()
+	p := netip.MustParsePrefix(prefix)
+	if p.Addr().Is6() {
+		tr = tree.NewIPv6Tree()
+	}
+	if err := tr.Add(&source.IPRange{Prefix: p, Cat: source.GetIPCat(p.Addr()), Provider: provider.Aws}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := tree.WriteFlat(f, tr, [tree.HashSize]byte{hash}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewResolverFromPathMixedBuilds(t *testing.T) {
+	dir := t.TempDir()
+	writeFlatTree(t, filepath.Join(dir, IPv4TreeFile), "192.0.2.0/24", 1)
+	writeFlatTree(t, filepath.Join(dir, IPv6TreeFile), "2001:db8::/32", 1)
+	if _, err := NewResolverFromPath(dir); err != nil {
+		t.Fatalf("Failed to load trees of the same build: %s", err)
+	}
+
+	// IPv4 tree of the next build, IPv6 tree not written yet
+	writeFlatTree(t, filepath.Join(dir, IPv4TreeFile), "198.51.100.0/24", 2)
+	if _, err := NewResolverFromPath(dir); err == nil {
+		t.Errorf("Expected an error for trees of different builds")
+	}
+}
+
+func TestDataHash(t *testing.T) {
+	dir := t.TempDir()
+	writeFlatTree(t, filepath.Join(dir, IPv4TreeFile), "192.0.2.0/24", 1)
+	writeFlatTree(t, filepath.Join(dir, IPv6TreeFile), "2001:db8::/32", 1)
+	trees, err := NewResolverFromPath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash := DataHash(trees); hash != "01"+strings.Repeat("00", tree.HashSize-1) {
+		t.Errorf("Expected the hash of the trees, got %q", hash)
+	}
+	if hash := DataHash(NewResolver()); hash != static.Hash() {
+		t.Errorf("Expected the hash of the embedded data %q, got %q", static.Hash(), hash)
+	}
+	reloadable, err := NewReloadableResolverFromPath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash := DataHash(reloadable); hash != DataHash(trees) {
+		t.Errorf("Expected the hash of the loaded trees, got %q", hash)
+	}
+	ranges, err := NewResolverFromPath("../../ranges")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash := DataHash(ranges); hash != "" {
+		t.Errorf("Expected no hash for ranges files, got %q", hash)
+	}
+}
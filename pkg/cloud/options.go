@@ -0,0 +1,57 @@
+package cloud
+
+import (
+	"log/slog"
+
+	"github.com/Escape-Technologies/cloudfinder/internal/log"
+)
+
+// Option configures a resolver, see NewResolver and NewResolverFromPath.
+type Option func(o *options)
+
+type options struct {
+	customRanges []CustomRange
+	asnDataPath  string
+	cnameRules   []CNAMERule
+	logger       *log.Scoped
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{logger: log.Discard}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithCustomRanges adds ranges on top of the provider data. Custom ranges take priority over the provider data,
+// even when a provider range is more specific. Invalid prefixes are ignored.
+func WithCustomRanges(ranges ...CustomRange) Option {
+	return func(o *options) {
+		o.customRanges = append(o.customRanges, ranges...)
+	}
+}
+
+// WithASNData loads the prefix to origin AS dataset at path, written by pre-build -write-asn (gzip compressed when
+// the name ends with .gz), for LookupASN. Without it, LookupASN never matches.
+func WithASNData(path string) Option {
+	return func(o *options) {
+		o.asnDataPath = path
+	}
+}
+
+// WithCNAMERules adds rules for LookupCNAME on top of the default ones (see DefaultCNAMERules). Custom rules take
+// priority over the default ones, even when a default rule is more specific.
+func WithCNAMERules(rules ...CNAMERule) Option {
+	return func(o *options) {
+		o.cnameRules = append(o.cnameRules, rules...)
+	}
+}
+
+// WithLogger sets the logger of the resolver. By default, resolvers do not log.
+// Each resolver has its own logger, the logs of other resolvers and of the application are left untouched.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = log.NewScoped(logger)
+	}
+}
@@ -0,0 +1,103 @@
+package cloud
+
+import (
+	"net/netip"
+
+	"github.com/Escape-Technologies/cloudfinder/internal/source"
+	"github.com/Escape-Technologies/cloudfinder/internal/tree"
+)
+
+// Block is a part of a looked up prefix whose addresses all have the same match, see LookupPrefix.
+type Block struct {
+	Prefix netip.Prefix
+	// The match of every address of the block, its Prefix is the matched range
+	Result Result
+}
+
+func (f *resolver) LookupPrefix(prefix netip.Prefix) []Block {
+	if !prefix.IsValid() {
+		return nil
+	}
+	// IPv4-mapped prefixes are looked up as IPv4, like addresses
+	if prefix.Addr().Is4In6() {
+		if prefix.Bits() < 96 { // nolint:mnd
+			return nil
+		}
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96) // nolint:mnd
+	}
+	prefix = prefix.Masked()
+
+	t, custom, family := f.treeFor(prefix.Addr())
+	b := blocks{main: t, custom: custom, family: family, out: make([]Block, 0)}
+	var customInner []source.IPRange
+	if custom != nil {
+		customInner = custom.FindIPRangesWithin(prefix)
+	}
+	b.split(prefix, t.FindIPRangesWithin(prefix), customInner)
+	return b.out
+}
+
+// blocks splits a prefix in halves until each half has a single match
+type blocks struct {
+	main, custom tree.Reader
+	family       IPFamily
+	out          []Block
+}
+
+// split appends the blocks of prefix, inner and customInner are the ranges of the trees more specific than prefix
+func (b *blocks) split(prefix netip.Prefix, inner, customInner []source.IPRange) {
+	// Custom ranges take priority: the ranges of the main tree do not matter under a custom one
+	customRange, customFound := covering(b.custom, prefix)
+	if len(customInner) == 0 && (customFound || len(inner) == 0) {
+		if customFound {
+			b.out = append(b.out, Block{Prefix: prefix, Result: newResult(b.family, customRange, true)})
+			return
+		}
+		r, found := covering(b.main, prefix)
+		b.out = append(b.out, Block{Prefix: prefix, Result: newResult(b.family, r, found)})
+		return
+	}
+
+	// A more specific range is inside, so prefix is not a single address
+	low := netip.PrefixFrom(prefix.Addr(), prefix.Bits()+1)
+	high := netip.PrefixFrom(setBit(prefix.Addr(), prefix.Bits()), prefix.Bits()+1)
+	for _, half := range []netip.Prefix{low, high} {
+		b.split(half, within(inner, half), within(customInner, half))
+	}
+}
+
+// covering returns the most specific range of t containing the whole prefix
+func covering(t tree.Reader, prefix netip.Prefix) (source.IPRange, bool) {
+	if t == nil {
+		return source.IPRange{}, false
+	}
+	for _, r := range t.FindAllIPRanges(prefix.Addr()) {
+		if r.Prefix.Bits() <= prefix.Bits() {
+			return r, true
+		}
+	}
+	return source.IPRange{}, false
+}
+
+// within returns the ranges inside prefix and more specific than it
+func within(ranges []source.IPRange, prefix netip.Prefix) []source.IPRange {
+	inside := make([]source.IPRange, 0, len(ranges))
+	for _, r := range ranges {
+		if r.Prefix.Bits() > prefix.Bits() && prefix.Contains(r.Prefix.Addr()) {
+			inside = append(inside, r)
+		}
+	}
+	return inside
+}
+
+// setBit sets the bit at index (from the most significant one) of addr
+func setBit(addr netip.Addr, index int) netip.Addr {
+	if addr.Is4() {
+		b := addr.As4()
+		b[index/8] |= 0x80 >> (index % 8) // nolint:mnd
+		return netip.AddrFrom4(b)
+	}
+	b := addr.As16()
+	b[index/8] |= 0x80 >> (index % 8) // nolint:mnd
+	return netip.AddrFrom16(b)
+}
@@ -0,0 +1,94 @@
+package cloud
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
+)
+
+func TestLookupPrefix(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "vercel.txt"), []byte("76.76.21.0/24\n2001:db8::/32\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "aws.txt"), []byte("76.76.0.0/16\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corp, err := provider.Register("PrefixCorp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewResolverFromPath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	custom, err := NewResolverFromPath(dir, WithCustomRanges(
+		CustomRange{Provider: corp, Prefix: netip.MustParsePrefix("76.76.21.128/25")},
+		CustomRange{Provider: corp, Prefix: netip.MustParsePrefix("76.76.32.0/19")},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		resolver Resolver
+		prefix   string
+		expected []string
+	}{
+		{r, "76.76.20.0/22", []string{"76.76.20.0/24 Aws", "76.76.21.0/24 Vercel", "76.76.22.0/23 Aws"}},
+		{r, "76.76.21.0/24", []string{"76.76.21.0/24 Vercel"}},
+		{r, "76.76.21.7/32", []string{"76.76.21.7/32 Vercel"}},
+		{r, "::ffff:76.76.21.0/120", []string{"76.76.21.0/24 Vercel"}},
+		// Not masked
+		{r, "76.76.21.7/23", []string{"76.76.20.0/24 Aws", "76.76.21.0/24 Vercel"}},
+		{r, "76.77.0.0/16", []string{"76.77.0.0/16 Unknown"}},
+		{r, "2001:db8::/31", []string{"2001:db8::/32 Vercel", "2001:db9::/32 Unknown"}},
+		{custom, "76.76.20.0/22", []string{"76.76.20.0/24 Aws", "76.76.21.0/25 Vercel", "76.76.21.128/25 PrefixCorp",
+			"76.76.22.0/23 Aws"}},
+		// Custom ranges win over more specific provider ranges
+		{custom, "76.76.32.0/20", []string{"76.76.32.0/20 PrefixCorp"}},
+	}
+	for _, test := range tests {
+		got := make([]string, 0)
+		for _, b := range test.resolver.LookupPrefix(netip.MustParsePrefix(test.prefix)) {
+			got = append(got, b.Prefix.String()+" "+b.Result.Provider.String())
+		}
+		if !slices.Equal(got, test.expected) {
+			t.Errorf("Expected %s to be split in %v, got %v", test.prefix, test.expected, got)
+		}
+	}
+
+	// The blocks cover the whole prefix, in order
+	blocks := r.LookupPrefix(netip.MustParsePrefix("76.76.0.0/15"))
+	next := netip.MustParseAddr("76.76.0.0")
+	for _, b := range blocks {
+		if b.Prefix.Addr() != next {
+			t.Fatalf("Expected a block starting at %s, got %s", next, b.Prefix)
+		}
+		if b.Result.Provider != provider.Unknown && (b.Result.Signal != SignalRange || !b.Result.Prefix.IsValid()) {
+			t.Errorf("Expected %s to be matched by a range, got %+v", b.Prefix, b.Result)
+		}
+		next = lastAddr(b.Prefix).Next()
+	}
+	if next != netip.MustParseAddr("76.78.0.0") {
+		t.Errorf("Expected the blocks to end at 76.77.255.255, got %s", next.Prev())
+	}
+
+	if blocks := r.LookupPrefix(netip.Prefix{}); blocks != nil {
+		t.Errorf("Expected no blocks for an invalid prefix, got %v", blocks)
+	}
+}
+
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Addr().As4()
+	for i := p.Bits(); i < 32; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	return netip.AddrFrom4(b)
+}
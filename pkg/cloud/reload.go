@@ -0,0 +1,201 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/Escape-Technologies/cloudfinder/internal/log"
+	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
+)
+
+// Loader creates the resolver used by a ReloadableResolver, it is called on each reload.
+type Loader func() (Resolver, error)
+
+// ReloadableResolver is a Resolver whose range data can be replaced while it is in use.
+//
+// It is safe for concurrent use: lookups can run from any number of goroutines while Reload or Watch swap the data.
+// The IPv4 and IPv6 data are swapped together, a lookup sees either the old or the new data, never a mix of both.
+// Lookups never block and keep the netip.Addr based methods allocation free.
+// A failed reload keeps the previous data.
+type ReloadableResolver struct {
+	load    Loader
+	current atomic.Pointer[loaded]
+	// Logger of Watch, replaced by WithLogger while Watch runs
+	logger atomic.Pointer[log.Scoped]
+}
+
+// loaded boxes the Resolver interface so that it can be stored in an atomic.Pointer
+type loaded struct {
+	Resolver
+}
+
+// NewReloadableResolver calls load once and returns a resolver that calls it again on each reload.
+// Only the WithLogger option applies, for the logs of Watch.
+func NewReloadableResolver(load Loader, opts ...Option) (*ReloadableResolver, error) {
+	r := &ReloadableResolver{load: load}
+	r.logger.Store(newOptions(opts).logger)
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// NewReloadableResolverFromPath creates a ReloadableResolver that loads the range data of path, see NewResolverFromPath.
+// Use Watch to reload it when the data on disk changes.
+func NewReloadableResolverFromPath(path string, opts ...Option) (*ReloadableResolver, error) {
+	return NewReloadableResolver(func() (Resolver, error) {
+		return NewResolverFromPath(path, opts...)
+	}, opts...)
+}
+
+// Reload loads new data and swaps it in. On error, the previous data is kept.
+// Concurrent calls are safe, the last one to finish wins.
+func (r *ReloadableResolver) Reload() error {
+	res, err := r.load()
+	if err != nil {
+		return fmt.Errorf("failed to reload resolver: %w", err)
+	}
+	if res == nil {
+		return errors.New("failed to reload resolver: loader returned no resolver")
+	}
+	r.current.Store(&loaded{res})
+	return nil
+}
+
+// Watch starts polling path every interval in the background, and reloads when it changes (modification time or size
+// of the file, or of any file directly in the directory) after Watch returns. Polling stops when ctx is done.
+// Reload errors are logged and the previous data is kept, the next change triggers a new attempt. Eg. when only one of
+// the trees of a new pre-build run was written, the trees are from different builds and the reload waits for the other.
+func (r *ReloadableResolver) Watch(ctx context.Context, path string, interval time.Duration) {
+	last, err := fingerprint(path)
+	if err != nil {
+		r.logger.Load().Warning("Failed to watch "+path, err)
+	}
+	go r.watch(ctx, path, interval, last)
+}
+
+func (r *ReloadableResolver) watch(ctx context.Context, path string, interval time.Duration, last dataFingerprint) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current, err := fingerprint(path)
+		if err != nil {
+			r.logger.Load().Warning("Failed to watch "+path, err)
+			continue
+		}
+		if current == last {
+			continue
+		}
+		last = current
+
+		if err := r.Reload(); err != nil {
+			r.logger.Load().Warning("Keeping previous range data", err)
+			continue
+		}
+		r.logger.Load().Debug("Reloaded range data from %s", path)
+	}
+}
+
+// dataFingerprint changes when the watched data changes
+type dataFingerprint struct {
+	modTime time.Time
+	size    int64
+	files   int
+}
+
+func fingerprint(path string) (dataFingerprint, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return dataFingerprint{}, err
+	}
+	fp := dataFingerprint{modTime: info.ModTime(), size: info.Size(), files: 1}
+	if !info.IsDir() {
+		return fp, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return dataFingerprint{}, err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			// Removed since ReadDir, the directory modification time changed anyway
+			continue
+		}
+		fp.files++
+		fp.size += info.Size()
+		if info.ModTime().After(fp.modTime) {
+			fp.modTime = info.ModTime()
+		}
+	}
+	return fp, nil
+}
+
+func (r *ReloadableResolver) resolver() Resolver {
+	return r.current.Load().Resolver
+}
+
+func (r *ReloadableResolver) Lookup(ip net.IP) Result {
+	return r.resolver().Lookup(ip)
+}
+
+func (r *ReloadableResolver) LookupAddr(addr netip.Addr) Result {
+	return r.resolver().LookupAddr(addr)
+}
+
+func (r *ReloadableResolver) LookupAll(ip net.IP) []Result {
+	return r.resolver().LookupAll(ip)
+}
+
+func (r *ReloadableResolver) LookupAllAddr(addr netip.Addr) []Result {
+	return r.resolver().LookupAllAddr(addr)
+}
+
+func (r *ReloadableResolver) LookupPrefix(prefix netip.Prefix) []Block {
+	return r.resolver().LookupPrefix(prefix)
+}
+
+func (r *ReloadableResolver) GetProviderForIP(ip net.IP) provider.Provider {
+	return r.resolver().GetProviderForIP(ip)
+}
+
+func (r *ReloadableResolver) GetProviderForAddr(addr netip.Addr) provider.Provider {
+	return r.resolver().GetProviderForAddr(addr)
+}
+
+func (r *ReloadableResolver) LookupASN(ip net.IP) ASN {
+	return r.resolver().LookupASN(ip)
+}
+
+func (r *ReloadableResolver) LookupASNAddr(addr netip.Addr) ASN {
+	return r.resolver().LookupASNAddr(addr)
+}
+
+func (r *ReloadableResolver) LookupCNAME(chain []string) Result {
+	return r.resolver().LookupCNAME(chain)
+}
+
+// WithLogger replaces the logger of Watch, it is safe to call while Watch runs. The logs of the Loader are left
+// untouched.
+//
+// Deprecated: use the WithLogger option.
+func (r *ReloadableResolver) WithLogger(logger *slog.Logger) {
+	r.logger.Store(log.NewScoped(logger))
+}
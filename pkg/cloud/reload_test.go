@@ -0,0 +1,168 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
+)
+
+func writeRanges(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadableResolver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aws.txt")
+	writeRanges(t, path, "192.0.2.0/24\n2001:db8::/32\n")
+
+	r, err := NewReloadableResolverFromPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := netip.MustParseAddr("192.0.2.1")
+	if p := r.GetProviderForAddr(addr); p != provider.Aws {
+		t.Errorf("Expected Aws, got %s", p)
+	}
+
+	writeRanges(t, path, "198.51.100.0/24\n")
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if p := r.GetProviderForAddr(addr); p != provider.Unknown {
+		t.Errorf("Expected Unknown after reload, got %s", p)
+	}
+
+	// A failed reload keeps the previous data
+	writeRanges(t, path, "not a cidr\n")
+	if err := r.Reload(); err == nil {
+		t.Errorf("Expected an error")
+	}
+	if p := r.GetProviderForAddr(netip.MustParseAddr("198.51.100.1")); p != provider.Aws {
+		t.Errorf("Expected Aws after failed reload, got %s", p)
+	}
+
+	if _, err := NewReloadableResolverFromPath(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("Expected an error for missing data")
+	}
+}
+
+func TestReloadableResolverConcurrent(t *testing.T) {
+	// Each generation has the same provider for both families
+	generations := make([]Resolver, 0, 2)
+	for _, p := range []provider.Provider{provider.Aws, provider.Gcp} {
+		g, err := newResolverFromRanges(nil, newOptions([]Option{WithCustomRanges(
+			CustomRange{Provider: p, Prefix: netip.MustParsePrefix("192.0.2.0/24")},
+			CustomRange{Provider: p, Prefix: netip.MustParsePrefix("2001:db8::/32")},
+		)}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		generations = append(generations, g)
+	}
+	var mu sync.Mutex
+	calls := 0
+	r, err := NewReloadableResolver(func() (Resolver, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		return generations[calls%2], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v4 := netip.MustParseAddr("192.0.2.1")
+	v6 := netip.MustParseAddr("2001:db8::1")
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// Both families of a snapshot come from the same generation: Aws for both or Gcp for both
+				current := r.resolver()
+				p4, p6 := current.GetProviderForAddr(v4), current.GetProviderForAddr(v6)
+				if p4 != p6 || (p4 != provider.Aws && p4 != provider.Gcp) {
+					t.Errorf("Expected the IPv4 and IPv6 data of the same generation, got %s and %s", p4, p6)
+				}
+				if p := r.LookupAllAddr(v6); len(p) != 1 {
+					t.Errorf("Expected 1 layer, got %d", len(p))
+				}
+			}
+		}()
+	}
+	for range 100 {
+		if err := r.Reload(); err != nil {
+			t.Error(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestReloadableResolverWatch(t *testing.T) {
+	dir := t.TempDir()
+	writeRanges(t, filepath.Join(dir, "aws.txt"), "192.0.2.0/24\n")
+	r, err := NewReloadableResolverFromPath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.Watch(ctx, dir, 10*time.Millisecond)
+
+	writeRanges(t, filepath.Join(dir, "gcp.txt"), "192.0.2.128/25\n")
+	addr := netip.MustParseAddr("192.0.2.200")
+	deadline := time.Now().Add(5 * time.Second)
+	for r.GetProviderForAddr(addr) != provider.Gcp {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the watcher to reload the new ranges")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReloadableResolverNilLoader(t *testing.T) {
+	errLoad := errors.New("load")
+	if _, err := NewReloadableResolver(func() (Resolver, error) { return nil, errLoad }); !errors.Is(err, errLoad) {
+		t.Errorf("Expected %v, got %v", errLoad, err)
+	}
+	if _, err := NewReloadableResolver(func() (Resolver, error) { return nil, nil }); err == nil {
+		t.Errorf("Expected an error for a nil resolver")
+	}
+}
+
+func TestReloadableResolverWithLoggerWhileWatching(t *testing.T) {
+	dir := t.TempDir()
+	writeRanges(t, filepath.Join(dir, "aws.txt"), "192.0.2.0/24\n")
+	r, err := NewReloadableResolverFromPath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.Watch(ctx, dir, time.Millisecond)
+
+	for range 100 {
+		r.WithLogger(slog.New(slog.DiscardHandler))
+		time.Sleep(100 * time.Microsecond)
+	}
+}
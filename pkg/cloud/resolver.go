@@ -1,48 +1,299 @@
 package cloud
 
 import (
+	"errors"
+	"fmt"
 	"log/slog"
 	"net"
+	"net/netip"
+	"strconv"
 
+	"github.com/Escape-Technologies/cloudfinder/internal/asn"
 	"github.com/Escape-Technologies/cloudfinder/internal/log"
+	"github.com/Escape-Technologies/cloudfinder/internal/source"
 	"github.com/Escape-Technologies/cloudfinder/internal/static"
 	"github.com/Escape-Technologies/cloudfinder/internal/tree"
 	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
 )
 
+// Resolver finds the provider of ips. The netip.Addr based methods do not allocate, except LookupAllAddr for the
+// returned slice. IPv4-mapped IPv6 addresses (::ffff:1.2.3.4) are looked up as IPv4.
+//
+// Lookups are safe for concurrent use: the range data of a resolver never changes once it is created.
+// Use a ReloadableResolver to replace the data of a long running process.
+//
+// Resolver is only implemented by this package, and may gain methods in any release (see CHANGELOG.md). Types
+// implementing it elsewhere, eg. test doubles, should embed a Resolver and only override the methods they need.
 type Resolver interface {
+	// Lookup returns the provider and the matching range for the given ip.
+	Lookup(ip net.IP) Result
+	LookupAddr(addr netip.Addr) Result
+	// LookupAll returns every range containing the given ip, from the most to the least specific.
+	// An ip can belong to several providers, eg. a CDN hosted on a cloud provider.
+	// Returns an empty slice when no range matches.
+	LookupAll(ip net.IP) []Result
+	LookupAllAddr(addr netip.Addr) []Result
+	// LookupPrefix splits prefix into the largest blocks whose addresses all have the same most specific match, in
+	// address order, eg. to find which parts of a /16 are Aws without looking up each address. Blocks without range
+	// have provider.Unknown. Returns nil for an invalid prefix.
+	LookupPrefix(prefix netip.Prefix) []Block
 	GetProviderForIP(ip net.IP) provider.Provider
+	GetProviderForAddr(addr netip.Addr) provider.Provider
+	// LookupASN returns the origin AS of the most specific announced prefix containing the given ip, from the dataset
+	// of the WithASNData option. Returns the zero ASN when no prefix matches or when there is no dataset.
+	LookupASN(ip net.IP) ASN
+	LookupASNAddr(addr netip.Addr) ASN
+	// LookupCNAME returns the provider of the first name of a CNAME chain (see dns.Resolver.LookupCNAMEChain)
+	// matching a CNAME rule, the most specific rule first. Custom rules (see WithCNAMERules) take priority over the
+	// default ones. The Signal of the result is SignalCNAME, its Prefix and Family are not set. Returns
+	// provider.Unknown when no name matches.
+	LookupCNAME(chain []string) Result
+	// WithLogger has no effect on the resolvers of New and NewResolverFromPath: they only log while loading, with the
+	// logger of the WithLogger option, and only warn on logger that it is unused. ReloadableResolver.WithLogger
+	// replaces the logger of Watch.
+	//
+	// Deprecated: use the WithLogger option.
 	WithLogger(logger *slog.Logger)
 }
 
+// IPFamily is the address family of a looked up ip.
+type IPFamily int
+
+const (
+	IPv4 IPFamily = 4
+	IPv6 IPFamily = 6
+)
+
+// Result describes the match for a single ip.
+type Result struct {
+	Provider provider.Provider
+	// The matched prefix, invalid (zero value) when no range matches (Provider is then provider.Unknown).
+	Prefix netip.Prefix
+	Family IPFamily
+	// Region and service of the matched range, as published by the provider. Empty when unknown.
+	Region  string
+	Service string
+	// Kind of infrastructure of the matched range, from its service or its provider (see provider.ServiceCategory).
+	// provider.CategoryUnknown when no range matches or the provider is not classified.
+	Category provider.Category
+	// What decided the provider: SignalRange for the results of ip lookups, SignalCNAME for LookupCNAME. SignalNone
+	// when nothing matched.
+	Signal Signal
+	// Name of the CNAME chain matching a CNAME rule, empty unless Signal is SignalCNAME
+	CNAME string
+}
+
+// Network returns the matched prefix as a *net.IPNet, nil when no range matches.
+func (r Result) Network() *net.IPNet {
+	if !r.Prefix.IsValid() {
+		return nil
+	}
+	return &net.IPNet{
+		IP:   r.Prefix.Addr().AsSlice(),
+		Mask: net.CIDRMask(r.Prefix.Bits(), r.Prefix.Addr().BitLen()),
+	}
+}
+
+// ASN is the origin AS of an ip, as announced in BGP.
+type ASN struct {
+	// AS number, 0 when unknown
+	Number uint32
+	// Name of the AS, eg. CLOUDFLARENET. Empty when the dataset has no name for it.
+	Name string
+	// The announced prefix containing the ip
+	Prefix netip.Prefix
+}
+
+// String returns the AS number with the AS prefix, eg. AS13335, empty when unknown.
+func (a ASN) String() string {
+	if a.Number == 0 {
+		return ""
+	}
+	return "AS" + strconv.FormatUint(uint64(a.Number), 10)
+}
+
 type resolver struct {
-	ipv4Tree tree.Tree
-	ipv6Tree tree.Tree
+	ipv4Tree tree.Reader
+	ipv6Tree tree.Reader
+	// Trees of the custom ranges (see WithCustomRanges), searched first. nil when there are none.
+	customIPv4Tree tree.Reader
+	customIPv6Tree tree.Reader
+	// Prefix to origin AS dataset (see WithASNData), nil when there is none
+	asnTable *asn.Table
+	// Rules of WithCNAMERules, searched before the default ones
+	customCNAMERules  cnameRules
+	defaultCNAMERules cnameRules
+	// Hash of the ranges the trees were built from (see internal/static/hash.txt), empty for ranges files
+	dataHash string
+}
+
+// New creates a resolver from the range data embedded at build time.
+// Fails if the embedded data is corrupted or if the options are invalid.
+func New(opts ...Option) (Resolver, error) {
+	ipv4Tree, err := static.LoadIPv4Tree()
+	if err != nil {
+		return nil, err
+	}
+	ipv6Tree, err := static.LoadIPv6Tree()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSameBuild(ipv4Tree, ipv6Tree); err != nil {
+		return nil, fmt.Errorf("failed to load embedded trees: %w", err)
+	}
+	r, err := newResolver(ipv4Tree, ipv6Tree, newOptions(opts))
+	if err != nil {
+		return nil, err
+	}
+	r.dataHash = flatHash(ipv4Tree)
+	return r, nil
+}
+
+// NewResolver is like New, but panics on error. The embedded data is checked when it is built, use New to handle
+// errors, eg. from custom ranges.
+func NewResolver(opts ...Option) Resolver {
+	r, err := New(opts...)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func newResolver(ipv4Tree, ipv6Tree tree.Reader, o *options) (*resolver, error) {
+	defaultRules, err := loadDefaultCNAMERules()
+	if err != nil {
+		return nil, err
+	}
+	r := &resolver{
+		ipv4Tree:          ipv4Tree,
+		ipv6Tree:          ipv6Tree,
+		customCNAMERules:  newCNAMERules(o.cnameRules),
+		defaultCNAMERules: newCNAMERules(defaultRules),
+	}
+	customIPv4Tree, customIPv6Tree, err := newCustomTrees(o.customRanges)
+	if err != nil {
+		return nil, err
+	}
+	// Only set non nil trees, a nil tree.Tree would not be a nil tree.Reader
+	if customIPv4Tree != nil {
+		r.customIPv4Tree = customIPv4Tree
+	}
+	if customIPv6Tree != nil {
+		r.customIPv6Tree = customIPv6Tree
+	}
+	if o.asnDataPath != "" {
+		table, err := asn.Load(o.asnDataPath)
+		if err != nil {
+			return nil, err
+		}
+		r.asnTable = table
+	}
+	return r, nil
 }
 
-func NewResolver() Resolver {
-	return &resolver{
-		ipv4Tree: static.LoadIPv4Tree(),
-		ipv6Tree: static.LoadIPv6Tree(),
+// DataHash returns the hash of the range data r was built from, as written by pre-build: the embedded data or the trees
+// of NewResolverFromPath, the data currently loaded for a ReloadableResolver. Empty when the data comes from ranges
+// files, or when r was not created by this package.
+func DataHash(r Resolver) string {
+	switch r := r.(type) {
+	case *resolver:
+		return r.dataHash
+	case *ReloadableResolver:
+		return DataHash(r.resolver())
 	}
+	return ""
 }
 
+// WithLogger has no effect, lookups do not log. It warns on logger, so that callers know their logger is unused.
+//
+// Deprecated: use the WithLogger option, for the logs of New and NewResolverFromPath.
 func (f *resolver) WithLogger(logger *slog.Logger) {
-	log.Logger = logger
+	log.NewScoped(logger).Warning("Resolver.WithLogger has no effect", errors.New("use the cloud.WithLogger option"))
 }
 
-func (f *resolver) GetProviderForIP(ip net.IP) provider.Provider {
-	if ipv4 := ip.To4(); ipv4 != nil {
-		ipRange := f.ipv4Tree.FindIPRange(ip)
-		if ipRange == nil {
-			return provider.Unknown
+// toAddr converts a net.IP, the invalid Addr is returned for invalid ips and never matches.
+func toAddr(ip net.IP) netip.Addr {
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr.Unmap()
+}
+
+func newResult(family IPFamily, ipRange source.IPRange, found bool) Result {
+	result := Result{Provider: provider.Unknown, Family: family}
+	if found {
+		result.Provider = ipRange.Provider
+		result.Prefix = ipRange.Prefix
+		result.Region = ipRange.Region
+		result.Service = ipRange.Service
+		result.Category = provider.ServiceCategory(ipRange.Provider, ipRange.Service)
+		result.Signal = SignalRange
+	}
+	return result
+}
+
+// treeFor returns the trees to search (custom one may be nil) and the family of addr
+func (f *resolver) treeFor(addr netip.Addr) (tree.Reader, tree.Reader, IPFamily) {
+	if addr.Unmap().Is4() {
+		return f.ipv4Tree, f.customIPv4Tree, IPv4
+	}
+	return f.ipv6Tree, f.customIPv6Tree, IPv6
+}
+
+func (f *resolver) Lookup(ip net.IP) Result {
+	return f.LookupAddr(toAddr(ip))
+}
+
+func (f *resolver) LookupAddr(addr netip.Addr) Result {
+	t, custom, family := f.treeFor(addr)
+	if custom != nil {
+		if r, found := custom.FindIPRange(addr); found {
+			return newResult(family, r, true)
 		}
-		return ipRange.Provider
 	}
+	r, found := t.FindIPRange(addr)
+	return newResult(family, r, found)
+}
+
+func (f *resolver) LookupAll(ip net.IP) []Result {
+	return f.LookupAllAddr(toAddr(ip))
+}
+
+func (f *resolver) LookupAllAddr(addr netip.Addr) []Result {
+	t, custom, family := f.treeFor(addr)
+	ranges := t.FindAllIPRanges(addr)
+	if custom != nil {
+		// Custom ranges are listed first, as they take priority
+		ranges = append(custom.FindAllIPRanges(addr), ranges...)
+	}
+	results := make([]Result, 0, len(ranges))
+	for _, r := range ranges {
+		results = append(results, newResult(family, r, true))
+	}
+	return results
+}
+
+func (f *resolver) GetProviderForIP(ip net.IP) provider.Provider {
+	return f.Lookup(ip).Provider
+}
 
-	ipRange := f.ipv6Tree.FindIPRange(ip.To16())
-	if ipRange == nil {
-		return provider.Unknown
+func (f *resolver) GetProviderForAddr(addr netip.Addr) provider.Provider {
+	return f.LookupAddr(addr).Provider
+}
+
+func (f *resolver) LookupASN(ip net.IP) ASN {
+	return f.LookupASNAddr(toAddr(ip))
+}
+
+func (f *resolver) LookupASNAddr(addr netip.Addr) ASN {
+	if f.asnTable == nil {
+		return ASN{}
 	}
-	return ipRange.Provider
+	number, prefix, found := f.asnTable.Lookup(addr)
+	if !found {
+		return ASN{}
+	}
+	return ASN{Number: number, Name: f.asnTable.Name(number), Prefix: prefix}
+}
+
+func (f *resolver) LookupCNAME(chain []string) Result {
+	return lookupCNAME(f.customCNAMERules, f.defaultCNAMERules, chain)
 }
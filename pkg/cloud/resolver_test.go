@@ -0,0 +1,146 @@
+package cloud
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Escape-Technologies/cloudfinder/internal/asn"
+	"github.com/Escape-Technologies/cloudfinder/internal/log"
+	"github.com/Escape-Technologies/cloudfinder/pkg/provider"
+)
+
+func TestLookup(t *testing.T) {
+	r := NewResolver()
+
+	tests := []struct {
+		ip       string
+		provider provider.Provider
+		network  string
+		family   IPFamily
+	}{
+		{"76.76.21.21", provider.Vercel, "76.76.21.0/24", IPv4},
+		{"::ffff:76.76.21.21", provider.Vercel, "76.76.21.0/24", IPv4},
+		{"104.16.1.1", provider.Cloudflare, "104.16.0.0/13", IPv4},
+		{"2606:4700::1", provider.Cloudflare, "2606:4700::/32", IPv6},
+		{"127.0.0.1", provider.Unknown, "", IPv4},
+		{"::1", provider.Unknown, "", IPv6},
+	}
+
+	for _, test := range tests {
+		t.Run(test.ip, func(t *testing.T) {
+			result := r.Lookup(net.ParseIP(test.ip))
+			if result.Provider != test.provider {
+				t.Errorf("Expected provider %s, got %s", test.provider, result.Provider)
+			}
+			if result.Family != test.family {
+				t.Errorf("Expected family %d, got %d", test.family, result.Family)
+			}
+			if test.network == "" && (result.Prefix.IsValid() || result.Network() != nil) {
+				t.Errorf("Expected no network, got %s", result.Prefix)
+			}
+			if test.network != "" && (result.Prefix.String() != test.network || result.Network().String() != test.network) {
+				t.Errorf("Expected network %s, got %s", test.network, result.Prefix)
+			}
+			if p := r.GetProviderForIP(net.ParseIP(test.ip)); p != result.Provider {
+				t.Errorf("GetProviderForIP and Lookup disagree: %s != %s", p, result.Provider)
+			}
+			if addrResult := r.LookupAddr(netip.MustParseAddr(test.ip)); addrResult != result {
+				t.Errorf("LookupAddr and Lookup disagree: %+v != %+v", addrResult, result)
+			}
+
+			all := r.LookupAll(net.ParseIP(test.ip))
+			if test.network == "" && len(all) != 0 {
+				t.Errorf("Expected no layers, got %d", len(all))
+			}
+			if test.network != "" && (len(all) == 0 || all[0].Prefix.String() != test.network) {
+				t.Errorf("Expected most specific layer to be %s, got %+v", test.network, all)
+			}
+		})
+	}
+}
+
+func TestLookupAddrDoesNotAllocate(t *testing.T) {
+	r := NewResolver()
+	addrs := []netip.Addr{
+		netip.MustParseAddr("76.76.21.21"),
+		netip.MustParseAddr("2606:4700::1"),
+		netip.MustParseAddr("127.0.0.1"),
+	}
+	allocs := testing.AllocsPerRun(1000, func() {
+		for _, addr := range addrs {
+			r.LookupAddr(addr)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("Expected no allocation, got %f", allocs)
+	}
+}
+
+func TestLookupASN(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "asn.txt.gz")
+	entries := []asn.Entry{
+		{Prefix: netip.MustParsePrefix("104.16.0.0/13"), ASN: 13335},
+		{Prefix: netip.MustParsePrefix("2600:1f00::/24"), ASN: 16509},
+	}
+	if err := asn.WriteFile(path, entries, map[uint32]string{13335: "CLOUDFLARENET"}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := New(WithASNData(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip   string
+		asn  ASN
+		name string
+	}{
+		{"104.16.1.1", ASN{13335, "CLOUDFLARENET", netip.MustParsePrefix("104.16.0.0/13")}, "AS13335"},
+		{"2600:1f00::1", ASN{16509, "", netip.MustParsePrefix("2600:1f00::/24")}, "AS16509"},
+		{"127.0.0.1", ASN{}, ""},
+	}
+	for _, test := range tests {
+		if got := r.LookupASN(net.ParseIP(test.ip)); got != test.asn || got.String() != test.name {
+			t.Errorf("Expected %s to be announced by %+v, got %+v", test.ip, test.asn, got)
+		}
+	}
+
+	// Without dataset, nothing matches
+	if got := NewResolver().LookupASNAddr(netip.MustParseAddr("104.16.1.1")); got != (ASN{}) {
+		t.Errorf("Expected no ASN without dataset, got %+v", got)
+	}
+	if _, err := New(WithASNData(filepath.Join(t.TempDir(), "missing.txt"))); err == nil {
+		t.Errorf("Expected an error for a missing dataset")
+	}
+}
+
+func TestWithLogger(t *testing.T) {
+	global := log.Logger
+	buffers := []*bytes.Buffer{{}, {}}
+	for _, b := range buffers {
+		logger := slog.New(slog.NewTextHandler(b, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		if _, err := NewResolverFromPath("../../ranges", WithLogger(logger)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, b := range buffers {
+		if strings.Count(b.String(), "Loading range data") != 1 {
+			t.Errorf("Expected resolver %d to log once to its own logger, got %q", i, b.String())
+		}
+	}
+	if log.Logger != global {
+		t.Errorf("Expected the global logger to be left untouched")
+	}
+
+	// The deprecated method has no effect, but tells so
+	b := &bytes.Buffer{}
+	NewResolver().WithLogger(slog.New(slog.NewTextHandler(b, nil)))
+	if !strings.Contains(b.String(), "WithLogger option") {
+		t.Errorf("Expected a warning pointing to the WithLogger option, got %q", b.String())
+	}
+}
@@ -0,0 +1,170 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// Read for the nameservers of the system when no server is configured
+const resolvConf = "/etc/resolv.conf"
+
+// LookupCNAMEChain returns the CNAME chain of host: host, then the target of each CNAME record in turn, lower case
+// without the final dot. The chain is only host when it has no CNAME record, and empty for an ip.
+//
+// The chain is read from the answers to A queries, sent directly to the servers, or to the nameservers of the
+// system configuration: host is looked up as an absolute name.
+func (r *Resolver) LookupCNAMEChain(ctx context.Context, host string) ([]string, error) {
+	if _, err := netip.ParseAddr(host); err == nil {
+		return nil, nil
+	}
+	name := strings.ToLower(host)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	chain := []string{name}
+	seen := map[string]bool{name: true}
+	for {
+		var a *answer
+		err := r.retry(ctx, func(ctx context.Context) error {
+			var err error
+			a, err = r.query(ctx, r.next(r.nameservers), host, chain[len(chain)-1], typeA)
+			return err
+		})
+		if err != nil {
+			// The end of the chain is dangling, which is worth reporting
+			if len(chain) > 1 {
+				break
+			}
+			return nil, err
+		}
+		for target, found := a.cnames[chain[len(chain)-1]]; found; target, found = a.cnames[target] {
+			if seen[target] || len(chain) > maxCNAMEs {
+				return nil, fmt.Errorf("CNAME loop for host \"%s\"", host)
+			}
+			seen[target] = true
+			chain = append(chain, target)
+		}
+		// Some resolvers stop at the first CNAME: the chain continues when the answer has no address
+		if len(a.ips) > 0 || len(a.cnames) == 0 {
+			break
+		}
+	}
+
+	for i := range chain {
+		chain[i] = strings.TrimSuffix(chain[i], ".")
+	}
+	return chain, nil
+}
+
+// query sends a qtype query of name (absolute) to srv, and returns its answer. The errors are reported for host.
+func (r *Resolver) query(ctx context.Context, srv *server, host, name string, qtype uint16) (*answer, error) {
+	id := uint16(rand.Uint32()) // nolint:gosec
+	query, err := newQuery(id, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	a, err := r.exchange(ctx, srv, id, query)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: host, Server: srv.address, IsTimeout: ctx.Err() != nil}
+	}
+	switch a.rcode {
+	case 0:
+		return a, nil
+	case rcodeNXDomain:
+		if len(a.cnames) > 0 {
+			return a, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, Server: srv.address, IsNotFound: true}
+	default:
+		return nil, &net.DNSError{Err: fmt.Sprintf("server answered rcode %d", a.rcode), Name: host,
+			Server: srv.address, IsTemporary: true}
+	}
+}
+
+// exchange sends query to srv over its transport, UDP answers which are truncated are queried again over TCP
+func (r *Resolver) exchange(ctx context.Context, srv *server, id uint16, query []byte) (*answer, error) {
+	network := transportUDP
+	for {
+		conn, err := r.dialer(srv)(ctx, network, "")
+		if err != nil {
+			return nil, err
+		}
+		resp, err := roundTrip(ctx, conn, query)
+		_ = conn.Close()
+		if err != nil {
+			return nil, err
+		}
+		a, err := parseAnswer(id, resp)
+		if err != nil {
+			return nil, err
+		}
+		if a.truncated && network == transportUDP && srv.transport == transportUDP {
+			network = transportTCP
+			continue
+		}
+		return a, nil
+	}
+}
+
+// roundTrip writes query and reads the answer, as a datagram over UDP, prefixed by its length over streams
+func roundTrip(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if _, ok := conn.(net.PacketConn); ok {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		b := make([]byte, maxMessageSize)
+		n, err := conn.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)); err != nil { // nolint:gosec
+		return nil, err
+	}
+	size := make([]byte, 2) // nolint:mnd
+	if _, err := io.ReadFull(conn, size); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(size))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// systemServers returns the nameservers of the system configuration, the local ones when there are none, like the
+// go resolver
+func systemServers() []*server {
+	servers := make([]*server, 0)
+	// Missing on some systems
+	data, _ := os.ReadFile(resolvConf)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if srv, err := parseServer(fields[1]); err == nil {
+			servers = append(servers, srv)
+		}
+	}
+	if len(servers) == 0 {
+		servers = append(servers,
+			&server{transport: transportUDP, address: net.JoinHostPort("127.0.0.1", portDNS)},
+			&server{transport: transportUDP, address: net.JoinHostPort("::1", portDNS)},
+		)
+	}
+	return servers
+}
@@ -0,0 +1,323 @@
+// Package dns resolves hostnames with configurable servers: plain DNS over UDP or TCP, DNS-over-TLS and
+// DNS-over-HTTPS, with a timeout per query, retries and the choice of the address family.
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Family selects the records to query.
+type Family string
+
+const (
+	// FamilyAny queries both A and AAAA records
+	FamilyAny Family = "ip"
+	// FamilyIPv4 only queries A records
+	FamilyIPv4 Family = "ip4"
+	// FamilyIPv6 only queries AAAA records
+	FamilyIPv6 Family = "ip6"
+)
+
+// Default ports of the transports
+const (
+	portDNS = "53"
+	portDoT = "853"
+)
+
+const (
+	DefaultTimeout = 5 * time.Second
+	DefaultRetries = 2
+)
+
+// Transports of a server
+const (
+	transportUDP   = "udp"
+	transportTCP   = "tcp"
+	transportTLS   = "tls"
+	transportHTTPS = "https"
+)
+
+// server is a configured nameserver
+type server struct {
+	transport string
+	// host:port, or the url of a DNS-over-HTTPS server
+	address string
+}
+
+// Resolver looks up the addresses of hostnames. It is safe for concurrent use.
+type Resolver struct {
+	// Empty when the system resolver is used
+	servers []*server
+	// Queried directly to follow CNAME chains: the servers, or the nameservers of the system configuration
+	nameservers []*server
+	system      *net.Resolver
+	timeout     time.Duration
+	retries     int
+	family      Family
+	tls         *tls.Config
+	client      *http.Client
+	attempts    atomic.Uint64
+}
+
+// Option configures a Resolver, see NewResolver.
+type Option func(r *Resolver) error
+
+// WithServers queries the given servers instead of the system ones, in turn: each retry goes to the next server.
+// A server is an address with an optional port and transport:
+//
+//	1.1.1.1, 1.1.1.1:53, udp://1.1.1.1   plain DNS over UDP, retried over TCP when the answer is truncated
+//	tcp://1.1.1.1:53                     plain DNS over TCP
+//	tls://1.1.1.1:853                    DNS-over-TLS, port 853 by default
+//	https://cloudflare-dns.com/dns-query DNS-over-HTTPS (RFC 8484)
+//
+// With custom servers, hostnames are looked up as absolute names, and only on the servers: the search domains, the
+// hosts file and the options (attempts, timeout, rotate) of the system configuration are not used.
+func WithServers(servers ...string) Option {
+	return func(r *Resolver) error {
+		for _, s := range servers {
+			srv, err := parseServer(s)
+			if err != nil {
+				return err
+			}
+			r.servers = append(r.servers, srv)
+		}
+		return nil
+	}
+}
+
+// WithTimeout sets the timeout of each attempt, DefaultTimeout by default. 0 disables the timeout.
+func WithTimeout(timeout time.Duration) Option {
+	return func(r *Resolver) error {
+		if timeout < 0 {
+			return fmt.Errorf("invalid dns timeout %s", timeout)
+		}
+		r.timeout = timeout
+		return nil
+	}
+}
+
+// WithRetries sets the number of retries after a failed attempt, DefaultRetries by default. Missing hosts are not
+// retried.
+//
+// With custom servers, an attempt is a single query per family (A and AAAA for FamilyAny) to one server: a lookup sends
+// at most retries+1 queries per family. Without, an attempt is a lookup of the system resolver, which retries on its
+// own (eg. the attempts option of resolv.conf, for each nameserver).
+func WithRetries(retries int) Option {
+	return func(r *Resolver) error {
+		if retries < 0 {
+			return fmt.Errorf("invalid dns retries %d", retries)
+		}
+		r.retries = retries
+		return nil
+	}
+}
+
+// WithFamily only queries the records of a family, FamilyAny by default.
+func WithFamily(family Family) Option {
+	return func(r *Resolver) error {
+		switch family {
+		case FamilyAny, FamilyIPv4, FamilyIPv6:
+			r.family = family
+			return nil
+		}
+		return fmt.Errorf("invalid dns family %q", family)
+	}
+}
+
+// WithTLSConfig sets the TLS configuration of the DNS-over-TLS servers, eg. to trust a private CA. The server name
+// is set from the server address when empty.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(r *Resolver) error {
+		r.tls = config
+		return nil
+	}
+}
+
+// WithHTTPClient sets the client of the DNS-over-HTTPS servers, http.DefaultClient by default.
+func WithHTTPClient(client *http.Client) Option {
+	return func(r *Resolver) error {
+		r.client = client
+		return nil
+	}
+}
+
+// NewResolver creates a resolver, using the system configuration unless WithServers is given.
+func NewResolver(opts ...Option) (*Resolver, error) {
+	r := &Resolver{
+		system:  &net.Resolver{},
+		timeout: DefaultTimeout,
+		retries: DefaultRetries,
+		family:  FamilyAny,
+		client:  http.DefaultClient,
+	}
+	for _, opt := range opts {
+		if err := opt(r); err != nil {
+			return nil, err
+		}
+	}
+	r.nameservers = r.servers
+	if len(r.servers) == 0 {
+		r.nameservers = systemServers()
+	}
+	return r, nil
+}
+
+// parseServer parses a server of WithServers
+func parseServer(s string) (*server, error) {
+	transport, address, found := strings.Cut(strings.TrimSpace(s), "://")
+	if !found {
+		transport, address = transportUDP, transport
+	}
+	switch transport {
+	case transportHTTPS:
+		u, err := url.Parse(s)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid dns server %q", s)
+		}
+		return &server{transport: transport, address: u.String()}, nil
+	case transportUDP, transportTCP, transportTLS:
+	default:
+		return nil, fmt.Errorf("invalid dns server %q: unknown transport %s", s, transport)
+	}
+
+	port := portDNS
+	if transport == transportTLS {
+		port = portDoT
+	}
+	// Without port, IPv6 addresses can be bracketed or not
+	if addr, err := netip.ParseAddr(strings.Trim(address, "[]")); err == nil {
+		address = net.JoinHostPort(addr.String(), port)
+	} else if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, port)
+	}
+	host, _, _ := net.SplitHostPort(address)
+	if host == "" {
+		return nil, fmt.Errorf("invalid dns server %q", s)
+	}
+	return &server{transport: transport, address: address}, nil
+}
+
+// dialer connects to srv over its transport, network is the one of plain DNS servers (udp, or tcp when an answer was
+// truncated)
+func (r *Resolver) dialer(srv *server) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, _ string) (net.Conn, error) {
+		d := net.Dialer{}
+		switch srv.transport {
+		case transportTCP:
+			return d.DialContext(ctx, "tcp", srv.address)
+		case transportTLS:
+			config := &tls.Config{MinVersion: tls.VersionTLS12}
+			if r.tls != nil {
+				config = r.tls.Clone()
+			}
+			if config.ServerName == "" {
+				config.ServerName, _, _ = net.SplitHostPort(srv.address)
+			}
+			td := tls.Dialer{NetDialer: &d, Config: config}
+			return td.DialContext(ctx, "tcp", srv.address)
+		case transportHTTPS:
+			return newDoHConn(ctx, r.client, srv.address), nil
+		default:
+			// udp, or tcp when the answer was truncated
+			return d.DialContext(ctx, network, srv.address)
+		}
+	}
+}
+
+// LookupNetIP returns the addresses of host, IPv4 addresses are unmapped. An ip is returned as is.
+func (r *Resolver) LookupNetIP(ctx context.Context, host string) ([]netip.Addr, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{ip}, nil
+	}
+
+	var ips []netip.Addr
+	err := r.retry(ctx, func(ctx context.Context) error {
+		var err error
+		ips, err = r.lookup(ctx, host)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("DNS lookup did not find any ips for host \"%s\"", host)
+	}
+	for i := range ips {
+		ips[i] = ips[i].Unmap()
+	}
+	return ips, nil
+}
+
+// retry runs attempt until it succeeds, at most retries+1 times, each with the timeout. Missing hosts are not
+// retried.
+func (r *Resolver) retry(ctx context.Context, attempt func(ctx context.Context) error) error {
+	var err error
+	for range r.retries + 1 {
+		err = r.withTimeout(ctx, attempt)
+		var dnsErr *net.DNSError
+		if err == nil || ctx.Err() != nil || (errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+			break
+		}
+	}
+	return err
+}
+
+func (r *Resolver) withTimeout(ctx context.Context, attempt func(ctx context.Context) error) error {
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+	return attempt(ctx)
+}
+
+// next returns the server of the next attempt, in turn
+func (r *Resolver) next(servers []*server) *server {
+	return servers[(r.attempts.Add(1)-1)%uint64(len(servers))]
+}
+
+// lookup runs one attempt, on the next server
+func (r *Resolver) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	if len(r.servers) == 0 {
+		return r.system.LookupNetIP(ctx, string(r.family), host)
+	}
+	srv := r.next(r.servers)
+	name := strings.ToLower(host)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	ips := make([]netip.Addr, 0)
+	for _, qtype := range r.family.qtypes() {
+		a, err := r.query(ctx, srv, host, name, qtype)
+		if err != nil {
+			// Like the go resolver, the addresses of a family are enough
+			if len(ips) > 0 {
+				break
+			}
+			return nil, err
+		}
+		ips = append(ips, a.ips...)
+	}
+	return ips, nil
+}
+
+// qtypes returns the record types to query for the family
+func (f Family) qtypes() []uint16 {
+	switch f {
+	case FamilyIPv4:
+		return []uint16{typeA}
+	case FamilyIPv6:
+		return []uint16{typeAAAA}
+	}
+	return []uint16{typeA, typeAAAA}
+}
@@ -0,0 +1,446 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stub is an in-process DNS server answering A and AAAA queries from records, following cnames, NXDOMAIN for other
+// names
+type stub struct {
+	records map[string][]netip.Addr
+	cnames  map[string]string
+	// Only answer the first CNAME of a chain, like some forwarders
+	partial atomic.Bool
+	// Queries answered, per transport
+	queries map[string]*atomic.Int64
+}
+
+func newStub() *stub {
+	s := &stub{
+		records: map[string][]netip.Addr{
+			"app.example.test.": {netip.MustParseAddr("192.0.2.10"), netip.MustParseAddr("2001:db8::10")},
+			"v4.example.test.":  {netip.MustParseAddr("192.0.2.20")},
+			"edge.cdn.test.":    {netip.MustParseAddr("192.0.2.30")},
+		},
+		cnames: map[string]string{
+			"www.example.test.":      "front.example.test.",
+			"front.example.test.":    "d111.cloudfront.net.",
+			"d111.cloudfront.net.":   "edge.cdn.test.",
+			"dangling.example.test.": "gone.example.test.",
+			"loop.example.test.":     "loop.example.test.",
+		},
+		queries: map[string]*atomic.Int64{},
+	}
+	for _, transport := range []string{transportUDP, transportTCP, transportTLS, transportHTTPS} {
+		s.queries[transport] = &atomic.Int64{}
+	}
+	return s
+}
+
+// answer builds the response to a query, nil when the query is invalid
+func (s *stub) answer(query []byte) []byte {
+	if len(query) < 12 { // nolint:mnd
+		return nil
+	}
+	// Question: labels, then type and class
+	end := 12
+	labels := make([]string, 0)
+	for end < len(query) && query[end] != 0 {
+		size := int(query[end])
+		if end+1+size > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[end+1:end+1+size]))
+		end += 1 + size
+	}
+	if end+5 > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[end+1:])
+	question := query[12 : end+5]
+	name := strings.ToLower(strings.Join(labels, ".")) + "."
+
+	// Answer section: the CNAME records of the chain, then the addresses of its end
+	rrs := make([]byte, 0)
+	count := 0
+	_, found := s.records[name]
+	// The first owner is a pointer to the question
+	owner := []byte{0xc0, 0x0c}
+	for target, ok := s.cnames[name]; ok && count < 20; target, ok = s.cnames[name] {
+		rrs = appendRR(rrs, owner, typeCNAME, encodeName(target))
+		owner = encodeName(target)
+		count++
+		found = true
+		name = target
+		if s.partial.Load() {
+			break
+		}
+	}
+	if count == 0 || !s.partial.Load() {
+		for _, addr := range s.records[name] {
+			if (qtype == typeA && addr.Is4()) || (qtype == typeAAAA && addr.Is6()) {
+				rrs = appendRR(rrs, owner, qtype, addr.AsSlice())
+				count++
+			}
+		}
+	}
+
+	// Header: same id, response with recursion desired and available, NXDOMAIN for unknown names
+	flags := uint16(0x8180)
+	if !found {
+		flags |= 3
+	}
+	b := append([]byte{}, query[:2]...)
+	b = binary.BigEndian.AppendUint16(b, flags)
+	b = binary.BigEndian.AppendUint16(b, 1)
+	b = binary.BigEndian.AppendUint16(b, uint16(count)) // nolint:gosec
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = append(b, question...)
+	return append(b, rrs...)
+}
+
+func appendRR(b, owner []byte, rtype uint16, data []byte) []byte {
+	b = append(b, owner...)
+	b = binary.BigEndian.AppendUint16(b, rtype)
+	b = binary.BigEndian.AppendUint16(b, 1)
+	b = binary.BigEndian.AppendUint32(b, 60)                // nolint:mnd
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data))) // nolint:gosec
+	return append(b, data...)
+}
+
+func encodeName(name string) []byte {
+	b := make([]byte, 0, len(name)+1)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func (s *stub) serveUDP(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() {
+		buf := make([]byte, maxMessageSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			s.queries[transportUDP].Add(1)
+			_, _ = conn.WriteTo(s.answer(buf[:n]), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// serveStream answers the length prefixed queries of the connections of l, over TCP or TLS
+func (s *stub) serveStream(t *testing.T, l net.Listener, transport string) string {
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					size := make([]byte, 2)
+					if _, err := io.ReadFull(conn, size); err != nil {
+						return
+					}
+					query := make([]byte, binary.BigEndian.Uint16(size))
+					if _, err := io.ReadFull(conn, query); err != nil {
+						return
+					}
+					s.queries[transport].Add(1)
+					answer := s.answer(query)
+					_, _ = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(answer))), answer...)) // nolint:gosec
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// serveDoH starts a DNS-over-HTTPS server, its certificate is also used by the DNS-over-TLS server
+func (s *stub) serveDoH(t *testing.T) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "expected a dns message", http.StatusBadRequest)
+			return
+		}
+		query, _ := io.ReadAll(r.Body)
+		s.queries[transportHTTPS].Add(1)
+		w.Header().Set("Content-Type", dohContentType)
+		_, _ = w.Write(s.answer(query))
+	}))
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestLookupNetIP(t *testing.T) {
+	s := newStub()
+	doh := s.serveDoH(t)
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dot, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := map[string]string{
+		transportUDP:   s.serveUDP(t),
+		transportTCP:   "tcp://" + s.serveStream(t, tcp, transportTCP),
+		transportTLS:   "tls://" + s.serveStream(t, tlsListener(dot, doh), transportTLS),
+		transportHTTPS: doh.URL + "/dns-query",
+	}
+
+	tests := []struct {
+		host     string
+		family   Family
+		expected []string
+	}{
+		{"app.example.test", FamilyAny, []string{"192.0.2.10", "2001:db8::10"}},
+		{"APP.example.test.", FamilyAny, []string{"192.0.2.10", "2001:db8::10"}},
+		{"app.example.test", FamilyIPv4, []string{"192.0.2.10"}},
+		{"app.example.test", FamilyIPv6, []string{"2001:db8::10"}},
+		{"v4.example.test", FamilyAny, []string{"192.0.2.20"}},
+		// Ips are not looked up
+		{"198.51.100.1", FamilyIPv6, []string{"198.51.100.1"}},
+	}
+	for transport, address := range servers {
+		t.Run(transport, func(t *testing.T) {
+			for _, test := range tests {
+				r, err := NewResolver(WithServers(address), WithFamily(test.family), WithTimeout(time.Second),
+					WithHTTPClient(doh.Client()), WithTLSConfig(doh.Client().Transport.(*http.Transport).TLSClientConfig))
+				if err != nil {
+					t.Fatal(err)
+				}
+				ips, err := r.LookupNetIP(context.Background(), test.host)
+				if err != nil {
+					t.Fatalf("Failed to look up %s: %v", test.host, err)
+				}
+				got := make([]string, 0, len(ips))
+				for _, ip := range ips {
+					got = append(got, ip.String())
+				}
+				slices.Sort(got)
+				if !slices.Equal(got, test.expected) {
+					t.Errorf("Expected %s (%s) to be %v, got %v", test.host, test.family, test.expected, got)
+				}
+			}
+
+			r, _ := NewResolver(WithServers(address), WithHTTPClient(doh.Client()),
+				WithTLSConfig(doh.Client().Transport.(*http.Transport).TLSClientConfig))
+			_, err := r.LookupNetIP(context.Background(), "missing.example.test")
+			var dnsErr *net.DNSError
+			if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+				t.Errorf("Expected a not found error, got %v", err)
+			}
+			if s.queries[transport].Load() == 0 {
+				t.Errorf("Expected the %s server to be queried", transport)
+			}
+		})
+	}
+}
+
+func TestLookupNetIPSkipsHostsFile(t *testing.T) {
+	// localhost is in the hosts file, the stub does not know it
+	r, err := NewResolver(WithServers(newStub().serveUDP(t)), WithTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.LookupNetIP(context.Background(), "localhost")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("Expected localhost to only be looked up on the server, got %v", err)
+	}
+}
+
+func TestDoHReadDeadline(t *testing.T) {
+	doh := newStub().serveDoH(t)
+	conn := newDoHConn(context.Background(), doh.Client(), doh.URL)
+	if err := conn.SetReadDeadline(time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	query, err := newQuery(1, "app.example.test.", typeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := roundTrip(context.Background(), conn, query); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the read deadline to apply, got %v", err)
+	}
+}
+
+// tlsListener serves TLS on l, with the certificate of the DNS-over-HTTPS server
+func tlsListener(l net.Listener, doh *httptest.Server) net.Listener {
+	config := doh.TLS.Clone()
+	config.NextProtos = nil
+	return tls.NewListener(l, config)
+}
+
+func TestRetries(t *testing.T) {
+	s := newStub()
+	// Never answers
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+	good := s.serveUDP(t)
+
+	timeout := WithTimeout(100 * time.Millisecond)
+	r, err := NewResolver(WithServers(dead.LocalAddr().String(), good), timeout, WithRetries(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.LookupNetIP(context.Background(), "v4.example.test"); err != nil {
+		t.Errorf("Expected the retry on the second server to succeed, got %v", err)
+	}
+
+	r, _ = NewResolver(WithServers(dead.LocalAddr().String()), timeout, WithRetries(0))
+	start := time.Now()
+	if _, err := r.LookupNetIP(context.Background(), "v4.example.test"); err == nil {
+		t.Errorf("Expected an error without answer")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the lookup to time out after 100ms, took %s", elapsed)
+	}
+
+	// Each attempt is a single query to one server
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	queries := atomic.Int64{}
+	go func() {
+		buf := make([]byte, maxMessageSize)
+		for {
+			if _, _, err := silent.ReadFrom(buf); err != nil {
+				return
+			}
+			queries.Add(1)
+		}
+	}()
+	r, _ = NewResolver(WithServers(silent.LocalAddr().String()), timeout, WithRetries(2), WithFamily(FamilyIPv4))
+	_, _ = r.LookupNetIP(context.Background(), "v4.example.test")
+	if queries.Load() != 3 {
+		t.Errorf("Expected 3 queries for 2 retries, got %d", queries.Load())
+	}
+
+	// Missing hosts are not retried
+	r, _ = NewResolver(WithServers(good), WithFamily(FamilyIPv4), WithRetries(3))
+	before := s.queries[transportUDP].Load()
+	if _, err := r.LookupNetIP(context.Background(), "missing.example.test"); err == nil {
+		t.Errorf("Expected an error for a missing host")
+	}
+	if queries := s.queries[transportUDP].Load() - before; queries != 1 {
+		t.Errorf("Expected a single query for a missing host, got %d", queries)
+	}
+}
+
+func TestLookupCNAMEChain(t *testing.T) {
+	s := newStub()
+	doh := s.serveDoH(t)
+	servers := []string{s.serveUDP(t), doh.URL + "/dns-query"}
+
+	tests := []struct {
+		host     string
+		expected []string
+	}{
+		{"www.example.test", []string{"www.example.test", "front.example.test", "d111.cloudfront.net", "edge.cdn.test"}},
+		{"Front.Example.Test.", []string{"front.example.test", "d111.cloudfront.net", "edge.cdn.test"}},
+		{"app.example.test", []string{"app.example.test"}},
+		{"dangling.example.test", []string{"dangling.example.test", "gone.example.test"}},
+		{"192.0.2.10", nil},
+	}
+	for _, partial := range []bool{false, true} {
+		s.partial.Store(partial)
+		for _, address := range servers {
+			r, err := NewResolver(WithServers(address), WithHTTPClient(doh.Client()), WithTimeout(time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, test := range tests {
+				chain, err := r.LookupCNAMEChain(context.Background(), test.host)
+				if err != nil {
+					t.Errorf("Failed to look up the chain of %s on %s: %v", test.host, address, err)
+					continue
+				}
+				if !slices.Equal(chain, test.expected) {
+					t.Errorf("Expected the chain of %s on %s (partial: %t) to be %v, got %v", test.host, address, partial,
+						test.expected, chain)
+				}
+			}
+
+			_, err = r.LookupCNAMEChain(context.Background(), "missing.example.test")
+			var dnsErr *net.DNSError
+			if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+				t.Errorf("Expected a not found error, got %v", err)
+			}
+			if _, err := r.LookupCNAMEChain(context.Background(), "loop.example.test"); err == nil {
+				t.Errorf("Expected an error for a CNAME loop")
+			}
+		}
+	}
+}
+
+func TestParseServer(t *testing.T) {
+	tests := map[string]string{
+		"1.1.1.1":                    "udp 1.1.1.1:53",
+		"1.1.1.1:5353":               "udp 1.1.1.1:5353",
+		"2606:4700::1111":            "udp [2606:4700::1111]:53",
+		"[2606:4700::1111]":          "udp [2606:4700::1111]:53",
+		"[2606:4700::1111]:5353":     "udp [2606:4700::1111]:5353",
+		"dns.example.com":            "udp dns.example.com:53",
+		"tcp://1.1.1.1":              "tcp 1.1.1.1:53",
+		"tls://one.one.one.one":      "tls one.one.one.one:853",
+		"tls://1.1.1.1:8853":         "tls 1.1.1.1:8853",
+		"https://1.1.1.1/dns-query":  "https https://1.1.1.1/dns-query",
+		" udp://9.9.9.9 ":            "udp 9.9.9.9:53",
+		"https://dns.google/resolve": "https https://dns.google/resolve",
+	}
+	for s, expected := range tests {
+		srv, err := parseServer(s)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", s, err)
+			continue
+		}
+		if got := srv.transport + " " + srv.address; got != expected {
+			t.Errorf("Expected %q to be %s, got %s", s, expected, got)
+		}
+	}
+
+	for _, s := range []string{"quic://1.1.1.1", "https:///dns-query", ":53", "tcp://"} {
+		if _, err := parseServer(s); err == nil {
+			t.Errorf("Expected an error for %q", s)
+		}
+	}
+	if _, err := NewResolver(WithFamily("ip5")); err == nil {
+		t.Errorf("Expected an error for an invalid family")
+	}
+	if _, err := NewResolver(WithRetries(-1)); err == nil {
+		t.Errorf("Expected an error for negative retries")
+	}
+}
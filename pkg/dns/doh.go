@@ -0,0 +1,125 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Largest DNS message, its length is encoded on 2 bytes
+const maxMessageSize = 65535
+
+const dohContentType = "application/dns-message"
+
+// dohConn carries DNS queries over DNS-over-HTTPS (RFC 8484). It is used like a stream connection (like TCP): each
+// message is prefixed by its length. Each query written is POSTed to the server, the
+// answer is then available to Read.
+type dohConn struct {
+	ctx      context.Context
+	client   *http.Client
+	url      string
+	deadline time.Time
+	query    bytes.Buffer
+	answers  bytes.Buffer
+}
+
+func newDoHConn(ctx context.Context, client *http.Client, url string) *dohConn {
+	return &dohConn{ctx: ctx, client: client, url: url}
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.query.Write(b)
+	for c.query.Len() >= 2 {
+		size := int(binary.BigEndian.Uint16(c.query.Bytes()))
+		if c.query.Len() < 2+size {
+			break
+		}
+		c.query.Next(2)
+		answer, err := c.roundTrip(c.query.Next(size))
+		if err != nil {
+			return 0, err
+		}
+		_ = binary.Write(&c.answers, binary.BigEndian, uint16(len(answer))) // nolint:gosec
+		c.answers.Write(answer)
+	}
+	return len(b), nil
+}
+
+func (c *dohConn) roundTrip(query []byte) ([]byte, error) {
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dns-over-https server %s answered %s", c.url, resp.Status)
+	}
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, maxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(answer) > maxMessageSize {
+		return nil, fmt.Errorf("dns-over-https server %s answered a message larger than %d bytes", c.url, maxMessageSize)
+	}
+	return answer, nil
+}
+
+// Read returns the answers of the queries written so far, io.EOF when there are none
+func (c *dohConn) Read(b []byte) (int, error) {
+	return c.answers.Read(b)
+}
+
+func (c *dohConn) Close() error {
+	return nil
+}
+
+func (c *dohConn) LocalAddr() net.Addr {
+	return dohAddr{}
+}
+
+func (c *dohConn) RemoteAddr() net.Addr {
+	return dohAddr{url: c.url}
+}
+
+func (c *dohConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+// SetReadDeadline is SetDeadline: the answer is read during the request sent by Write
+func (c *dohConn) SetReadDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+func (c *dohConn) SetWriteDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+type dohAddr struct {
+	url string
+}
+
+func (a dohAddr) Network() string {
+	return transportHTTPS
+}
+
+func (a dohAddr) String() string {
+	return a.url
+}
@@ -0,0 +1,152 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// Minimal DNS message encoding (RFC 1035), enough to read the addresses and the CNAME records of an answer.
+
+const (
+	headerSize = 12
+	typeA      = 1
+	typeCNAME  = 5
+	typeAAAA   = 28
+	classINET  = 1
+
+	flagResponse  = 1 << 15
+	flagTruncated = 1 << 9
+	flagRecursion = 1 << 8
+	rcodeMask     = 0xf
+	rcodeNXDomain = 3
+
+	// Compression pointers start with the 2 high bits set
+	pointerMask = 0xc0
+	// Longer chains are considered loops
+	maxCNAMEs = 16
+)
+
+var errInvalidMessage = errors.New("invalid dns message")
+
+// newQuery encodes a recursive query of name (absolute, with the final dot)
+func newQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	b := binary.BigEndian.AppendUint16(nil, id)
+	b = binary.BigEndian.AppendUint16(b, flagRecursion)
+	b = binary.BigEndian.AppendUint16(b, 1)
+	b = append(b, 0, 0, 0, 0, 0, 0)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 { // nolint:mnd
+			return nil, fmt.Errorf("invalid name %q", name)
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	b = append(b, 0)
+	b = binary.BigEndian.AppendUint16(b, qtype)
+	return binary.BigEndian.AppendUint16(b, classINET), nil
+}
+
+// answer is the part of a response needed to look up addresses and to follow CNAME chains
+type answer struct {
+	truncated bool
+	rcode     int
+	// A and AAAA records of the answer section, the end of the chain
+	ips []netip.Addr
+	// CNAME records of the answer section, owner -> target, lower case absolute names
+	cnames map[string]string
+}
+
+func parseAnswer(id uint16, b []byte) (*answer, error) {
+	if len(b) < headerSize {
+		return nil, errInvalidMessage
+	}
+	be := binary.BigEndian
+	flags := be.Uint16(b[2:])
+	if be.Uint16(b) != id || flags&flagResponse == 0 {
+		return nil, fmt.Errorf("%w: unexpected id or not a response", errInvalidMessage)
+	}
+	a := &answer{
+		truncated: flags&flagTruncated != 0,
+		rcode:     int(flags & rcodeMask),
+		cnames:    make(map[string]string),
+	}
+	questions, answers := int(be.Uint16(b[4:])), int(be.Uint16(b[6:]))
+
+	offset := headerSize
+	for range questions {
+		_, next, err := readName(b, offset)
+		if err != nil {
+			return nil, err
+		}
+		offset = next + 4 // nolint:mnd
+	}
+	for range answers {
+		owner, next, err := readName(b, offset)
+		if err != nil {
+			return nil, err
+		}
+		// type u16 | class u16 | ttl u32 | data length u16 | data
+		if next+10 > len(b) {
+			return nil, errInvalidMessage
+		}
+		rtype, size := be.Uint16(b[next:]), int(be.Uint16(b[next+8:]))
+		data := next + 10 // nolint:mnd
+		if data+size > len(b) {
+			return nil, errInvalidMessage
+		}
+		switch rtype {
+		case typeA, typeAAAA:
+			ip, ok := netip.AddrFromSlice(b[data : data+size])
+			if !ok || (rtype == typeA) != (size == net.IPv4len) {
+				return nil, fmt.Errorf("%w: invalid address record", errInvalidMessage)
+			}
+			a.ips = append(a.ips, ip)
+		case typeCNAME:
+			target, _, err := readName(b, data)
+			if err != nil {
+				return nil, err
+			}
+			a.cnames[owner] = target
+		}
+		offset = data + size
+	}
+	return a, nil
+}
+
+// readName reads the possibly compressed name at offset, and returns the offset following it
+func readName(b []byte, offset int) (string, int, error) {
+	labels := make([]string, 0)
+	end := -1
+	for jumps := 0; ; {
+		if offset >= len(b) {
+			return "", 0, errInvalidMessage
+		}
+		size := int(b[offset])
+		switch {
+		case size == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")) + ".", end, nil
+		case size&pointerMask == pointerMask:
+			if offset+1 >= len(b) || jumps > maxCNAMEs*4 {
+				return "", 0, errInvalidMessage
+			}
+			if end < 0 {
+				end = offset + 2 // nolint:mnd
+			}
+			offset = int(binary.BigEndian.Uint16(b[offset:]) & 0x3fff) // nolint:mnd
+			jumps++
+		default:
+			if offset+1+size > len(b) {
+				return "", 0, errInvalidMessage
+			}
+			labels = append(labels, string(b[offset+1:offset+1+size]))
+			offset += 1 + size
+		}
+	}
+}
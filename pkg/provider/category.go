@@ -0,0 +1,143 @@
+package provider
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Category is the kind of infrastructure behind a range, eg. a CDN edge or a compute instance.
+type Category string
+
+const (
+	// CategoryUnknown is the category of Unknown and of unclassified custom providers
+	CategoryUnknown Category = ""
+	// CategoryCDN is an edge network in front of an origin, eg. Cloudflare or CloudFront
+	CategoryCDN Category = "cdn"
+	// CategoryCompute is a cloud instance or load balancer, usually the origin itself
+	CategoryCompute Category = "compute"
+	// CategoryServerless is a managed application platform or API gateway, eg. Vercel or AWS API Gateway
+	CategoryServerless Category = "serverless"
+	// CategoryObjectStorage is a bucket endpoint, eg. S3
+	CategoryObjectStorage Category = "object-storage"
+	// CategoryDNS is a DNS service, eg. Route 53
+	CategoryDNS Category = "dns"
+	// CategoryEgress is the source of requests made by a provider, eg. CDN origin fetches or health checks
+	CategoryEgress Category = "egress"
+	// CategoryHosting is a VPS or dedicated server host
+	CategoryHosting Category = "hosting"
+)
+
+// Categories lists the known categories, CategoryUnknown excluded.
+var Categories = []Category{
+	CategoryCDN,
+	CategoryCompute,
+	CategoryServerless,
+	CategoryObjectStorage,
+	CategoryDNS,
+	CategoryEgress,
+	CategoryHosting,
+}
+
+func (c Category) String() string {
+	return string(c)
+}
+
+// ParseCategory returns the category with the given name, case insensitively. The empty name is CategoryUnknown.
+func ParseCategory(name string) (Category, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return CategoryUnknown, nil
+	}
+	for _, c := range Categories {
+		if string(c) == name {
+			return c, nil
+		}
+	}
+	return CategoryUnknown, fmt.Errorf("unknown category %q", name)
+}
+
+// Default category of each built-in provider, used when the service of a range is not more specific. The categories
+// of custom providers are in the registry, see SetCategory.
+var builtinCategories = map[Provider]Category{
+	Aws:          CategoryCompute,
+	Alibaba:      CategoryCompute,
+	Azure:        CategoryCompute,
+	Cloudflare:   CategoryCDN,
+	Digitalocean: CategoryHosting,
+	Fastly:       CategoryCDN,
+	Gcp:          CategoryCompute,
+	Ibm:          CategoryCompute,
+	Linode:       CategoryHosting,
+	Oracle:       CategoryCompute,
+	Ovh:          CategoryHosting,
+	Scaleway:     CategoryHosting,
+	Tencent:      CategoryCompute,
+	Ucloud:       CategoryCompute,
+	Vercel:       CategoryServerless,
+	Akamai:       CategoryCDN,
+}
+
+// Category of the services published in the feeds, keyed by service name as published. Services missing from the
+// map (eg. the generic AMAZON and AzureCloud) get the category of their provider.
+var serviceCategories = map[Provider]map[string]Category{
+	// https://docs.aws.amazon.com/vpc/latest/userguide/aws-ip-syntax.html
+	Aws: {
+		"CLOUDFRONT":               CategoryCDN,
+		"GLOBALACCELERATOR":        CategoryCDN,
+		"CLOUDFRONT_ORIGIN_FACING": CategoryEgress,
+		"ROUTE53_HEALTHCHECKS":     CategoryEgress,
+		"EC2_INSTANCE_CONNECT":     CategoryEgress,
+		"CODEBUILD":                CategoryEgress,
+		"AMAZON_APPFLOW":           CategoryEgress,
+		"API_GATEWAY":              CategoryServerless,
+		"S3":                       CategoryObjectStorage,
+		"ROUTE53":                  CategoryDNS,
+		"ROUTE53_RESOLVER":         CategoryDNS,
+		"EC2":                      CategoryCompute,
+	},
+	// https://learn.microsoft.com/azure/virtual-network/service-tags-overview, region suffixes are stripped
+	Azure: {
+		"AzureFrontDoor.Frontend":   CategoryCDN,
+		"AzureFrontDoor.FirstParty": CategoryCDN,
+		"AzureFrontDoor.Backend":    CategoryEgress,
+		"AzureTrafficManager":       CategoryEgress,
+		"ActionGroup":               CategoryEgress,
+		"AzureConnectors":           CategoryEgress,
+		"AppService":                CategoryServerless,
+		"ApiManagement":             CategoryServerless,
+		"LogicApps":                 CategoryServerless,
+		"Storage":                   CategoryObjectStorage,
+	},
+}
+
+// Category returns the default category of the provider, CategoryUnknown when it has none.
+func (x Provider) Category() Category {
+	return registry.Load().categories[x]
+}
+
+// ServiceCategory returns the category of a range of the provider published under service, eg. CategoryCDN for the
+// CLOUDFRONT service of Aws. Unknown or empty services get the default category of the provider.
+func ServiceCategory(p Provider, service string) Category {
+	// Exact match, lookups do not allocate
+	if c, ok := serviceCategories[p][service]; ok {
+		return c
+	}
+	return p.Category()
+}
+
+// SetCategory sets the default category of a provider, eg. of a custom one. Like Register, it is safe for concurrent
+// use with lookups.
+func SetCategory(p Provider, c Category) {
+	registerLock.Lock()
+	defer registerLock.Unlock()
+	if registry.Load().categories[p] == c {
+		return
+	}
+	next := registry.Load().clone()
+	if c == CategoryUnknown {
+		delete(next.categories, p)
+	} else {
+		next.categories[p] = c
+	}
+	registry.Store(next)
+}
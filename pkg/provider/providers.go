@@ -1,28 +1,109 @@
-//go:generate go-enum --marshal --noprefix --nocomments
 package provider
 
-/*
-ENUM(
-Unknown
-Aws
-Alibaba
-Azure
-Cloudflare
-Digitalocean
-Fastly
-Gcp
-Ibm
-Linode
-Oracle
-Ovh
-Scaleway
-Tencent
-Ucloud
-Vercel
-Akamai
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
-*/
+
+// Provider is a cloud or hosting provider. The built-in ones are constants, custom ones are added with Register.
 type Provider int
 
-// re-export ProviderMap
-var ProviderMap = _ProviderMap
+// ProviderMap maps the built-in providers to their names. Custom providers are not listed, see Register.
+var ProviderMap = func() map[Provider]string {
+	m := make(map[Provider]string, len(builtinNames))
+	for p, name := range builtinNames {
+		m[Provider(p)] = name
+	}
+	return m
+}()
+
+// providerRegistry holds the names and default categories of the providers. It is copied on write (see Register and
+// SetCategory): readers use a snapshot without locking, and never see a provider half registered.
+type providerRegistry struct {
+	// Names indexed by value, enum values are contiguous from 0
+	names      []string
+	values     map[string]Provider
+	categories map[Provider]Category
+}
+
+var registry atomic.Pointer[providerRegistry]
+
+func init() { //nolint:gochecknoinits
+	r := &providerRegistry{
+		names:      builtinNames,
+		values:     make(map[string]Provider, len(builtinNames)),
+		categories: builtinCategories,
+	}
+	for p, name := range builtinNames {
+		r.values[name] = Provider(p)
+	}
+	registry.Store(r)
+}
+
+// clone returns a copy of r that can be modified, r is left unchanged
+func (r *providerRegistry) clone() *providerRegistry {
+	return &providerRegistry{
+		names:      slices.Clone(r.names),
+		values:     maps.Clone(r.values),
+		categories: maps.Clone(r.categories),
+	}
+}
+
+// ParseProviderFold is a case insensitive ParseProvider, eg. ParseProviderFold("aws") -> Aws.
+func ParseProviderFold(name string) (Provider, error) {
+	for p, n := range registry.Load().names {
+		if strings.EqualFold(n, name) {
+			return Provider(p), nil
+		}
+	}
+	return Provider(0), fmt.Errorf("%s is %w", name, ErrInvalidProvider)
+}
+
+// builtinCount is the number of built-in providers, custom providers come after them.
+var builtinCount = len(builtinNames)
+
+// registerLock serializes the writers of the registry
+var registerLock = sync.Mutex{}
+
+// Builtins returns the built-in providers, including Unknown.
+func Builtins() []Provider {
+	providers := make([]Provider, 0, builtinCount)
+	for p := range builtinCount {
+		providers = append(providers, Provider(p))
+	}
+	return providers
+}
+
+// IsCustom reports whether the provider was added with Register.
+func (x Provider) IsCustom() bool {
+	return int(x) >= builtinCount && x.IsValid()
+}
+
+// Register adds a custom provider (eg. corporate or partner ranges) and returns it.
+// Registering an existing name (case insensitive) returns the existing provider.
+// Register is safe for concurrent use, including with lookups and other uses of Provider values.
+func Register(name string) (Provider, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return Provider(0), errors.New("provider name is empty")
+	}
+
+	registerLock.Lock()
+	defer registerLock.Unlock()
+
+	if p, err := ParseProviderFold(name); err == nil {
+		return p, nil
+	}
+
+	next := registry.Load().clone()
+	p := Provider(len(next.names))
+	next.names = append(next.names, name)
+	next.values[name] = p
+	registry.Store(next)
+	return p, nil
+}
@@ -1,8 +1,3 @@
-// Code generated by go-enum DO NOT EDIT.
-// Version: v0.9.4
-
-// Built By: go install
-
 package provider
 
 import (
@@ -10,6 +5,9 @@ import (
 	"fmt"
 )
 
+// The enum was first generated by go-enum. It is maintained by hand since custom providers (see Register) are added
+// at runtime: the names are read from the registry, which go-enum's static maps could not be safely updated like.
+
 const (
 	Unknown Provider = iota
 	Aws
@@ -32,32 +30,32 @@ const (
 
 var ErrInvalidProvider = errors.New("not a valid Provider")
 
-const _ProviderName = "UnknownAwsAlibabaAzureCloudflareDigitaloceanFastlyGcpIbmLinodeOracleOvhScalewayTencentUcloudVercelAkamai"
-
-var _ProviderMap = map[Provider]string{
-	Unknown:      _ProviderName[0:7],
-	Aws:          _ProviderName[7:10],
-	Alibaba:      _ProviderName[10:17],
-	Azure:        _ProviderName[17:22],
-	Cloudflare:   _ProviderName[22:32],
-	Digitalocean: _ProviderName[32:44],
-	Fastly:       _ProviderName[44:50],
-	Gcp:          _ProviderName[50:53],
-	Ibm:          _ProviderName[53:56],
-	Linode:       _ProviderName[56:62],
-	Oracle:       _ProviderName[62:68],
-	Ovh:          _ProviderName[68:71],
-	Scaleway:     _ProviderName[71:79],
-	Tencent:      _ProviderName[79:86],
-	Ucloud:       _ProviderName[86:92],
-	Vercel:       _ProviderName[92:98],
-	Akamai:       _ProviderName[98:104],
+// Names of the built-in providers, indexed by value
+var builtinNames = []string{
+	"Unknown",
+	"Aws",
+	"Alibaba",
+	"Azure",
+	"Cloudflare",
+	"Digitalocean",
+	"Fastly",
+	"Gcp",
+	"Ibm",
+	"Linode",
+	"Oracle",
+	"Ovh",
+	"Scaleway",
+	"Tencent",
+	"Ucloud",
+	"Vercel",
+	"Akamai",
 }
 
 // String implements the Stringer interface.
 func (x Provider) String() string {
-	if str, ok := _ProviderMap[x]; ok {
-		return str
+	names := registry.Load().names
+	if x >= 0 && int(x) < len(names) {
+		return names[x]
 	}
 	return fmt.Sprintf("Provider(%d)", x)
 }
@@ -65,33 +63,12 @@ func (x Provider) String() string {
 // IsValid provides a quick way to determine if the typed value is
 // part of the allowed enumerated values
 func (x Provider) IsValid() bool {
-	_, ok := _ProviderMap[x]
-	return ok
-}
-
-var _ProviderValue = map[string]Provider{
-	_ProviderName[0:7]:    Unknown,
-	_ProviderName[7:10]:   Aws,
-	_ProviderName[10:17]:  Alibaba,
-	_ProviderName[17:22]:  Azure,
-	_ProviderName[22:32]:  Cloudflare,
-	_ProviderName[32:44]:  Digitalocean,
-	_ProviderName[44:50]:  Fastly,
-	_ProviderName[50:53]:  Gcp,
-	_ProviderName[53:56]:  Ibm,
-	_ProviderName[56:62]:  Linode,
-	_ProviderName[62:68]:  Oracle,
-	_ProviderName[68:71]:  Ovh,
-	_ProviderName[71:79]:  Scaleway,
-	_ProviderName[79:86]:  Tencent,
-	_ProviderName[86:92]:  Ucloud,
-	_ProviderName[92:98]:  Vercel,
-	_ProviderName[98:104]: Akamai,
+	return x >= 0 && int(x) < len(registry.Load().names)
 }
 
 // ParseProvider attempts to convert a string to a Provider.
 func ParseProvider(name string) (Provider, error) {
-	if x, ok := _ProviderValue[name]; ok {
+	if x, ok := registry.Load().values[name]; ok {
 		return x, nil
 	}
 	return Provider(0), fmt.Errorf("%s is %w", name, ErrInvalidProvider)
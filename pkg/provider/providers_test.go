@@ -0,0 +1,140 @@
+package provider
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRegister(t *testing.T) {
+	p, err := Register("CorpVPN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.IsCustom() || !p.IsValid() {
+		t.Errorf("Expected %s to be a valid custom provider", p)
+	}
+	if p.String() != "CorpVPN" {
+		t.Errorf("Expected name CorpVPN, got %s", p.String())
+	}
+
+	again, err := Register("corpvpn")
+	if err != nil || again != p {
+		t.Errorf("Expected registering twice to return %d, got %d (%v)", p, again, err)
+	}
+	if parsed, err := ParseProviderFold("CORPVPN"); err != nil || parsed != p {
+		t.Errorf("Expected ParseProviderFold to find %s, got %s (%v)", p, parsed, err)
+	}
+
+	builtin, err := Register("aws")
+	if err != nil || builtin != Aws || builtin.IsCustom() {
+		t.Errorf("Expected Aws, got %s (%v)", builtin, err)
+	}
+
+	if _, err := Register(" "); err == nil {
+		t.Errorf("Expected an error for an empty name")
+	}
+
+	for _, b := range Builtins() {
+		if b.IsCustom() {
+			t.Errorf("Expected %s not to be custom", b)
+		}
+	}
+}
+
+func TestCategories(t *testing.T) {
+	for _, b := range Builtins() {
+		if (b.Category() == CategoryUnknown) != (b == Unknown) {
+			t.Errorf("Expected %s to have a category iff it is not Unknown, got %q", b, b.Category())
+		}
+	}
+
+	tests := []struct {
+		provider Provider
+		service  string
+		category Category
+	}{
+		{Aws, "CLOUDFRONT", CategoryCDN},
+		{Aws, "CLOUDFRONT_ORIGIN_FACING", CategoryEgress},
+		{Aws, "S3", CategoryObjectStorage},
+		{Aws, "ROUTE53", CategoryDNS},
+		{Aws, "AMAZON", CategoryCompute},
+		{Aws, "", CategoryCompute},
+		{Azure, "AzureFrontDoor.Frontend", CategoryCDN},
+		{Azure, "AppService", CategoryServerless},
+		{Azure, "AzureCloud", CategoryCompute},
+		// Services are per provider
+		{Gcp, "CLOUDFRONT", CategoryCompute},
+		{Ovh, "", CategoryHosting},
+		{Unknown, "", CategoryUnknown},
+	}
+	for _, test := range tests {
+		if c := ServiceCategory(test.provider, test.service); c != test.category {
+			t.Errorf("Expected %s %q to be %q, got %q", test.provider, test.service, test.category, c)
+		}
+	}
+
+	p, err := Register("CorpEgress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Category() != CategoryUnknown {
+		t.Errorf("Expected a custom provider to have no category, got %q", p.Category())
+	}
+	SetCategory(p, CategoryEgress)
+	if ServiceCategory(p, "vpn") != CategoryEgress {
+		t.Errorf("Expected %s to be %q, got %q", p, CategoryEgress, p.Category())
+	}
+	SetCategory(p, CategoryUnknown)
+	if p.Category() != CategoryUnknown {
+		t.Errorf("Expected the category of %s to be reset, got %q", p, p.Category())
+	}
+}
+
+func TestParseCategory(t *testing.T) {
+	for _, c := range Categories {
+		if parsed, err := ParseCategory(" " + strings.ToUpper(c.String())); err != nil || parsed != c {
+			t.Errorf("Expected %q, got %q (%v)", c, parsed, err)
+		}
+	}
+	if c, err := ParseCategory(""); err != nil || c != CategoryUnknown {
+		t.Errorf("Expected the empty name to be CategoryUnknown, got %q (%v)", c, err)
+	}
+	if _, err := ParseCategory("database"); err == nil {
+		t.Errorf("Expected an error for an unknown category")
+	}
+}
+
+func TestRegisterConcurrent(t *testing.T) {
+	// Run with -race: lookups read the names while custom providers are registered
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 100 {
+			p, err := Register(fmt.Sprintf("ConcurrentCorp%d", i))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			SetCategory(p, CategoryHosting)
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			p, err := ParseProviderFold("concurrentcorp99")
+			if err != nil || p.String() != "ConcurrentCorp99" || !p.IsCustom() || p.Category() != CategoryHosting {
+				t.Errorf("Expected ConcurrentCorp99 to be registered, got %s (%v)", p, err)
+			}
+			return
+		default:
+			if Aws.String() != "Aws" || !Akamai.IsValid() || ServiceCategory(Aws, "CLOUDFRONT") != CategoryCDN {
+				t.Fatalf("Expected the built-in providers to stay valid")
+			}
+			if _, err := ParseProvider("Gcp"); err != nil {
+				t.Fatal(err)
+			}
+			_, _ = ParseProviderFold("concurrentcorp50")
+		}
+	}
+}